@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+   Archival copies. With archive set to monthly, weekly or yearly, the first
+   successful dump of each period is copied server-side to
+   <prefix>/archive/<database>/. Retention only ever looks at the direct
+   children of <prefix>/<database>/, so archived dumps are kept forever.
+*/
+
+// periodStart returns the start (UTC) of the archive period containing t.
+// Weeks start on Monday.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case "yearly":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	case "weekly":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func archivePrefix(b Backup, dest Destination) string {
+	return path.Join(b.rootPrefix(dest), "archive", b.keyName()) + "/"
+}
+
+// archiveIfFirst copies key into the archive prefix unless a dump from the
+// same period is already archived there.
+func archiveIfFirst(ctx context.Context, b Backup, dest Destination, key string) error {
+	ts, ok := dumpTime(key, b.dumpPrefix())
+	if !ok {
+		return fmt.Errorf("no timestamp in key %s", key)
+	}
+	start := periodStart(b.Archive, ts)
+	prefix := archivePrefix(b, dest)
+	store := dest.store()
+
+	var objs []s3Object
+	err := storageOp(ctx, dest, "list "+store.url(prefix), pruneTimeout, func(ctx context.Context) error {
+		var err error
+		objs, err = store.list(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if t, ok := dumpTime(o.Key, b.dumpPrefix()); ok && !t.Before(start) {
+			return nil
+		}
+	}
+
+	copies := []string{key}
+	if b.WriteManifest {
+		copies = append(copies, manifestKey(key))
+	}
+	for _, src := range copies {
+		dst := prefix + path.Base(src)
+		err := storageOp(ctx, dest, "copy "+src, 0, func(ctx context.Context) error {
+			return store.copy(ctx, src, dst)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("[archive] %s: first %s dump since %s archived as %s", b.Name, strings.TrimSuffix(b.Archive, "ly"),
+		start.Format("2006-01-02"), store.url(prefix+path.Base(key)))
+	return nil
+}
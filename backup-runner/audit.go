@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+   audit lists every dump in the object-store destinations together with the
+   state of its manifest sidecar (writeManifest), so a damaged or incomplete
+   bucket shows up before a restore needs it. Without --verify only listings
+   and the manifests are read: a dump is ok when its manifest is there and
+   agrees on the size. --verify also downloads each dump with a manifest and
+   compares its SHA-256. A dump written by a backup with writeManifest whose
+   manifest is missing is flagged, as is a manifest without its dump. The
+   exit status is 1 if anything was flagged.
+*/
+
+// Audit statuses. The first four are problems.
+const (
+	auditMissingSidecar   = "missing-sidecar"
+	auditBadSidecar       = "bad-sidecar"
+	auditSizeMismatch     = "size-mismatch"
+	auditChecksumMismatch = "checksum-mismatch"
+	auditOrphanSidecar    = "orphan-sidecar"
+	auditVerified         = "verified"
+	auditOK               = "ok"
+	auditNoSidecar        = "no-sidecar"
+)
+
+type auditEntry struct {
+	Destination  string    `json:"destination"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Status       string    `json:"status"`
+	Detail       string    `json:"detail,omitempty"`
+	// Description is the description and database comment from the
+	// manifest.
+	Description string `json:"description,omitempty"`
+}
+
+func (e auditEntry) problem() bool {
+	switch e.Status {
+	case auditOK, auditVerified, auditNoSidecar:
+		return false
+	}
+	return true
+}
+
+func auditCmd(args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	destName := fs.String("destination", "", "audit only this destination")
+	verify := fs.Bool("verify", false, "download every dump with a manifest and check its SHA-256")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner audit [--destination name] [--verify] [--json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if _, ok := cfg.Destinations[*destName]; *destName != "" && !ok {
+		fmt.Fprintf(os.Stderr, "unknown destination %q\n", *destName)
+		return 2
+	}
+
+	var names []string
+	for name, d := range cfg.Destinations {
+		if d.Type != "restic" && (*destName == "" || name == *destName) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ctx := context.Background()
+	var entries []auditEntry
+	failed := false
+	for _, name := range names {
+		es, err := auditDestination(ctx, cfg, name, *verify)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		entries = append(entries, es...)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+		enc.Encode(entries)
+	} else {
+		printAudit(entries)
+	}
+	for _, e := range entries {
+		failed = failed || e.problem()
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func printAudit(entries []auditEntry) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tDESTINATION\tKEY\tSIZE\tMODIFIED\tDESCRIPTION\tDETAIL")
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Status, e.Destination, e.Key, ByteSize(e.Size), e.LastModified.UTC().Format(time.RFC3339), e.Description, e.Detail)
+	}
+	tw.Flush()
+	var summary []string
+	for _, s := range []string{auditVerified, auditOK, auditNoSidecar, auditMissingSidecar, auditBadSidecar, auditSizeMismatch, auditChecksumMismatch, auditOrphanSidecar} {
+		if counts[s] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[s], s))
+		}
+	}
+	if len(summary) == 0 {
+		summary = []string{"no dumps"}
+	}
+	fmt.Println("\n" + strings.Join(summary, ", "))
+}
+
+// auditDestination audits every dump under the named destination's prefix.
+func auditDestination(ctx context.Context, cfg Config, name string, verify bool) ([]auditEntry, error) {
+	dest := cfg.Destinations[name]
+	root := strings.Trim(dest.Prefix, "/")
+	if root != "" {
+		root += "/"
+	}
+	var objs []s3Object
+	err := storageOp(ctx, dest, "list "+dest.store().url(root), 0, func(ctx context.Context) error {
+		var err error
+		objs, err = dest.store().list(ctx, root)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byKey := map[string]s3Object{}
+	for _, o := range objs {
+		byKey[o.Key] = o
+	}
+	expects := manifestExpectations(cfg, name)
+	dumps := map[string]bool{}
+	var entries []auditEntry
+	for _, o := range objs {
+		if !isAnyDumpKey(o.Key) {
+			continue
+		}
+		dumps[manifestKey(o.Key)] = true
+		e := auditEntry{Destination: name, Key: o.Key, Size: o.Size, LastModified: o.LastModified}
+		if m, ok := byKey[manifestKey(o.Key)]; ok {
+			e.Status, e.Detail, e.Description = auditManifest(ctx, dest, o, m, verify)
+		} else if expects(o.Key) {
+			e.Status, e.Detail = auditMissingSidecar, "no "+path.Base(manifestKey(o.Key))
+		} else {
+			e.Status = auditNoSidecar
+		}
+		entries = append(entries, e)
+	}
+	for _, o := range objs {
+		if isManifestKey(o.Key) && !dumps[o.Key] {
+			entries = append(entries, auditEntry{Destination: name, Key: o.Key, Size: o.Size, LastModified: o.LastModified, Status: auditOrphanSidecar, Detail: "manifest without its dump"})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// isAnyDumpKey reports whether key is a dump or bundle of any backup.
+func isAnyDumpKey(key string) bool {
+	for _, kind := range []string{"pgdump-", "pgbundle-"} {
+		for _, mode := range []string{"", "schema-", "data-"} {
+			if isDumpKey(key, kind+mode) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isManifestKey reports whether key is named like a dump's manifest.
+func isManifestKey(key string) bool {
+	base := path.Base(key)
+	if !strings.HasSuffix(base, ".json") {
+		return false
+	}
+	return isAnyDumpKey(strings.TrimSuffix(key, ".json") + ".dump")
+}
+
+// manifestExpectations returns whether a dump key on the named destination
+// was written by a backup with writeManifest. Discovery backups write one
+// directory per database below their tier.
+func manifestExpectations(cfg Config, name string) func(key string) bool {
+	dest := cfg.Destinations[name]
+	dirs, parents := map[string]bool{}, map[string]bool{}
+	for _, b := range cfg.Backups {
+		if b.Destination != name || !b.WriteManifest {
+			continue
+		}
+		if b.Discover && !b.Bundle {
+			parents[filepath.Join(b.rootPrefix(dest), b.Tier)] = true
+		} else {
+			for _, b := range b.members() {
+				dirs[strings.TrimSuffix(basePrefix(b, dest), "/")] = true
+			}
+		}
+	}
+	return func(key string) bool {
+		dir := strings.TrimLeft(path.Dir(key), "/")
+		return dirs[dir] || parents[strings.Trim(path.Dir(dir), "./")]
+	}
+}
+
+// auditManifest checks dump o against its manifest object m.
+func auditManifest(ctx context.Context, dest Destination, o, m s3Object, verify bool) (status, detail, description string) {
+	dir, err := os.MkdirTemp("", "pgbackup-audit-")
+	if err != nil {
+		return auditBadSidecar, err.Error(), ""
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "manifest.json")
+	err = storageOp(ctx, dest, "download "+m.Key, 0, func(ctx context.Context) error {
+		return dest.store().get(ctx, m.Key, file)
+	})
+	if err != nil {
+		return auditBadSidecar, fmt.Sprintf("download: %v", err), ""
+	}
+	var man Manifest
+	body, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(body, &man)
+	}
+	if err != nil {
+		return auditBadSidecar, err.Error(), ""
+	}
+	if man.Size != o.Size {
+		return auditSizeMismatch, fmt.Sprintf("manifest says %d bytes", man.Size), man.describe()
+	}
+	if !verify {
+		return auditOK, "", man.describe()
+	}
+	if man.SHA256 == "" {
+		return auditBadSidecar, "manifest has no sha256", man.describe()
+	}
+	dump := filepath.Join(dir, "dump")
+	err = storageOp(ctx, dest, "download "+o.Key, 0, func(ctx context.Context) error {
+		return dest.store().get(ctx, o.Key, dump)
+	})
+	if err != nil {
+		return auditChecksumMismatch, fmt.Sprintf("download: %v", err), man.describe()
+	}
+	sum, err := fileSHA256(dump)
+	if err != nil {
+		return auditChecksumMismatch, err.Error(), man.describe()
+	}
+	if sum != man.SHA256 {
+		return auditChecksumMismatch, fmt.Sprintf("sha256 %s, manifest says %s", sum, man.SHA256), man.describe()
+	}
+	return auditVerified, "", man.describe()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Compression level tuning. With compressionAutoTune the level isn't fixed
+   but follows how long runs take against a window, the time a run may
+   take: a run that finished in under half the window leaves room for a
+   higher level next time, one that took more than 90% of it gets a lower
+   one, anything in between keeps the level. The level stays within
+   minLevel and maxLevel and starts at compressionLevel (or the
+   compressor's default). It is kept in memory, so it starts over after a
+   restart. Only successful runs count, and every run logs the level it
+   uses and why.
+*/
+
+const (
+	autoTuneRaiseBelow = 0.5
+	autoTuneLowerAbove = 0.9
+)
+
+type AutoTune struct {
+	MinLevel int `yaml:"minLevel"`
+	MaxLevel int `yaml:"maxLevel"`
+	// Window is how long a run may take, e.g. the gap before the next
+	// scheduled job on the server.
+	Window time.Duration `yaml:"window"`
+}
+
+func (a AutoTune) enabled() bool { return a.Window > 0 || a.MinLevel != 0 || a.MaxLevel != 0 }
+
+// validate checks a against b's resolved compressor.
+func (a AutoTune) validate(b Backup) error {
+	if !a.enabled() {
+		return nil
+	}
+	if b.Compression == "" && b.pgDumpCompress == "" {
+		return fmt.Errorf("compressionAutoTune needs compression")
+	}
+	if a.Window <= 0 {
+		return fmt.Errorf("compressionAutoTune needs window")
+	}
+	top := 9
+	if b.Compression == "zstd" || strings.HasPrefix(b.pgDumpCompress, "zstd") {
+		top = 19
+	}
+	if a.MinLevel < 1 || a.MaxLevel < a.MinLevel || a.MaxLevel > top {
+		return fmt.Errorf("compressionAutoTune: need 1 <= minLevel <= maxLevel <= %d, got %d-%d", top, a.MinLevel, a.MaxLevel)
+	}
+	for _, r := range b.Rules {
+		if r.compresses() {
+			return fmt.Errorf("compressionAutoTune can't be combined with rules that set compression")
+		}
+	}
+	return nil
+}
+
+type tuneState struct {
+	level  int
+	reason string
+}
+
+var (
+	tuneMu sync.Mutex
+	tuned  = map[string]tuneState{}
+)
+
+// defaultLevel is the level b's compressor uses when none is given.
+func (b Backup) defaultLevel() int {
+	if b.Compression == "zstd" || strings.HasPrefix(b.pgDumpCompress, "zstd") {
+		return 3
+	}
+	return 6
+}
+
+// withTunedLevel returns b compressing at its tuned level, logging it.
+func withTunedLevel(b Backup) Backup {
+	a := b.CompressionAutoTune
+	if !a.enabled() {
+		return b
+	}
+	tuneMu.Lock()
+	st, ok := tuned[b.Name]
+	if !ok || st.level < a.MinLevel || st.level > a.MaxLevel {
+		start := min(max(cmp.Or(b.CompressionLevel, b.defaultLevel()), a.MinLevel), a.MaxLevel)
+		st = tuneState{level: start, reason: "no run measured yet, starting at " + strconv.Itoa(start)}
+		tuned[b.Name] = st
+	}
+	tuneMu.Unlock()
+	log.Printf("[backup] %s: compression level %d (autoTune %d-%d): %s", b.Name, st.level, a.MinLevel, a.MaxLevel, st.reason)
+	b.CompressionLevel = st.level
+	switch {
+	case strings.HasPrefix(b.pgDumpCompress, "zstd"):
+		b.pgDumpCompress = "zstd:" + strconv.Itoa(st.level)
+	case b.pgDumpCompress != "":
+		// pg_dump's zlib, which zstd fell back to.
+		b.pgDumpCompress = strconv.Itoa(min(st.level, 9))
+	}
+	return b
+}
+
+// recordTuning picks the level of b's next run from how long r took.
+func recordTuning(b Backup, r RunResult) {
+	a := b.CompressionAutoTune
+	if !a.enabled() || r.Err != nil || r.Skipped {
+		return
+	}
+	tuneMu.Lock()
+	defer tuneMu.Unlock()
+	st, ok := tuned[b.Name]
+	if !ok {
+		return
+	}
+	share := r.Duration.Seconds() / a.Window.Seconds()
+	took := fmt.Sprintf("last run took %s of the %s window", r.Duration.Round(time.Second), a.Window)
+	switch {
+	case share < autoTuneRaiseBelow && st.level < a.MaxLevel:
+		st = tuneState{st.level + 1, fmt.Sprintf("%s, raised from %d", took, st.level)}
+	case share < autoTuneRaiseBelow:
+		st.reason = took + ", already at maxLevel"
+	case share > autoTuneLowerAbove && st.level > a.MinLevel:
+		st = tuneState{st.level - 1, fmt.Sprintf("%s, lowered from %d", took, st.level)}
+	case share > autoTuneLowerAbove:
+		st.reason = took + ", already at minLevel"
+	default:
+		st.reason = took + ", kept"
+	}
+	tuned[b.Name] = st
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+   Backblaze B2 destinations (type: b2) use the native B2 API through the `b2`
+   command line tool instead of B2's S3-compatible endpoint. accessKey and
+   secretKey are the application key id and application key. Keys, pruning
+   and restore work exactly as for S3.
+*/
+
+type b2Store struct{ d Destination }
+
+func (s b2Store) command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "b2", args...)
+	s.d = s.d.current()
+	cmd.Env = append(os.Environ(),
+		"B2_APPLICATION_KEY_ID="+s.d.Access,
+		"B2_APPLICATION_KEY="+s.d.Secret,
+		"B2_USER_AGENT_APPEND="+strings.TrimSpace("pg-backup/"+version+" "+s.d.UserAgent),
+	)
+	return cmd
+}
+
+func (s b2Store) url(key string) string {
+	return "b2://" + s.d.Bucket + "/" + strings.TrimLeft(key, "/")
+}
+
+func (s b2Store) put(ctx context.Context, key, file string) error {
+	cmd := s.command(ctx, "file", "upload", "--no-progress", s.d.Bucket, file, strings.TrimLeft(key, "/"))
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func (s b2Store) get(ctx context.Context, key, file string) error {
+	cmd := s.command(ctx, "file", "download", "--no-progress", s.url(key), file)
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func (s b2Store) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	out, err := outputCaptured(s.command(ctx, "ls", "--recursive", "--json", s.url(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	var files []struct {
+		FileName        string `json:"fileName"`
+		ContentLength   int64  `json:"contentLength"`
+		ContentSha1     string `json:"contentSha1"`
+		UploadTimestamp int64  `json:"uploadTimestamp"`
+		Action          string `json:"action"`
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return nil, fmt.Errorf("parse b2 ls output: %w", err)
+	}
+	objs := make([]s3Object, 0, len(files))
+	for _, f := range files {
+		if f.Action != "" && f.Action != "upload" {
+			continue
+		}
+		objs = append(objs, s3Object{
+			Key:          f.FileName,
+			LastModified: time.UnixMilli(f.UploadTimestamp).UTC(),
+			Size:         f.ContentLength,
+			ETag:         f.ContentSha1,
+		})
+	}
+	return objs, nil
+}
+
+// remove deletes every version of each key, so pruned dumps don't linger as
+// hidden versions that still count towards storage.
+func (s b2Store) remove(ctx context.Context, keys []string) ([]string, error) {
+	for _, k := range keys {
+		cmd := s.command(ctx, "rm", "--versions", s.url(k))
+		cmd.Stdout = os.Stdout
+		if err := runCaptured(cmd, nil); err != nil {
+			return nil, fmt.Errorf("b2 rm %s: %w", k, err)
+		}
+	}
+	return nil, nil
+}
+
+func (s b2Store) copy(ctx context.Context, src, dst string) error {
+	cmd := s.command(ctx, "file", "server-side-copy", s.url(src), s.url(dst))
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func (s b2Store) exists(ctx context.Context, key string) (bool, error) {
+	objs, err := s.list(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	for _, o := range objs {
+		if o.Key == strings.TrimLeft(key, "/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s b2Store) size(ctx context.Context, key string) (int64, error) {
+	objs, err := s.list(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	for _, o := range objs {
+		if o.Key == strings.TrimLeft(key, "/") {
+			return o.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("%s not found", s.url(key))
+}
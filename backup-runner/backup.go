@@ -0,0 +1,599 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// job is a scheduled backup. The mutex is an overlap lock: a run that finds it
+// held is skipped rather than queued, so a slow dump is never doubled up by
+// the next tick or a startup run. It is shared per backup name, so a run
+// still in flight across a config reload keeps blocking the new job.
+type job struct {
+	b    Backup
+	dest Destination
+	mu   *sync.Mutex
+}
+
+var (
+	jobLocksMu sync.Mutex
+	jobLocks   = map[string]*sync.Mutex{}
+)
+
+func newJob(b Backup, dest Destination) *job {
+	jobLocksMu.Lock()
+	defer jobLocksMu.Unlock()
+	mu, ok := jobLocks[b.Name]
+	if !ok {
+		mu = &sync.Mutex{}
+		jobLocks[b.Name] = mu
+	}
+	return &job{b: b, dest: dest, mu: mu}
+}
+
+// run runs the backup once. queued, if not nil, is called as soon as the
+// run holds a worker slot or waits in the queue for one, or has been
+// skipped or dropped.
+func (j *job) run(trigger string, queued func()) {
+	if queued == nil {
+		queued = func() {}
+	}
+	queued = sync.OnceFunc(queued)
+	defer queued()
+	if !j.mu.TryLock() {
+		log.Printf("[backup] %s: previous run still in progress or queued, skipping %s run", j.b.Name, trigger)
+		return
+	}
+	defer j.mu.Unlock()
+	if !runPool.acquire(j.b.Name, trigger, queued) {
+		return
+	}
+	defer runPool.release()
+	// The daemon's runs have no deadline.
+	ctx := context.Background()
+	var res RunResult
+	if len(j.b.fanoutTo) > 0 {
+		// Every destination goes through its own breaker; see fanout.go.
+		res = runBackup(ctx, j.b, j.dest)
+	} else if err := admit(j.b, j.dest); err != nil {
+		res = RunResult{Backup: j.b.Name, Started: time.Now()}
+		res.fail(PhaseUpload, err)
+		res.Retryable = false
+	} else {
+		res = runBackup(ctx, j.b, j.dest)
+		observe(j.b, j.dest, res)
+	}
+	report(j.b, res)
+	writeReport("daemon", []RunResult{res})
+}
+
+// runOnStart triggers one run at startup. Failures, including panics, are
+// logged and never take the daemon down.
+func (j *job) runOnStart(queued func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[backup] %s: startup run panicked: %v", j.b.Name, r)
+		}
+	}()
+	log.Printf("[backup] %s: running on start", j.b.Name)
+	j.run("startup", queued)
+}
+
+// runAllOnStart starts the startup runs of jobs by priority, highest
+// first and in config order among equal ones. Each run is queued before
+// the next is started, so with workers set they take the free slots and
+// then the queue in that order.
+func runAllOnStart(jobs []*job) {
+	jobs = slices.Clone(jobs)
+	slices.SortStableFunc(jobs, func(a, b *job) int { return cmp.Compare(b.b.Priority, a.b.Priority) })
+	for _, j := range jobs {
+		queued := make(chan struct{})
+		go j.runOnStart(func() { close(queued) })
+		<-queued
+	}
+}
+
+// byPriority orders backups for run: highest priority first, in config
+// order among equal ones.
+func byPriority(backups []Backup) []Backup {
+	backups = slices.Clone(backups)
+	slices.SortStableFunc(backups, func(a, b Backup) int { return cmp.Compare(b.Priority, a.Priority) })
+	return backups
+}
+
+func runBackup(ctx context.Context, b Backup, dest Destination) (res RunResult) {
+	b = withTunedLevel(b)
+	if b.dumpsGlobals(dest) {
+		defer func() {
+			if res.Err == nil && !res.Skipped {
+				res.GlobalsErr = storeGlobals(ctx, b, dest)
+				res.Duration = time.Since(res.Started)
+			}
+		}()
+	}
+	publishStarted(b)
+	if b.Discover && !b.Bundle {
+		return runDiscovery(ctx, b, dest)
+	}
+	if len(b.Parts) > 0 {
+		return runParts(ctx, b, dest)
+	}
+	defer startRun(b.Name)()
+	ws, err := newWorkspace(ctx, dest)
+	if err != nil {
+		return workspaceFailure(b, err)
+	}
+	defer removeWorkspace(ws)
+	res, out := dumpBackup(ctx, b, dest, ws)
+	if out == "" {
+		return res
+	}
+	return store(ctx, b, dest, res, out)
+}
+
+// workRoot is where per-run workspaces are created.
+const workRoot = "/tmp"
+
+// newWorkspace creates the directory a run writes all its files to: the
+// dump and whatever compression, bundling or manifests derive from it. The
+// caller removes it as a whole with removeWorkspace when the run ends,
+// however it ends, so no stage has to clean up after itself. Resumable
+// uploads need the workspace to outlive a crash, so it goes on the /backups
+// volume for them.
+func newWorkspace(ctx context.Context, dest Destination) (string, error) {
+	root := workRoot
+	if dest.resumable() {
+		if err := os.MkdirAll(resumeRoot, 0o700); err != nil {
+			return "", err
+		}
+		root = resumeRoot
+	}
+	ws, err := os.MkdirTemp(root, "pgbackup-run-")
+	if err == nil {
+		trackWorkspace(ctx, ws)
+	}
+	return ws, err
+}
+
+func workspaceFailure(b Backup, err error) RunResult {
+	res := RunResult{Backup: b.Name, Started: time.Now()}
+	res.fail(PhaseDump, fmt.Errorf("workspace: %w", err))
+	return res
+}
+
+// dumpBackup runs the pre-dump checks and the dump itself into ws. out is
+// the finished dump, or empty if the run failed or was skipped. res.Key is
+// set if the dump was already uploaded while it was written.
+func dumpBackup(ctx context.Context, b Backup, dest Destination, ws string) (res RunResult, out string) {
+	res = RunResult{Backup: b.Name, Started: time.Now()}
+	defer func() { res.Duration = time.Since(res.Started) }()
+	fail := func(phase Phase, err error) (RunResult, string) {
+		res.fail(phase, err)
+		return res, ""
+	}
+
+	log.Printf("[backup] start %s", redactConn(b.URL))
+	if ok, err := checkPrecondition(ctx, b); err != nil {
+		return fail(PhasePrecheck, err)
+	} else if !ok {
+		log.Printf("[backup] %s: precondition is false, nothing to back up", b.Name)
+		res.Skipped = true
+		return res, ""
+	}
+	if b.SkipUnchanged {
+		if res.WalLSN, res.Unchanged = checkUnchanged(ctx, b, dest); res.Unchanged {
+			res.Skipped = true
+			return res, ""
+		}
+	}
+	if !checkDbSize(ctx, b) || !checkFreeSpace(b, ws) {
+		res.Skipped = true
+		return res, ""
+	}
+	if err := checkPgDumpVersion(ctx, b); err != nil {
+		res, out = fail(PhasePrecheck, err)
+		res.Retryable = false
+		return res, out
+	}
+	if len(b.ExcludeTableData) > 0 {
+		log.Printf("[backup] WARNING: %s: data of tables matching %s is excluded and can't be restored from this backup",
+			b.Name, strings.Join(b.ExcludeTableData, ", "))
+	}
+	setRunPhase(b.Name, PhaseDump)
+	dump := runPgDump
+	if b.Bundle {
+		dump = runBundleDump
+	}
+	if b.Stream != "" {
+		dump = streamDumpFor(dest, &res)
+	}
+	out, err := dumpRetryingLocks(ctx, b, ws, dump)
+	var pe *phaseError
+	if errors.As(err, &pe) {
+		return fail(pe.phase, err)
+	}
+	if err != nil {
+		return fail(PhaseDump, fmt.Errorf("pg_dump: %w", err))
+	}
+	// peak is the most the run has on disk at once: the dump, and while
+	// compressing also the compressed copy.
+	var peak int64
+	if st, err := os.Stat(out); err == nil {
+		peak = st.Size()
+	}
+	if b.skipsCompression(peak) {
+		log.Printf("[backup] %s: dump is %s, below compressMinSize %s, storing it uncompressed",
+			b.Name, ByteSize(peak), b.CompressMinSize)
+	} else if b.Compression != "" && b.Stream == "" {
+		setRunPhase(b.Name, PhaseCompress)
+		compressed, err := compressFile(ctx, b, out)
+		if err != nil {
+			return fail(PhaseCompress, err)
+		}
+		out = compressed
+		res.RawSize = peak
+	}
+	if st, err := os.Stat(out); err == nil {
+		res.Size = st.Size()
+	}
+	if r := res.compressionRatio(); r > 0 {
+		log.Printf("[backup] %s: %s compressed %s to %s, ratio %.2f",
+			b.Name, b.Compression, ByteSize(res.RawSize), ByteSize(res.Size), r)
+	}
+	if b.Compression != "" && b.Stream == "" && b.compressed(out) {
+		peak += res.Size
+	}
+	recordPeakUsage(b.Name, peak)
+	if err := checkDumpSize(ctx, b, res.Size); err != nil {
+		if res.Key != "" {
+			removeStreamed(ctx, b, dest, res.Key)
+			res.Key = ""
+		}
+		return fail(PhaseDump, err)
+	}
+	return res, out
+}
+
+// storeBackup uploads a finished dump and applies retention.
+func storeBackup(ctx context.Context, b Backup, dest Destination, dumped RunResult, out string) (res RunResult) {
+	res = dumped
+	defer func() { res.Duration = time.Since(res.Started) }()
+	fail := func(phase Phase, err error) RunResult {
+		res.fail(phase, err)
+		return res
+	}
+	setRunPhase(b.Name, PhaseUpload)
+
+	if dest.Type == "restic" {
+		err := storageOp(ctx, dest, "restic backup "+b.Name, 0, func(ctx context.Context) error {
+			return resticBackup(ctx, b, dest, out)
+		})
+		if err != nil {
+			return fail(PhaseUpload, err)
+		}
+		log.Printf("[backup] stored %s in restic repository %s", b.Name, dest.Repository)
+		if b.hasRetention() {
+			res.PruneErr = pruneHistory(ctx, b, dest, "")
+		}
+		if b.PostMaintenance != nil {
+			postMaintenance(ctx, b)
+		}
+		return res
+	}
+
+	up, err := uploadDump(ctx, b, dest, &res, out)
+	if err != nil {
+		return res
+	}
+	var (
+		rb         Backup
+		rup        uploaded
+		replicated bool
+	)
+	if b.replica != nil {
+		rb, rup, replicated = replicate(ctx, b, dest, &res, out)
+	}
+	keepLocal(ctx, b, &res, out)
+	applyRetention(ctx, b, dest, &res, up)
+	if replicated {
+		applyRetention(ctx, rb, b.replica.dest, &res, rup)
+	}
+	if b.PostMaintenance != nil {
+		postMaintenance(ctx, b)
+	}
+	up.finish(ctx, b, dest)
+	return res
+}
+
+// uploaded is a dump stored on a destination, waiting for retention and
+// its latest pointer.
+type uploaded struct {
+	basePrefix string
+	latest     latestPointer
+	latestErr  error
+}
+
+// uploadDump stores out on dest and does everything that belongs to the
+// object itself: verification, checksum, object lock, manifest and
+// archive. A failure is recorded in res and returned.
+func uploadDump(ctx context.Context, b Backup, dest Destination, res *RunResult, out string) (uploaded, error) {
+	setRunPhase(b.Name, PhaseUpload)
+	// Streamed dumps are uploaded already.
+	key := res.Key
+	var manifest *Manifest
+	if key == "" {
+		var err error
+		if key, err = dumpKey(ctx, b, dest, b.fileDumpExt(out)); err != nil {
+			res.fail(PhaseUpload, err)
+			return uploaded{}, err
+		}
+		if dest.resumable() {
+			manifest, err = resumableUpload(ctx, b, dest, *res, key, out)
+		} else {
+			err = storageOp(ctx, dest, "upload "+key, 0, func(ctx context.Context) error {
+				return dest.store().put(ctx, key, out)
+			})
+		}
+		if err != nil {
+			res.fail(PhaseUpload, err)
+			return uploaded{}, err
+		}
+	}
+	return finishUpload(ctx, b, dest, res, key, out, manifest)
+}
+
+// finishUpload does what belongs to the dump out once it is uploaded to
+// key: everything uploadDump does after the upload. manifest, if not nil,
+// is the dump's manifest, built before the upload.
+func finishUpload(ctx context.Context, b Backup, dest Destination, res *RunResult, key, out string, manifest *Manifest) (uploaded, error) {
+	fail := func(phase Phase, err error) (uploaded, error) {
+		res.fail(phase, err)
+		return uploaded{}, err
+	}
+	up := uploaded{basePrefix: basePrefix(b, dest)}
+	if dest.VerifyUpload {
+		if err := verifyUpload(ctx, dest, key, out); err != nil {
+			return fail(PhaseUpload, fmt.Errorf("verify upload: %w", err))
+		}
+	}
+	res.Key = key
+	log.Printf("[backup] uploaded %s", dest.store().url(key))
+	if catalogEnabled() {
+		res.SHA256, _ = fileSHA256(out)
+	}
+
+	if dest.ChecksumAlgorithm != "" {
+		if err := confirmChecksum(ctx, dest, key, out); err != nil {
+			return fail(PhaseUpload, fmt.Errorf("checksum: %w", err))
+		}
+	}
+
+	if dest.ObjectLockRetention > 0 {
+		until := time.Now().Add(dest.ObjectLockRetention)
+		err := storageOp(ctx, dest, "retention "+key, 0, func(ctx context.Context) error {
+			return awsPutRetention(ctx, dest, key, dest.ObjectLockMode, until)
+		})
+		if err != nil {
+			return fail(PhaseUpload, fmt.Errorf("object lock retention: %w", err))
+		}
+		log.Printf("[backup] %s locked (%s) until %s", key, dest.ObjectLockMode, until.UTC().Format(time.RFC3339))
+	}
+
+	if b.WriteManifest {
+		var err error
+		if manifest != nil {
+			err = putManifest(ctx, dest, key, out, *manifest)
+		} else {
+			err = uploadManifest(ctx, b, dest, key, out, *res)
+		}
+		if err != nil {
+			log.Printf("[backup] manifest upload failed: %v", err)
+		}
+	}
+
+	// Described now, while out is still there; written last.
+	if b.LatestPointer {
+		up.latest, up.latestErr = newLatest(b, key, out)
+	}
+
+	if b.Archive != "" {
+		if err := archiveIfFirst(ctx, b, dest, key); err != nil {
+			log.Printf("[archive] WARNING: %s: archiving %s failed: %v", b.Name, key, err)
+			notify("archive_failed", fmt.Sprintf("archiving %s for %s failed: %v", key, b.Name, err), map[string]any{
+				"backup": b.Name,
+				"key":    key,
+				"error":  err.Error(),
+			})
+		}
+	}
+
+	return up, nil
+}
+
+// keepLocal keeps out in localCopyDir, if that exists.
+func keepLocal(ctx context.Context, b Backup, res *RunResult, out string) {
+	if _, err := os.Stat(localCopyDir); err != nil {
+		return
+	}
+	keep := keepLocalCopy
+	if b.LocalEncryption.enabled() {
+		keep = func(out string) error { return keepEncryptedCopy(ctx, b.LocalEncryption, out) }
+	}
+	if err := keep(out); err != nil {
+		log.Printf("[backup] WARNING: %s: no local copy in %s, the upload is the only copy: %v", b.Name, localCopyDir, err)
+		res.LocalCopyErr = err
+	}
+}
+
+// applyRetention prunes b's dumps on dest after an upload. The upload
+// already succeeded; a prune failure is recorded on the result but never
+// turns into a failed backup. It is returned as well, for the destination's
+// own report.
+func applyRetention(ctx context.Context, b Backup, dest Destination, res *RunResult, up uploaded) error {
+	if !b.hasRetention() {
+		return nil
+	}
+	setRunPhase(b.Name, PhasePrune)
+	err := pruneHistory(ctx, b, dest, up.basePrefix)
+	res.PruneErr = errors.Join(res.PruneErr, err)
+	return err
+}
+
+// finish writes the latest pointer. It comes last, so the pointer never
+// names a dump whose run didn't finish.
+func (up uploaded) finish(ctx context.Context, b Backup, dest Destination) {
+	if !b.LatestPointer {
+		return
+	}
+	err := up.latestErr
+	if err == nil {
+		err = putLatest(ctx, dest, latestKey(b, up.basePrefix), up.latest)
+	}
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: updating %s failed: %v", b.Name, latestKey(b, up.basePrefix), err)
+	}
+}
+
+// dumpKey picks the key a new dump of b with extension ext is uploaded to.
+func dumpKey(ctx context.Context, b Backup, dest Destination, ext string) (string, error) {
+	ts := time.Now().UTC().Format(tsLayout)
+	return resolveKeyCollision(ctx, b, dest, basePrefix(b, dest)+b.dumpPrefix()+ts, ext)
+}
+
+// localCopyDir receives a copy of every uploaded dump if it exists, usually
+// a mounted volume.
+const localCopyDir = "/backups"
+
+// keepLocalCopy moves a dump into localCopyDir, copying it when that is on
+// another filesystem. A partial copy is removed; the caller removes out.
+func keepLocalCopy(out string) error {
+	dst := filepath.Join(localCopyDir, filepath.Base(out))
+	err := os.Rename(out, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(out, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// verifyUpload checks that key holds as many bytes as the local file, so a
+// truncated upload that the CLI still reported as done fails the run instead
+// of letting retention delete the previous good dump.
+func verifyUpload(ctx context.Context, dest Destination, key, file string) error {
+	st, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	var size int64
+	err = storageOp(ctx, dest, "head "+key, 0, func(ctx context.Context) error {
+		var err error
+		size, err = dest.store().size(ctx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if size != st.Size() {
+		return fmt.Errorf("%s has %d bytes, local file has %d", dest.store().url(key), size, st.Size())
+	}
+	return nil
+}
+
+// confirmChecksum reads back the checksum S3 stored for key. S3 already
+// rejected the upload if it didn't match what the CLI sent; for SHA256 on a
+// single-part upload it is also compared against the local file.
+func confirmChecksum(ctx context.Context, dest Destination, key, file string) error {
+	var head s3Head
+	err := storageOp(ctx, dest, "head "+key, 0, func(ctx context.Context) error {
+		var err error
+		head, err = awsHeadObject(ctx, dest, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	remote := head.checksum(dest.ChecksumAlgorithm)
+	if remote == "" {
+		log.Printf("[backup] %s: S3 reported no %s checksum (endpoint may not support checksums)", key, dest.ChecksumAlgorithm)
+		return nil
+	}
+	if dest.ChecksumAlgorithm == "SHA256" && !strings.Contains(remote, "-") {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+		raw, _ := hex.DecodeString(sum)
+		if local := base64.StdEncoding.EncodeToString(raw); local != remote {
+			return fmt.Errorf("S3 has %s, local file is %s", remote, local)
+		}
+	}
+	log.Printf("[backup] S3 confirmed %s checksum %s for %s", dest.ChecksumAlgorithm, remote, key)
+	return nil
+}
+
+// resolveKeyCollision returns the key to upload to. With the default
+// "overwrite" strategy it is always stem+ext; "suffix" appends -2, -3, ... to
+// the stem until the key is free, and "fail" refuses to clobber an existing
+// object.
+func resolveKeyCollision(ctx context.Context, b Backup, dest Destination, stem, ext string) (string, error) {
+	key := stem + ext
+	if b.KeyCollision == "" || b.KeyCollision == "overwrite" {
+		return key, nil
+	}
+	for n := 2; ; n++ {
+		var exists bool
+		err := storageOp(ctx, dest, "head "+key, 0, func(ctx context.Context) error {
+			var err error
+			exists, err = dest.store().exists(ctx, key)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return key, nil
+		}
+		if b.KeyCollision == "fail" {
+			return "", fmt.Errorf("%s already exists", dest.store().url(key))
+		}
+		log.Printf("[backup] %s already exists, trying next suffix", dest.store().url(key))
+		key = fmt.Sprintf("%s-%d%s", stem, n, ext)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fakeBins puts scripts named after the tools they stand in for first on
+// the PATH.
+func fakeBins(t *testing.T, scripts map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// A run that fails after the dump, with the dump and partial outputs in its
+// workspace, leaves nothing behind, nor a deadline's record of the workspace.
+func TestFailedRunRemovesWorkspace(t *testing.T) {
+	storageBackoff = time.Millisecond
+	t.Cleanup(func() { storageBackoff = 5 * time.Second })
+	const pgDump = `[ "$1" = --version ] && { echo "pg_dump (PostgreSQL) 16.2"; exit 0; }
+for a; do out=$a; done
+head -c 100000 /dev/zero > "$out"`
+	for _, tc := range []struct {
+		name    string
+		scripts map[string]string
+		phase   Phase
+	}{
+		{"compression", map[string]string{
+			"pg_dump": pgDump,
+			"psql":    "echo 1",
+			"gzip":    "head -c 1000 >/dev/null; echo partial; exit 1",
+			"aws":     "exit 0",
+		}, PhaseCompress},
+		{"upload", map[string]string{
+			"pg_dump": pgDump,
+			"psql":    "echo 1",
+			"aws":     `echo "upload failed" >&2; exit 1`,
+		}, PhaseUpload},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeBins(t, tc.scripts)
+			before := runWorkspaces(t)
+			b := Backup{Name: "ws-test", URL: "postgres://db/app", Destination: "s3", Compression: "gzip"}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			res := runBackup(ctx, b, Destination{Bucket: "bucket"})
+			if res.Err == nil {
+				t.Fatal("run succeeded")
+			}
+			if res.Phase != tc.phase {
+				t.Errorf("failed in %s, want %s: %v", res.Phase, tc.phase, res.Err)
+			}
+			for _, ws := range runWorkspaces(t) {
+				if !slices.Contains(before, ws) {
+					t.Errorf("workspace %s left behind", ws)
+				}
+			}
+			workspacesMu.Lock()
+			defer workspacesMu.Unlock()
+			if len(workspaces) > 0 {
+				t.Errorf("removed workspaces still tracked: %v", workspaces)
+			}
+		})
+	}
+}
+
+func runWorkspaces(t *testing.T) []string {
+	t.Helper()
+	ws, err := filepath.Glob(filepath.Join(workRoot, "pgbackup-run-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+   benchmark compresses a sample of real data with every compressor and
+   level the runner supports and is installed, and prints how small and
+   how fast each came out, to choose compression and compressionLevel from
+   data rather than guesses. The sample is an existing local dump (--file,
+   e.g. a copy from /backups; compression and age layers are removed
+   first, into a temporary directory) or a fresh uncompressed dump of a
+   configured backup (--backup). Only the first --sample bytes are used, so
+   a large dump doesn't take hours. Each compressor runs as a backup run
+   would, with the same arguments (compressArgs), reading the sample and
+   writing nowhere.
+*/
+
+const defaultBenchmarkSample = 256 << 20
+
+// benchmarkLevels are the levels tried per compressor.
+var benchmarkLevels = map[string][]int{
+	"gzip": {1, 3, 6, 9},
+	"pigz": {1, 3, 6, 9},
+	"zstd": {1, 3, 6, 9, 12, 15, 19},
+}
+
+type benchmarkResult struct {
+	compressor string
+	level      int
+	size       int64
+	took       time.Duration
+}
+
+func (r benchmarkResult) ratio(in int64) float64 { return float64(in) / float64(max(r.size, 1)) }
+
+// speed is the input bytes compressed per second.
+func (r benchmarkResult) speed(in int64) float64 {
+	return float64(in) / max(r.took.Seconds(), 1e-9)
+}
+
+func benchmarkCmd(args []string) int {
+	fs := flag.NewFlagSet("benchmark", flag.ContinueOnError)
+	file := fs.String("file", "", "local dump to take the sample from")
+	name := fs.String("backup", "", "dump this backup for the sample instead")
+	ageIdentity := fs.String("age-identity", "", "age identity file for an encrypted --file")
+	sample := ByteSize(defaultBenchmarkSample)
+	fs.Func("sample", "bytes of the dump to compress, e.g. 1GiB (default 256MiB)", func(s string) error {
+		n, err := parseSize(s)
+		if err == nil && n <= 0 {
+			err = errors.New("must be positive")
+		}
+		sample = n
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner benchmark (--file dump | --backup name) [--sample size]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if (*file == "") == (*name == "") || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	dir, err := os.MkdirTemp(workRoot, "pgbackup-benchmark-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	var threads int
+	src := *file
+	if src != "" {
+		src, err = benchmarkFile(src, dir, *ageIdentity)
+	} else {
+		src, threads, err = benchmarkDump(ctx, *name, dir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	st, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	in := min(st.Size(), int64(sample))
+	fmt.Printf("sample: %s of %s\n\n", ByteSize(in), ByteSize(st.Size()))
+
+	var results []benchmarkResult
+	for _, c := range []string{"gzip", "pigz", "zstd"} {
+		if _, err := exec.LookPath(c); err != nil {
+			fmt.Printf("%s: not installed, skipped\n", c)
+			continue
+		}
+		for _, level := range benchmarkLevels[c] {
+			b := Backup{Compression: c, CompressionLevel: level, CompressionThreads: threads}
+			r, err := benchmarkOne(ctx, b, src, in)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s -%d: %v\n", c, level, err)
+				return 1
+			}
+			results = append(results, r)
+		}
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "no compressor installed")
+		return 1
+	}
+
+	slices.SortStableFunc(results, func(a, b benchmarkResult) int { return cmp.Compare(a.size, b.size) })
+	fmt.Println("\nby ratio:")
+	printBenchmark(results, in)
+	slices.SortStableFunc(results, func(a, b benchmarkResult) int { return cmp.Compare(a.took, b.took) })
+	fmt.Println("\nby speed:")
+	printBenchmark(results, in)
+	if best := slices.MinFunc(results, func(a, b benchmarkResult) int { return cmp.Compare(a.size, b.size) }); best.ratio(in) < 1.1 {
+		fmt.Println("\nThe sample barely compresses. If it is a custom-format dump pg_dump compressed itself, benchmark")
+		fmt.Println("an uncompressed one instead, e.g. with --backup.")
+	}
+	return 0
+}
+
+// benchmarkFile returns file without its compression and encryption
+// layers, removed into dir so nothing is written next to file.
+func benchmarkFile(file, dir, ageIdentity string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", err
+	}
+	// unwrapDump writes each step next to its input: next to the link.
+	link := filepath.Join(dir, filepath.Base(abs))
+	if err := os.Symlink(abs, link); err != nil {
+		return "", err
+	}
+	out, _, err := unwrapDump(link, ageIdentity)
+	return out, err
+}
+
+// benchmarkDump dumps the named backup uncompressed into dir. threads is
+// the backup's compressionThreads, which the benchmark uses too.
+func benchmarkDump(ctx context.Context, name, dir string) (out string, threads int, err error) {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	for _, b := range cfg.Backups {
+		if b.Name != name {
+			continue
+		}
+		if b.Discover || len(b.Parts) > 0 {
+			return "", 0, fmt.Errorf("backup %q dumps several databases or parts; benchmark one dump with --file", name)
+		}
+		threads = b.CompressionThreads
+		b.Compression, b.pgDumpCompress = "", "0"
+		fmt.Printf("dumping %s...\n", b.Name)
+		out, err := runPgDump(ctx, b, dir)
+		return out, threads, err
+	}
+	return "", 0, fmt.Errorf("unknown backup %q", name)
+}
+
+// benchmarkOne compresses the first n bytes of file as b would.
+func benchmarkOne(ctx context.Context, b Backup, file string, n int64) (benchmarkResult, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return benchmarkResult{}, err
+	}
+	defer f.Close()
+	r := benchmarkResult{compressor: b.Compression, level: b.CompressionLevel}
+	cmd := runCommand(ctx, b.Compression, compressArgs(b)...)
+	cmd.Stdin = io.LimitReader(f, n)
+	cmd.Stdout = &countingWriter{w: io.Discard, n: &r.size}
+	start := time.Now()
+	err = runCaptured(cmd, nil)
+	r.took = time.Since(start)
+	return r, err
+}
+
+func printBenchmark(results []benchmarkResult, in int64) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "COMPRESSOR\tLEVEL\tSIZE\tRATIO\tTIME\tSPEED\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.2f\t%s\t%s/s\t\n", r.compressor, r.level, ByteSize(r.size), r.ratio(in),
+			r.took.Round(time.Millisecond), ByteSize(int64(r.speed(in))))
+	}
+	tw.Flush()
+}
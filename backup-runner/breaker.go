@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+   Unreachable destinations. When a bucket is down, every backup writing to
+   it fails in the upload phase, each after a full dump, and each sends its
+   own backup_failed notification. With breaker.failures set on a
+   destination, that many consecutive upload failures open its breaker:
+   one destination_degraded notification goes out, and backups to it are
+   failed up front without dumping and without notifying. Once the backoff
+   has passed, the next run first probes the destination with a single
+   cheap request; if that answers, the run goes ahead, otherwise the backoff
+   doubles up to maxBackoff. The first successful upload closes the breaker
+   and sends destination_recovered.
+
+   Only upload failures count: a dump failing says nothing about the
+   destination. State is kept per destination name across reloads.
+*/
+
+const (
+	defaultBreakerBackoff    = 5 * time.Minute
+	defaultBreakerMaxBackoff = time.Hour
+	breakerProbeTimeout      = 30 * time.Second
+)
+
+var destinationDegraded = newGauge("pgbackup_destination_degraded", "1 while the destination's breaker is open after repeated upload failures.", "destination")
+
+// Breaker configures a destination's circuit breaker.
+type Breaker struct {
+	// Failures is how many consecutive upload failures open the breaker;
+	// 0 disables it.
+	Failures int `yaml:"failures"`
+	// Backoff is how long an open breaker waits before probing again,
+	// doubled after each failed probe up to MaxBackoff.
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"maxBackoff"`
+}
+
+func (br Breaker) backoff() time.Duration {
+	if br.Backoff <= 0 {
+		return defaultBreakerBackoff
+	}
+	return br.Backoff
+}
+
+func (br Breaker) maxBackoff() time.Duration {
+	if br.MaxBackoff <= 0 {
+		return max(defaultBreakerMaxBackoff, br.backoff())
+	}
+	return br.MaxBackoff
+}
+
+type breakerState struct {
+	failures int // consecutive upload failures
+	open     bool
+	since    time.Time // when it opened
+	retryAt  time.Time // while open, when to probe next
+	backoff  time.Duration
+	lastErr  string
+}
+
+var (
+	breakerMu sync.Mutex
+	breakers  = map[string]*breakerState{}
+)
+
+// errDegraded marks runs failed up front by an open breaker.
+var errDegraded = errors.New("destination degraded")
+
+func breakerFor(name string) *breakerState {
+	s, ok := breakers[name]
+	if !ok {
+		s = &breakerState{}
+		breakers[name] = s
+	}
+	return s
+}
+
+// degraded reports whether the named destination's breaker is open.
+func degraded(name string) bool {
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	s, ok := breakers[name]
+	return ok && s.open
+}
+
+// admit decides whether a run of b may go ahead. It returns an error wrapping
+// errDegraded if the destination's breaker is open and not due for a probe,
+// or if the probe failed.
+func admit(b Backup, dest Destination) error {
+	if dest.Breaker.Failures <= 0 {
+		return nil
+	}
+	breakerMu.Lock()
+	s := breakerFor(b.Destination)
+	if !s.open {
+		breakerMu.Unlock()
+		return nil
+	}
+	if now := time.Now(); now.Before(s.retryAt) {
+		retryAt := s.retryAt
+		breakerMu.Unlock()
+		return fmt.Errorf("%w: %q unreachable, next probe at %s", errDegraded, b.Destination, retryAt.Format(time.RFC3339))
+	}
+	// Runs coming in while the probe is out wait for the next window.
+	s.retryAt = time.Now().Add(s.backoff)
+	breakerMu.Unlock()
+
+	err := probe(b, dest)
+	if err == nil {
+		log.Printf("[breaker] destination %q answers again, letting %s run", b.Destination, b.Name)
+		return nil
+	}
+	breakerMu.Lock()
+	s.backoff = min(s.backoff*2, dest.Breaker.maxBackoff())
+	s.retryAt = time.Now().Add(s.backoff)
+	retryAt := s.retryAt
+	breakerMu.Unlock()
+	log.Printf("[breaker] destination %q still unreachable, next probe at %s: %v", b.Destination, retryAt.Format(time.RFC3339), err)
+	return fmt.Errorf("%w: %q unreachable, next probe at %s: %v", errDegraded, b.Destination, retryAt.Format(time.RFC3339), err)
+}
+
+// probe checks the destination answers with one request: a head of a key
+// that doesn't exist, which is a "no" from a working bucket.
+func probe(b Backup, dest Destination) error {
+	ctx, cancel := context.WithTimeout(context.Background(), breakerProbeTimeout)
+	defer cancel()
+	_, err := dest.store().exists(ctx, basePrefix(b, dest)+".pgbackup-probe")
+	return err
+}
+
+// observe updates the breaker of b's destination with a finished run.
+func observe(b Backup, dest Destination, res RunResult) {
+	if dest.Breaker.Failures <= 0 || errors.Is(res.Err, errDegraded) {
+		return
+	}
+	breakerMu.Lock()
+	defer breakerMu.Unlock()
+	s := breakerFor(b.Destination)
+	switch {
+	case res.Err != nil && res.Phase == PhaseUpload:
+		s.failures++
+		s.lastErr = res.Err.Error()
+		if s.open {
+			// The probe answered but the upload still failed.
+			s.backoff = min(s.backoff*2, dest.Breaker.maxBackoff())
+			s.retryAt = time.Now().Add(s.backoff)
+			return
+		}
+		if s.failures < dest.Breaker.Failures {
+			return
+		}
+		s.open, s.since, s.backoff = true, time.Now(), dest.Breaker.backoff()
+		s.retryAt = s.since.Add(s.backoff)
+		destinationDegraded.Set(1, b.Destination)
+		log.Printf("[breaker] destination %q degraded after %d consecutive upload failures, backing off until %s", b.Destination, s.failures, s.retryAt.Format(time.RFC3339))
+		go notify("destination_degraded", fmt.Sprintf("destination %s degraded after %d consecutive upload failures: %s", b.Destination, s.failures, s.lastErr), map[string]any{
+			"destination": b.Destination,
+			"failures":    s.failures,
+			"error":       s.lastErr,
+		})
+	case res.Err == nil && !res.Skipped:
+		if s.open {
+			down := time.Since(s.since).Round(time.Second)
+			log.Printf("[breaker] destination %q recovered after %s", b.Destination, down)
+			destinationDegraded.Set(0, b.Destination)
+			go notify("destination_recovered", fmt.Sprintf("destination %s recovered after %s", b.Destination, down), map[string]any{
+				"destination": b.Destination,
+				"downtime":    down.Seconds(),
+			})
+		}
+		*s = breakerState{}
+	}
+}
+
+// validate checks the breaker settings of destination k.
+func (br Breaker) validate(k string, d Destination) []error {
+	var errs []error
+	if br.Failures < 0 {
+		errs = append(errs, fmt.Errorf("destination %q: breaker.failures must not be negative", k))
+	}
+	if br.Backoff < 0 || br.MaxBackoff < 0 {
+		errs = append(errs, fmt.Errorf("destination %q: breaker backoffs must not be negative", k))
+	} else if br.MaxBackoff > 0 && br.MaxBackoff < br.backoff() {
+		errs = append(errs, fmt.Errorf("destination %q: breaker.maxBackoff must be at least backoff", k))
+	}
+	if br.Failures > 0 && d.Type == "restic" {
+		errs = append(errs, fmt.Errorf("destination %q: breaker is not supported on restic", k))
+	}
+	return errs
+}
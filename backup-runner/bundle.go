@@ -0,0 +1,211 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+/*
+   Bundles. A discovery backup with bundle: true dumps every selected
+   database and packs the dumps, together with a manifest.json describing
+   them, into one pgbundle-<ts>.tar.zst object under <prefix>/<name>/. Upload,
+   retention and archiving all see a single object per run. The dumps inside
+   are uncompressed custom-format files; zstd compresses the whole tar.
+*/
+
+const bundleManifestName = "manifest.json"
+
+// bundleManifest is the manifest.json inside a bundle.
+type bundleManifest struct {
+	Backup      string        `json:"backup"`
+	CreatedAt   time.Time     `json:"createdAt"`
+	ToolVersion string        `json:"toolVersion"`
+	Databases   []bundleEntry `json:"databases"`
+}
+
+type bundleEntry struct {
+	Database string `json:"database"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// runBundleDump dumps every discovered database and returns the path of the
+// bundle, written to ws. Any database failing fails the whole bundle.
+func runBundleDump(ctx context.Context, b Backup, ws string) (string, error) {
+	dbs, err := discoverDatabases(ctx, b)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(ws, "pgbundle-")
+	if err != nil {
+		return "", err
+	}
+	// The dumps are only needed until they are in the tar.
+	defer os.RemoveAll(dir)
+
+	m := bundleManifest{Backup: b.Name, CreatedAt: time.Now().UTC(), ToolVersion: version}
+	for _, db := range dbs {
+		// Dumped under the bundle's own name, so /status shows the
+		// bundle's progress and pg_dump's stderr.
+		c := b.forDatabase(db)
+		c.Name = b.Name
+		log.Printf("[backup] %s: dumping %s", b.Name, db)
+		out, err := runPgDump(ctx, c, ws)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", db, err)
+		}
+		e := bundleEntry{Database: db, File: url.PathEscape(db) + ".dump"}
+		if err := os.Rename(out, filepath.Join(dir, e.File)); err != nil {
+			return "", err
+		}
+		if e.SHA256, err = fileSHA256(filepath.Join(dir, e.File)); err != nil {
+			return "", err
+		}
+		if st, err := os.Stat(filepath.Join(dir, e.File)); err == nil {
+			e.Size = st.Size()
+		}
+		m.Databases = append(m.Databases, e)
+	}
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, bundleManifestName), body, 0o600); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(ws, b.dumpPrefix()+time.Now().UTC().Format(tsLayout)+"-*"+b.dumpExt())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	names := []string{bundleManifestName}
+	for _, e := range m.Databases {
+		names = append(names, e.File)
+	}
+	if err := writeTarZstd(ctx, f, dir, names); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// writeTarZstd streams the named files of dir as a tar through zstd into w.
+func writeTarZstd(ctx context.Context, w io.Writer, dir string, names []string) error {
+	cmd := runCommand(ctx, "zstd", "-q", "-T0", "-c")
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	tail := &tailWriter{}
+	captureStderr(cmd, tail)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+	tw := tar.NewWriter(stdin)
+	werr := addTarFiles(tw, dir, names)
+	if werr == nil {
+		werr = tw.Close()
+	}
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd: %w", &cmdError{err: err, stderr: tail.Lines()})
+	}
+	return werr
+}
+
+func addTarFiles(tw *tar.Writer, dir string, names []string) error {
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: st.Size(), ModTime: st.ModTime()})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractBundle unpacks a downloaded bundle into dir and returns its manifest.
+func extractBundle(file, dir string) (bundleManifest, error) {
+	var m bundleManifest
+	cmd := exec.Command("zstd", "-q", "-d", "-c", file)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return m, err
+	}
+	tail := &tailWriter{}
+	captureStderr(cmd, tail)
+	if err := cmd.Start(); err != nil {
+		return m, fmt.Errorf("zstd: %w", err)
+	}
+	rerr := extractTar(tar.NewReader(stdout), dir)
+	if rerr != nil {
+		// Let zstd exit instead of blocking on a full pipe.
+		io.Copy(io.Discard, stdout)
+	}
+	if err := cmd.Wait(); err != nil {
+		return m, fmt.Errorf("zstd: %w", &cmdError{err: err, stderr: tail.Lines()})
+	}
+	if rerr != nil {
+		return m, rerr
+	}
+	body, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return m, fmt.Errorf("bundle has no %s: %w", bundleManifestName, err)
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, fmt.Errorf("%s: %w", bundleManifestName, err)
+	}
+	return m, nil
+}
+
+func extractTar(tr *tar.Reader, dir string) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Entries are flat; anything else is not from this tool.
+		name := filepath.Base(hdr.Name)
+		out, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
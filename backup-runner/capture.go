@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Child processes' stderr is captured so a failure can be explained from the
+// log line or notification alone. Only the tail is kept, bounded in lines and
+// line length; LOG_LEVEL=debug additionally streams it in full.
+const (
+	stderrTailLines = 20
+	stderrLineMax   = 1024
+)
+
+// tailWriter keeps the last stderrTailLines lines written to it.
+type tailWriter struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	// onLine, if set, sees every line, including those that have
+	// dropped out of the tail.
+	onLine func(string)
+	// skip, if set, sees every line first; lines it returns true for are
+	// neither kept nor passed on to onLine.
+	skip func(string) bool
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range p {
+		if c == '\n' {
+			t.push()
+			continue
+		}
+		if len(t.partial) < stderrLineMax {
+			t.partial = append(t.partial, c)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tailWriter) push() {
+	line := strings.TrimRight(string(t.partial), "\r")
+	t.partial = t.partial[:0]
+	if line == "" || (t.skip != nil && t.skip(line)) {
+		return
+	}
+	if t.onLine != nil {
+		t.onLine(line)
+	}
+	t.lines = append(t.lines, line)
+	if len(t.lines) > stderrTailLines {
+		t.lines = t.lines[len(t.lines)-stderrTailLines:]
+	}
+}
+
+// Lines returns the captured lines, including an unterminated last one.
+func (t *tailWriter) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := append([]string(nil), t.lines...)
+	if p := strings.TrimSpace(string(t.partial)); p != "" {
+		out = append(out, p)
+	}
+	if len(out) > stderrTailLines {
+		out = out[len(out)-stderrTailLines:]
+	}
+	return out
+}
+
+// cmdError is a failed child process with the tail of its stderr.
+type cmdError struct {
+	err    error
+	stderr []string
+}
+
+func (e *cmdError) Error() string {
+	if len(e.stderr) == 0 {
+		return e.err.Error()
+	}
+	return e.err.Error() + ": " + e.stderr[len(e.stderr)-1]
+}
+
+func (e *cmdError) Unwrap() error { return e.err }
+
+func captureStderr(cmd *exec.Cmd, tail *tailWriter) {
+	cmd.Stderr = tail
+	if logLevel == "debug" {
+		cmd.Stderr = io.MultiWriter(tail, os.Stderr)
+	}
+}
+
+// runCaptured runs cmd, capturing its stderr into tail (a fresh one if nil)
+// and attaching it to the error if the command fails.
+func runCaptured(cmd *exec.Cmd, tail *tailWriter) error {
+	if tail == nil {
+		tail = &tailWriter{}
+	}
+	captureStderr(cmd, tail)
+	if err := cmd.Run(); err != nil {
+		return &cmdError{err: err, stderr: tail.Lines()}
+	}
+	return nil
+}
+
+// outputCaptured is runCaptured for commands whose stdout is wanted.
+func outputCaptured(cmd *exec.Cmd) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := runCaptured(cmd, nil)
+	return out.Bytes(), err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   Catalog. With catalog.url set, every finished run is also inserted as a
+   row into a table of a PostgreSQL database (catalog.table, default
+   pgbackup_runs), so backup history can be queried in SQL next to
+   everything else. The row is written through psql like the other queries
+   against databases, with the values passed as psql variables rather than
+   spliced into the statement. createTable creates the table on first use.
+   A failed insert is logged and never affects the run.
+*/
+
+const defaultCatalogTable = "pgbackup_runs"
+
+type Catalog struct {
+	URL         string `yaml:"url"`
+	Table       string `yaml:"table"`
+	CreateTable bool   `yaml:"createTable"`
+	// PsqlPath is the psql binary used to write rows (default: PATH).
+	PsqlPath   string `yaml:"psqlPath"`
+	PgpassFile string `yaml:"pgpassFile"`
+}
+
+// catalogTableName is a table name, optionally schema-qualified.
+var catalogTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func (c Catalog) table() string {
+	if c.Table == "" {
+		return defaultCatalogTable
+	}
+	return c.Table
+}
+
+func (c Catalog) validate() error {
+	if c.URL == "" {
+		if c.Table != "" || c.CreateTable {
+			return fmt.Errorf("catalog: table and createTable need url")
+		}
+		return nil
+	}
+	if _, err := connEnv(c.URL); err != nil {
+		return fmt.Errorf("catalog.url: %w", err)
+	}
+	if !catalogTableName.MatchString(c.table()) {
+		return fmt.Errorf("catalog.table: %q is not a plain table name", c.Table)
+	}
+	return nil
+}
+
+var catalogCfg atomic.Pointer[Catalog]
+
+func setCatalog(c Catalog) { catalogCfg.Store(&c) }
+
+func catalogEnabled() bool {
+	c := catalogCfg.Load()
+	return c != nil && c.URL != ""
+}
+
+const catalogSchema = `CREATE TABLE IF NOT EXISTS %s (
+	id          bigserial PRIMARY KEY,
+	backup      text NOT NULL,
+	database    text NOT NULL,
+	key         text,
+	size        bigint NOT NULL,
+	sha256      text,
+	status      text NOT NULL,
+	phase       text,
+	error       text,
+	started_at  timestamptz NOT NULL,
+	finished_at timestamptz NOT NULL
+);
+`
+
+const catalogInsert = `INSERT INTO %s (backup, database, key, size, sha256, status, phase, error, started_at, finished_at)
+VALUES (:'backup', :'database', NULLIF(:'key', ''), :'size', NULLIF(:'sha256', ''), :'status',
+	NULLIF(:'phase', ''), NULLIF(:'error', ''), :'started', :'finished');
+`
+
+// recordCatalog inserts the run r of b into the catalog table, if one is
+// configured.
+func recordCatalog(b Backup, r RunResult) {
+	c := catalogCfg.Load()
+	if c == nil || c.URL == "" {
+		return
+	}
+	if err := insertCatalog(*c, b, r); err != nil {
+		log.Printf("[backup] WARNING: %s: writing to catalog %s failed: %v", b.Name, c.table(), err)
+	}
+}
+
+func insertCatalog(c Catalog, b Backup, r RunResult) error {
+	script := fmt.Sprintf(catalogInsert, c.table())
+	if c.CreateTable {
+		script = "SET client_min_messages = warning;\n" + fmt.Sprintf(catalogSchema, c.table()) + script
+	}
+	var errMsg string
+	if r.Err != nil {
+		errMsg = r.Err.Error()
+	}
+	vars := []string{
+		"backup=" + b.Name,
+		"database=" + b.prefixName(),
+		"key=" + r.Key,
+		"size=" + strconv.FormatInt(r.Size, 10),
+		"sha256=" + r.SHA256,
+		"status=" + r.status(),
+		"phase=" + string(r.Phase),
+		"error=" + errMsg,
+		"started=" + r.Started.UTC().Format(time.RFC3339Nano),
+		"finished=" + r.Started.Add(r.Duration).UTC().Format(time.RFC3339Nano),
+	}
+	env, err := pgEnv(Backup{URL: c.URL, PgpassFile: c.PgpassFile})
+	if err != nil {
+		return err
+	}
+	args := []string{"-X", "-q", "-v", "ON_ERROR_STOP=1"}
+	for _, v := range vars {
+		args = append(args, "-v", v)
+	}
+	cmd := exec.Command(binPath(c.PsqlPath, "psql"), args...)
+	cmd.Env = env
+	cmd.Stdin = strings.NewReader(script)
+	_, err = outputCaptured(cmd)
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+/*
+   Catch-up. cron doesn't remember runs that fell into downtime: a backup
+   whose time came while the node was rebooting waits for its next tick,
+   leaving a gap nobody asked for. With catchUpOnStart, the daemon looks up
+   the newest dump of the backup at startup and, if a scheduled run was due
+   since it was taken (or there is none), runs the backup right away. The
+   catch-up runs join the runOnStart ones, in priority order and through
+   the same overlap locks and workers.
+*/
+
+// newestDumpTimeout bounds the listing that finds a backup's newest dump.
+const newestDumpTimeout = 2 * time.Minute
+
+// catchUps returns the jobs whose backups set catchUpOnStart and missed a
+// scheduled run, leaving out those in skip.
+func catchUps(ctx context.Context, jobs []*job, skip map[*job]bool) map[*job]bool {
+	due := map[*job]bool{}
+	now := time.Now()
+	for _, j := range jobs {
+		if !j.b.CatchUpOnStart || skip[j] {
+			continue
+		}
+		missed, err := missedRun(ctx, j.b, j.dest, now)
+		if err != nil {
+			log.Printf("[schedule] WARNING: %s: can't tell whether a run was missed, not catching up: %v", j.b.Name, err)
+			continue
+		}
+		if missed {
+			due[j] = true
+		}
+	}
+	return due
+}
+
+// missedRun reports whether b, per its schedule, should have run since its
+// newest dump on dest was taken.
+func missedRun(ctx context.Context, b Backup, dest Destination, now time.Time) (bool, error) {
+	sched, err := b.schedule()
+	if err != nil {
+		return false, err
+	}
+	_, newest, err := newestDump(ctx, b, dest)
+	if err != nil {
+		return false, err
+	}
+	if newest.IsZero() {
+		log.Printf("[schedule] %s: no dump under %s, catching up", b.Name, dest.store().url(basePrefix(b, dest)))
+		return true, nil
+	}
+	due := sched.Next(newest)
+	if due.After(now) {
+		return false, nil
+	}
+	log.Printf("[schedule] %s: newest dump is from %s, the run due at %s was missed, catching up",
+		b.Name, newest.Format(time.RFC3339), due.Format(time.RFC3339))
+	return true, nil
+}
+
+// newestDump returns the key and time of b's newest dump on dest, by the
+// timestamp in its key; the time is zero if there is none.
+func newestDump(ctx context.Context, b Backup, dest Destination) (string, time.Time, error) {
+	prefix := basePrefix(b, dest)
+	var objs []s3Object
+	err := storageOp(ctx, dest, "list "+prefix, newestDumpTimeout, func(ctx context.Context) error {
+		var err error
+		objs, err = dest.store().list(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var key string
+	var newest time.Time
+	for _, o := range objs {
+		if t, ok := dumpTime(o.Key, b.dumpPrefix()); ok && t.After(newest) {
+			key, newest = o.Key, t
+		}
+	}
+	return key, newest, nil
+}
+
+// validateCatchUp checks that b's newest dump can be found.
+func validateCatchUp(b Backup, dest Destination) error {
+	switch {
+	case !b.CatchUpOnStart:
+		return nil
+	case dest.Type == "restic":
+		return errors.New("catchUpOnStart is not supported on restic destinations")
+	case b.Discover && !b.Bundle:
+		return errors.New("catchUpOnStart is not supported with discover, which stores each database under its own prefix; use runOnStart")
+	}
+	return nil
+}
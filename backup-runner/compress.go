@@ -0,0 +1,242 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// compressors maps the compression setting to the file extension it adds.
+var compressors = map[string]string{
+	"gzip": ".gz",
+	"pigz": ".gz",
+	"zstd": ".zst",
+}
+
+// pgDumpZstdVersion is the first pg_dump that compresses custom-format
+// archives with zstd (-Z zstd).
+const pgDumpZstdVersion = 16
+
+// dumpExts lists every extension a dump object written by this tool can have:
+// each dump format with each compressor suffix, optionally age-encrypted. Retention matches on all of
+// them, so changing format or compression on an existing backup doesn't leave
+// the old artifacts outside of pruning.
+var dumpExts = func() []string {
+	var exts []string
+	for _, format := range []string{".dump", ".sql", ".tar"} {
+		for _, comp := range []string{".gz", ".zst", ""} {
+			exts = append(exts, format+comp+".age", format+comp)
+		}
+	}
+	return exts
+}()
+
+// trimDumpExt strips a known dump extension from name.
+func trimDumpExt(name string) (string, bool) {
+	for _, ext := range dumpExts {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext), true
+		}
+	}
+	return name, false
+}
+
+func (b Backup) dumpExt() string {
+	if b.Bundle {
+		return ".tar.zst"
+	}
+	return ".dump" + compressors[b.Compression]
+}
+
+// fileDumpExt is the extension a finished dump file is stored with:
+// dumpExt, unless compression was skipped for it.
+func (b Backup) fileDumpExt(out string) string {
+	if !b.compressed(out) {
+		return ".dump"
+	}
+	return b.dumpExt()
+}
+
+// compressed reports whether the finished dump out went through b's
+// compressor.
+func (b Backup) compressed(out string) bool {
+	return b.Compression == "" || strings.HasSuffix(out, compressors[b.Compression])
+}
+
+// skipsCompression reports whether a dump of size is below compressMinSize.
+func (b Backup) skipsCompression(size int64) bool {
+	return b.Compression != "" && b.CompressMinSize > 0 && size < int64(b.CompressMinSize)
+}
+
+// resolveCompressor checks the configured compressor is installed, falling
+// back from pigz to gzip when pigz is missing. Output is gzip either way.
+// zstd is left to pg_dump 16+ inside the custom format, else to the zstd
+// binary, else to pg_dump's zlib.
+func resolveCompressor(ctx context.Context, b *Backup) error {
+	if err := checkCompressionLevel(*b); err != nil {
+		return err
+	}
+	switch b.Compression {
+	case "", "none":
+		b.Compression = ""
+		return nil
+	case "zstd":
+		major, err := pgDumpMajor(ctx, *b)
+		if err == nil && major >= pgDumpZstdVersion {
+			b.Compression, b.pgDumpCompress = "", "zstd"
+			if b.CompressionLevel > 0 {
+				b.pgDumpCompress += ":" + strconv.Itoa(b.CompressionLevel)
+			}
+			return nil
+		}
+		why := fmt.Sprintf("pg_dump %d is older than %d", major, pgDumpZstdVersion)
+		if err != nil {
+			why = fmt.Sprintf("pg_dump version unknown (%v)", err)
+		}
+		if _, err := exec.LookPath("zstd"); err == nil {
+			log.Printf("[backup] %s: %s, compressing with the zstd binary instead", b.Name, why)
+			return nil
+		}
+		// zlib levels stop at 9; 6 is pg_dump's default.
+		log.Printf("[backup] %s: %s and zstd not installed, falling back to pg_dump's zlib compression", b.Name, why)
+		b.Compression, b.pgDumpCompress = "", strconv.Itoa(min(cmp.Or(b.CompressionLevel, 6), 9))
+		return nil
+	case "pigz":
+		if _, err := exec.LookPath("pigz"); err == nil {
+			return nil
+		}
+		log.Printf("[backup] %s: pigz not installed, falling back to gzip", b.Name)
+		b.Compression = "gzip"
+		fallthrough
+	case "gzip":
+		if _, err := exec.LookPath("gzip"); err != nil {
+			return fmt.Errorf("compression gzip: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q", b.Compression)
+}
+
+// compressFile compresses path into path+ext and removes the original.
+func compressFile(ctx context.Context, b Backup, path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	outPath := path + compressors[b.Compression]
+	out, err := os.Create(outPath)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	cmd := runCommand(ctx, b.Compression, compressArgs(b)...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	if err := runCaptured(cmd, nil); err != nil {
+		os.Remove(outPath)
+		return "", fmt.Errorf("%s: %w", b.Compression, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	os.Remove(path)
+	return outPath, nil
+}
+
+// compressArgs makes the compressor write stdin to stdout.
+func compressArgs(b Backup) []string {
+	var args []string
+	if b.Compression == "pigz" && b.CompressionThreads > 0 {
+		args = append(args, "-p", strconv.Itoa(b.CompressionThreads))
+	}
+	if b.Compression == "zstd" {
+		args = append(args, "-q", "-T"+strconv.Itoa(b.CompressionThreads))
+	}
+	if b.CompressionLevel > 0 {
+		args = append(args, "-"+strconv.Itoa(b.CompressionLevel))
+	}
+	return append(args, "-c")
+}
+
+func checkCompressionLevel(b Backup) error {
+	top := 9
+	if b.Compression == "zstd" {
+		top = 19
+	}
+	if b.CompressionLevel < 0 || b.CompressionLevel > top {
+		return fmt.Errorf("compressionLevel must be between 1 and %d for %s", top, cmp.Or(b.Compression, "pg_dump"))
+	}
+	return nil
+}
+
+var (
+	pgDumpVersionMu    sync.Mutex
+	pgDumpVersionCache = map[string]string{}
+)
+
+// pgDumpVersion is the version of the pg_dump b runs, e.g. 16.2, from
+// pg_dump --version. It is asked once per binary or image.
+func pgDumpVersion(ctx context.Context, b Backup) (string, error) {
+	bin := binPath(b.PgDumpPath, "pg_dump")
+	if b.PgDumpImage != "" {
+		bin = b.PgDumpImage
+	}
+	pgDumpVersionMu.Lock()
+	defer pgDumpVersionMu.Unlock()
+	if v, ok := pgDumpVersionCache[bin]; ok {
+		return v, nil
+	}
+	cmd := exec.Command(bin, "--version")
+	if b.PgDumpImage != "" {
+		var err error
+		if cmd, err = containerTool(ctx, b, os.TempDir(), "pg_dump", []string{"--version"}, nil); err != nil {
+			return "", err
+		}
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	// pg_dump (PostgreSQL) 16.2 (Debian 16.2-1.pgdg120+2)
+	f := strings.Fields(string(out))
+	if len(f) < 3 {
+		return "", fmt.Errorf("unexpected pg_dump --version output %q", strings.TrimSpace(string(out)))
+	}
+	if _, err := majorVersion(f[2]); err != nil {
+		return "", fmt.Errorf("unexpected pg_dump --version output %q", strings.TrimSpace(string(out)))
+	}
+	pgDumpVersionCache[bin] = f[2]
+	return f[2], nil
+}
+
+// pgDumpMajor is the major version of the pg_dump b runs.
+func pgDumpMajor(ctx context.Context, b Backup) (int, error) {
+	v, err := pgDumpVersion(ctx, b)
+	if err != nil {
+		return 0, err
+	}
+	return majorVersion(v)
+}
+
+// majorVersion is the major version of a PostgreSQL version such as 16.2,
+// 17beta1 or 9.6.24: the leading digits.
+func majorVersion(v string) (int, error) {
+	digits := v
+	if n := strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }); n >= 0 {
+		digits = digits[:n]
+	}
+	major, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a PostgreSQL version", v)
+	}
+	return major, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTrimDumpExt(t *testing.T) {
+	for _, tc := range []struct {
+		name, base string
+		ok         bool
+	}{
+		{"pgdump-20240101T020000Z.dump", "pgdump-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.dump.gz", "pgdump-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.dump.zst", "pgdump-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.dump.age", "pgdump-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.dump.zst.age", "pgdump-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.sql.gz", "pgdump-20240101T020000Z", true},
+		{"pgbundle-20240101T020000Z.tar.zst", "pgbundle-20240101T020000Z", true},
+		{"pgdump-20240101T020000Z.json", "pgdump-20240101T020000Z.json", false},
+		{"pgdump-20240101T020000Z.dump.bz2", "pgdump-20240101T020000Z.dump.bz2", false},
+	} {
+		base, ok := trimDumpExt(tc.name)
+		if base != tc.base || ok != tc.ok {
+			t.Errorf("trimDumpExt(%q) = %q, %v, want %q, %v", tc.name, base, ok, tc.base, tc.ok)
+		}
+	}
+}
+
+// A backup whose compression changed over time has dumps of every format
+// under its prefix; retention must see all of them.
+func TestRetentionSeesMixedFormats(t *testing.T) {
+	keys := []string{
+		"backups/app/pgdump-20240105T020000Z.dump.zst.age",
+		"backups/app/pgdump-20240104T020000Z.dump.zst",
+		"backups/app/pgdump-20240104T020000Z.json",
+		"backups/app/pgdump-20240103T020000Z.dump.gz",
+		"backups/app/pgdump-20240102T020000Z.dump",
+		"backups/app/pgdump-20240101T020000Z.dump.age",
+		"backups/app/globals-20240101T020000Z.sql",
+		"backups/app/pgdump-schema-20240101T020000Z.dump",
+	}
+	var dumps []s3Object
+	for _, k := range keys {
+		if isDumpKey(k, "pgdump-") {
+			dumps = append(dumps, s3Object{Key: k})
+		}
+	}
+	var got []string
+	for _, o := range dumps {
+		got = append(got, o.Key)
+	}
+	want := []string{keys[0], keys[1], keys[3], keys[4], keys[5]}
+	if !slices.Equal(got, want) {
+		t.Fatalf("dump keys = %q, want %q", got, want)
+	}
+
+	when := func(o s3Object) time.Time {
+		ts, _ := dumpTime(o.Key, "pgdump-")
+		return ts
+	}
+	expired := retention{maxHistory: 2}.expiredDumps(dumps, when, time.Now())
+	got = nil
+	for _, o := range expired {
+		got = append(got, o.Key)
+	}
+	if want := []string{keys[3], keys[4], keys[5]}; !slices.Equal(got, want) {
+		t.Errorf("expired = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+   Containerized pg_dump. With pgDumpImage set (e.g. postgres:16), a backup's
+   pg_dump runs in a throwaway container of that image through docker or
+   podman, whichever is found first in PATH, so the client can match any
+   server version without installing them all in this image. The run's
+   workspace is mounted at the same path and the dump is written there as
+   the runner's own user. The connection is passed as PG* environment
+   variables, as for a local pg_dump, never on the command line. The
+   container uses the host network: the database must be reachable from it.
+*/
+
+var containerRuntimes = []string{"docker", "podman"}
+
+// containerRuntime returns the docker or podman binary.
+func containerRuntime() (string, error) {
+	for _, rt := range containerRuntimes {
+		if path, err := exec.LookPath(rt); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("pgDumpImage needs docker or podman in PATH, found neither")
+}
+
+// containerPgDump returns the command running pg_dump with args in b's
+// pgDumpImage, with dir mounted and the PG* variables of env passed in.
+func containerPgDump(ctx context.Context, b Backup, dir string, args, env []string) (*exec.Cmd, error) {
+	return containerTool(ctx, b, dir, "pg_dump", args, env)
+}
+
+// containerTool is containerPgDump for any client tool of the image.
+func containerTool(ctx context.Context, b Backup, dir, tool string, args, env []string) (*exec.Cmd, error) {
+	rt, err := containerRuntime()
+	if err != nil {
+		return nil, err
+	}
+	run := []string{
+		"run", "--rm", "--network", "host",
+		"--user", fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid()),
+		"-v", dir + ":" + dir,
+	}
+	if b.PgpassFile != "" {
+		run = append(run, "-v", b.PgpassFile+":"+b.PgpassFile+":ro")
+	}
+	// -e NAME without a value takes it from the runtime's own environment,
+	// keeping passwords out of the process list.
+	seen := map[string]bool{}
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "PG") && !seen[name] {
+			seen[name] = true
+			run = append(run, "-e", name)
+		}
+	}
+	run = append(run, b.PgDumpImage, tool)
+	cmd := runCommand(ctx, rt, append(run, args...)...)
+	cmd.Env = env
+	return cmd, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+/*
+   Destinations without static keys leave credentials to the AWS CLI's
+   default chain, which every aws invocation re-runs: an STS AssumeRole, SSO
+   token exchange or IMDS request per upload, list and delete, each adding
+   latency and counting against throttling limits. Instead the chain is
+   resolved once with `aws configure export-credentials` and the resulting
+   keys are shared by every destination with the same region, endpoint and
+   profile until shortly before they expire.
+*/
+
+const (
+	// credRefreshMargin renews temporary credentials this long before they
+	// expire, so no command starts with keys about to lapse.
+	credRefreshMargin = 5 * time.Minute
+	// credStaticTTL is how long credentials without an expiry (e.g. from
+	// ~/.aws/credentials) are reused before being resolved again.
+	credStaticTTL = time.Hour
+	// credRetryAfter is how long a failed resolution falls back to the
+	// CLI's own chain before trying again.
+	credRetryAfter = 5 * time.Minute
+)
+
+// credKey identifies a credential source. Destinations only share
+// credentials when all of it matches.
+type credKey struct {
+	region, endpoint, profile, configFile string
+}
+
+type cachedCreds struct {
+	access, secret, token string
+	// renewAt is when the entry must be resolved again.
+	renewAt time.Time
+	failed  bool
+}
+
+var (
+	credMu    sync.Mutex
+	credCache = map[credKey]cachedCreds{}
+)
+
+func (d Destination) credKey() credKey {
+	k := credKey{region: d.Region, endpoint: d.Endpoint, profile: os.Getenv("AWS_PROFILE"), configFile: os.Getenv("AWS_CONFIG_FILE")}
+	if path, _ := s3ConfigFile(d); path != "" {
+		// A different config file may mean different profiles.
+		k.configFile = path
+	}
+	return k
+}
+
+// chainCredentials returns the default chain's credentials for d, resolving
+// them only when the cached ones are missing or about to expire. ok is false
+// when the chain couldn't be resolved; the CLI is then left to try itself.
+func chainCredentials(ctx context.Context, d Destination, env []string) (cachedCreds, bool) {
+	k := d.credKey()
+	credMu.Lock()
+	defer credMu.Unlock()
+	if c, found := credCache[k]; found && time.Now().Before(c.renewAt) {
+		return c, !c.failed
+	}
+	c, err := exportCredentials(ctx, env)
+	if err != nil {
+		log.Printf("[backup] resolving AWS credentials failed, leaving it to each aws command for %s: %v", credRetryAfter, err)
+		credCache[k] = cachedCreds{failed: true, renewAt: time.Now().Add(credRetryAfter)}
+		return cachedCreds{}, false
+	}
+	credCache[k] = c
+	return c, true
+}
+
+// exportCredentials runs the CLI's credential chain once.
+func exportCredentials(ctx context.Context, env []string) (cachedCreds, error) {
+	cmd := exec.CommandContext(ctx, "aws", "configure", "export-credentials", "--format", "process")
+	cmd.Env = env
+	out, err := outputCaptured(cmd)
+	if err != nil {
+		return cachedCreds{}, err
+	}
+	var p struct {
+		AccessKeyID     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		SessionToken    string    `json:"SessionToken"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.Unmarshal(out, &p); err != nil {
+		return cachedCreds{}, fmt.Errorf("export-credentials: %w", err)
+	}
+	if p.AccessKeyID == "" || p.SecretAccessKey == "" {
+		return cachedCreds{}, fmt.Errorf("export-credentials returned no keys")
+	}
+	c := cachedCreds{access: p.AccessKeyID, secret: p.SecretAccessKey, token: p.SessionToken}
+	if p.Expiration.IsZero() {
+		c.renewAt = time.Now().Add(credStaticTTL)
+	} else {
+		c.renewAt = p.Expiration.Add(-credRefreshMargin)
+	}
+	return c, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// daemon owns the running scheduler so it can be swapped on reload.
+type daemon struct {
+	mu   sync.Mutex
+	cron *cron.Cron
+	jobs []*job
+}
+
+// start schedules every backup in cfg, which must already be validated, and
+// replaces the previous scheduler if there is one. Runs already in progress
+// under the old scheduler are left to finish.
+func (d *daemon) start(cfg Config) {
+	c := cron.New(cron.WithParser(cronParser), cron.WithChain(cron.Recover(cron.DefaultLogger)))
+	var jobs []*job
+	for _, b := range cfg.Backups {
+		sched, _ := b.schedule()
+		j := newJob(b, cfg.Destinations[b.Destination])
+		jobs = append(jobs, j)
+		c.Schedule(sched, cron.FuncJob(func() { j.run("scheduled", nil) }))
+		spec, _ := b.scheduleSpec()
+		log.Printf("[schedule] %s: %q, next run %s", b.Name, spec, sched.Next(time.Now()).Format(time.RFC3339))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cron != nil {
+		d.cron.Stop()
+	}
+	d.cron, d.jobs = c, jobs
+	setStaleWatches(cfg.Backups)
+	setSuppressWindows(cfg.Backups)
+	setReport(cfg.Report)
+	setCatalog(cfg.Catalog)
+	setEvents(cfg.Events)
+	runPool.configure(cfg.Workers, cfg.WhenBusy == "drop")
+	c.Start()
+}
+
+// reload re-reads the config file. An invalid config is logged and
+// discarded; the daemon keeps running with what it had.
+func (d *daemon) reload() {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		log.Printf("[reload] keeping current config: %v", err)
+		return
+	}
+	setNotifier(cfg.Notify)
+	setLabels(cfg.Labels, cfg.Backups)
+	d.start(cfg)
+	log.Printf("[reload] config reloaded, %d backups scheduled", len(cfg.Backups))
+}
+
+// waitForSignals blocks forever, reloading the config on SIGHUP and
+// running backups on trig, unless it is 0; see trigger.go.
+func (d *daemon) waitForSignals(trig syscall.Signal) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	if trig != 0 {
+		signal.Notify(sig, trig)
+	}
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			log.Printf("[reload] SIGHUP received")
+			d.reload()
+			continue
+		}
+		d.trigger(s)
+	}
+}
+
+// runOnceCmd runs the named backups (all of them if none are given) once,
+// in order, and exits. Unlike the daemon it stops on a bad config and its
+// exit status reflects the runs: 1 if any failed, 2 for usage or config
+// errors.
+func runOnceCmd(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	deadline := fs.Duration("deadline", 0, "abort backups still running after this long, e.g. 30m (exit status 3)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner run [--deadline duration] [backup name...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *deadline < 0 {
+		fmt.Fprintln(os.Stderr, "--deadline must not be negative")
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	setNotifier(cfg.Notify)
+	setLabels(cfg.Labels, cfg.Backups)
+	setSuppressWindows(cfg.Backups)
+	setReport(cfg.Report)
+	setCatalog(cfg.Catalog)
+	setEvents(cfg.Events)
+
+	backups := cfg.Backups
+	if names := fs.Args(); len(names) > 0 {
+		byName := map[string]Backup{}
+		for _, b := range cfg.Backups {
+			byName[b.Name] = b
+		}
+		backups = nil
+		for _, n := range names {
+			b, ok := byName[n]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "unknown backup %q\n", n)
+				return 2
+			}
+			backups = append(backups, b)
+		}
+	}
+
+	ctx := context.Background()
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadline)
+		defer cancel()
+	}
+
+	failed := 0
+	var results []RunResult
+	outcomes := map[string][]string{}
+	for _, b := range byPriority(backups) {
+		res, outcome := runBefore(ctx, b, cfg.Destinations[b.Destination])
+		report(b, res)
+		results = append(results, res)
+		outcomes[outcome] = append(outcomes[outcome], b.Name)
+		if res.Err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "%s: %s failed: %v\n", b.Name, res.Phase, res.Err)
+		}
+	}
+	writeReport("once", results)
+	flushEvents()
+	if len(outcomes[runAborted])+len(outcomes[runNotStarted]) > 0 {
+		fmt.Fprintf(os.Stderr, "deadline of %s exceeded\n", *deadline)
+		for _, o := range []string{runCompleted, runAborted, runNotStarted} {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", o+":", cmp.Or(strings.Join(outcomes[o], ", "), "-"))
+		}
+		return 3
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
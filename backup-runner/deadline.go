@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+/*
+   Deadline. `run --deadline 30m` caps the wall-clock time of the whole
+   command, for CI pipelines that must not hang on one stuck backup. Every
+   command a run starts (pg_dump, psql, the compressor, aws, ...) and every
+   storage operation is bound to the context runBackup is given, which the
+   deadline cancels: the commands still running are killed, retries stop,
+   and the run fails and cleans up its workspace as after any other
+   failure. Backups not started by then aren't started at all. A run still
+   not back deadlineGrace after the deadline, stuck somewhere no
+   cancellation reaches, is given up on and its workspace removed.
+
+   The daemon runs its backups with a context that is never cancelled.
+*/
+
+// deadlineGrace is how long a run may take to wind down once the deadline
+// has passed.
+const deadlineGrace = 30 * time.Second
+
+// Outcomes of a run under a deadline.
+const (
+	runCompleted  = "completed"
+	runAborted    = "aborted"
+	runNotStarted = "not started"
+)
+
+var (
+	workspacesMu sync.Mutex
+	// workspaces are the run workspaces created under a deadline and not
+	// removed yet, for removal when a run is given up on.
+	workspaces = map[string]bool{}
+)
+
+// runCommand is exec.CommandContext for the commands a run starts.
+func runCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Once killed, don't wait on pipes a leftover child process of the
+	// command may still hold open.
+	cmd.WaitDelay = 5 * time.Second
+	return cmd
+}
+
+// trackWorkspace remembers ws if the run has a deadline.
+func trackWorkspace(ctx context.Context, ws string) {
+	if _, ok := ctx.Deadline(); !ok {
+		return
+	}
+	workspacesMu.Lock()
+	workspaces[ws] = true
+	workspacesMu.Unlock()
+}
+
+// removeWorkspace removes ws and forgets it.
+func removeWorkspace(ws string) {
+	os.RemoveAll(ws)
+	workspacesMu.Lock()
+	delete(workspaces, ws)
+	workspacesMu.Unlock()
+}
+
+// removeWorkspaces removes the tracked workspaces still there.
+func removeWorkspaces() {
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	for ws := range workspaces {
+		os.RemoveAll(ws)
+		delete(workspaces, ws)
+	}
+}
+
+// runBefore runs b unless ctx is done, and tells whether the run completed
+// (successfully or not), was aborted at the deadline or never started.
+func runBefore(ctx context.Context, b Backup, dest Destination) (RunResult, string) {
+	if ctx.Err() != nil {
+		res := RunResult{Backup: b.Name, Started: time.Now()}
+		res.fail(PhasePrecheck, errors.New("not started before the deadline"))
+		return res, runNotStarted
+	}
+	started := time.Now()
+	done := make(chan RunResult, 1)
+	go func() { done <- runBackup(ctx, b, dest) }()
+	var res RunResult
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		select {
+		case res = <-done:
+		case <-time.After(deadlineGrace):
+			removeWorkspaces()
+			res = RunResult{Backup: b.Name, Started: started, Duration: time.Since(started)}
+			res.fail(PhaseDump, fmt.Errorf("still running %s after the deadline, given up", deadlineGrace))
+			return res, runAborted
+		}
+	}
+	if res.Err != nil && ctx.Err() != nil {
+		res.Err = fmt.Errorf("aborted at the deadline: %w", res.Err)
+		return res, runAborted
+	}
+	return res, runCompleted
+}
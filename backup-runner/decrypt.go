@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+   Encrypted config files, so a config including its secrets can live in
+   git. A file encrypted with age (binary or armored), or with SOPS, is
+   decrypted in memory by the age or sops CLI before env expansion and
+   parsing; the plaintext never touches the disk. The age identity comes from
+   SOPS_AGE_KEY or SOPS_AGE_KEY_FILE, the variables sops itself uses, so
+   both formats are unlocked the same way.
+*/
+
+var (
+	ageHeader      = []byte("age-encryption.org/v1\n")
+	ageArmorHeader = []byte("-----BEGIN AGE ENCRYPTED FILE-----")
+)
+
+// configEncryption reports how a config file is encrypted: "age", "sops"
+// or "" for plaintext.
+func configEncryption(name string, raw []byte) string {
+	if bytes.HasPrefix(raw, ageHeader) || bytes.HasPrefix(bytes.TrimSpace(raw), ageArmorHeader) || filepath.Ext(name) == ".age" {
+		return "age"
+	}
+	if strings.Contains(filepath.Base(name), ".sops.") {
+		return "sops"
+	}
+	// SOPS keeps its metadata in a top-level sops key with a MAC.
+	var doc struct {
+		Sops struct {
+			Mac string `yaml:"mac"`
+		} `yaml:"sops"`
+	}
+	if yaml.Unmarshal(raw, &doc) == nil && doc.Sops.Mac != "" {
+		return "sops"
+	}
+	return ""
+}
+
+// decryptConfig returns the plaintext of an encrypted config file.
+func decryptConfig(name string, raw []byte, method string) ([]byte, error) {
+	if method == "age" {
+		return decryptAge(name, raw)
+	}
+	// sops also accepts KMS, PGP and other keys, so a missing age key is
+	// only an error when age is how the file was encrypted.
+	var doc struct {
+		Sops struct {
+			Age []any `yaml:"age"`
+			KMS []any `yaml:"kms"`
+			PGP []any `yaml:"pgp"`
+		} `yaml:"sops"`
+	}
+	_ = yaml.Unmarshal(raw, &doc)
+	if len(doc.Sops.Age) > 0 && len(doc.Sops.KMS) == 0 && len(doc.Sops.PGP) == 0 && !haveAgeKey() {
+		return nil, fmt.Errorf("%s is SOPS-encrypted with age but neither SOPS_AGE_KEY nor SOPS_AGE_KEY_FILE is set", name)
+	}
+	cmd := exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", name)
+	out, err := outputCaptured(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("sops: %w", err)
+	}
+	return out, nil
+}
+
+func haveAgeKey() bool {
+	return os.Getenv("SOPS_AGE_KEY") != "" || os.Getenv("SOPS_AGE_KEY_FILE") != ""
+}
+
+// decryptAge decrypts an age file with the identity from SOPS_AGE_KEY or
+// SOPS_AGE_KEY_FILE.
+func decryptAge(name string, raw []byte) ([]byte, error) {
+	keyFile := os.Getenv("SOPS_AGE_KEY_FILE")
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		// age only reads identities from files.
+		f, err := os.CreateTemp("", "pg-backup-age-*.key")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(key + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		keyFile = f.Name()
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("%s is age-encrypted but neither SOPS_AGE_KEY nor SOPS_AGE_KEY_FILE is set", name)
+	}
+	cmd := exec.Command("age", "--decrypt", "-i", keyFile)
+	cmd.Stdin = bytes.NewReader(raw)
+	out, err := outputCaptured(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("age: %w", err)
+	}
+	return out, nil
+}
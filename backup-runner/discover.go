@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Discovery. With discover: true the backup's URL points at a maintenance
+   database (usually postgres) and every database on the server that accepts
+   connections and isn't a template is backed up, narrowed down by the
+   include/exclude glob patterns. Each database is dumped as if it had its own
+   entry, under its own prefix and with its own retention; with bundle: true
+   they are packed into a single object instead, see bundle.go. rules
+   override the dump mode, compression and retention of the databases whose
+   name matches their regular expression; the first matching rule applies,
+   and databases no rule matches use the backup's own settings.
+*/
+
+const discoverQuery = "SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY 1"
+
+// discoverDatabases lists the databases a discovery backup covers.
+func discoverDatabases(ctx context.Context, b Backup) ([]string, error) {
+	out, err := psqlQuery(ctx, b, discoverQuery)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	var dbs []string
+	for _, db := range strings.Split(out, "\n") {
+		if db = strings.TrimSpace(db); db != "" && b.selects(db) {
+			dbs = append(dbs, db)
+		}
+	}
+	if len(dbs) == 0 {
+		return nil, fmt.Errorf("discovery: no databases matched")
+	}
+	return dbs, nil
+}
+
+// selects reports whether a discovered database passes include and exclude.
+func (b Backup) selects(db string) bool {
+	if len(b.Include) > 0 && !matchAny(b.Include, db) {
+		return false
+	}
+	return !matchAny(b.Exclude, db)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// DatabaseRule overrides settings of a discovery backup for the databases
+// whose name matches Match, a regular expression.
+type DatabaseRule struct {
+	Match            string         `yaml:"match"`
+	SchemaOnly       *bool          `yaml:"schemaOnly"`
+	DataOnly         *bool          `yaml:"dataOnly"`
+	Compression      *string        `yaml:"compression"`
+	CompressionLevel *int           `yaml:"compressionLevel"`
+	MaxHistory       *int           `yaml:"maxHistory"`
+	KeepPerDay       *int           `yaml:"keepPerDay"`
+	MaxAge           *time.Duration `yaml:"maxAge"`
+
+	re *regexp.Regexp
+	// The compressor as resolveCompressor settled it for this rule.
+	compression, pgDumpCompress string
+}
+
+// validate compiles the rule's pattern and resolves its compressor against
+// the settings of b it doesn't override, which must not be resolved yet.
+func (r *DatabaseRule) validate(b Backup) error {
+	if r.Match == "" {
+		return errors.New("match is required")
+	}
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("match: %w", err)
+	}
+	r.re = re
+	c := r.apply(b)
+	if c.SchemaOnly && c.DataOnly {
+		return errors.New("schemaOnly and dataOnly are mutually exclusive")
+	}
+	if r.compresses() {
+		c.Name = fmt.Sprintf("%s (rule %q)", b.Name, r.Match)
+		if err := resolveCompressor(context.Background(), &c); err != nil {
+			return err
+		}
+		r.compression, r.pgDumpCompress = c.Compression, c.pgDumpCompress
+	}
+	return nil
+}
+
+// apply returns b with the rule's overrides.
+func (r *DatabaseRule) apply(b Backup) Backup {
+	if r.SchemaOnly != nil {
+		b.SchemaOnly = *r.SchemaOnly
+	}
+	if r.DataOnly != nil {
+		b.DataOnly = *r.DataOnly
+	}
+	if r.Compression != nil {
+		b.Compression = *r.Compression
+	}
+	if r.CompressionLevel != nil {
+		b.CompressionLevel = *r.CompressionLevel
+	}
+	if r.MaxHistory != nil {
+		b.MaxHistory = *r.MaxHistory
+	}
+	if r.KeepPerDay != nil {
+		b.KeepPerDay = *r.KeepPerDay
+	}
+	if r.MaxAge != nil {
+		b.MaxAge = *r.MaxAge
+	}
+	return b
+}
+
+func (r *DatabaseRule) compresses() bool { return r.Compression != nil || r.CompressionLevel != nil }
+
+// forDatabase returns the backup of one discovered database, with the
+// first rule matching it applied.
+func (b Backup) forDatabase(db string) Backup {
+	c := b
+	c.Name = b.Name + "/" + db
+	c.URL = withDatabase(b.URL, db)
+	c.Discover = false
+	c.Rules = nil
+	for i := range b.Rules {
+		if r := &b.Rules[i]; r.re != nil && r.re.MatchString(db) {
+			c = r.apply(c)
+			if r.compresses() {
+				c.Compression, c.pgDumpCompress = r.compression, r.pgDumpCompress
+			}
+			break
+		}
+	}
+	return c
+}
+
+// runDiscovery backs up each discovered database and sums them up into one
+// result. One database failing doesn't stop the others. Databases are dumped
+// one at a time; with parallelUploads the upload, prune and maintenance of a
+// finished dump overlap with the next dumps.
+func runDiscovery(ctx context.Context, b Backup, dest Destination) RunResult {
+	res := RunResult{Backup: b.Name, Started: time.Now()}
+	dbs, err := discoverDatabases(ctx, b)
+	if err != nil {
+		res.fail(PhasePrecheck, err)
+		res.Duration = time.Since(res.Started)
+		return res
+	}
+	log.Printf("[backup] %s: discovered %d databases: %s", b.Name, len(dbs), strings.Join(dbs, ", "))
+	return runMembers(ctx, b, dest, res, dbs, b.forDatabase, nil)
+}
+
+// runMembers backs up the members of a discovery or snapshot backup, each
+// built by member from its name, and sums them up into res. dumped, if
+// set, is called once the last dump is done.
+func runMembers(ctx context.Context, b Backup, dest Destination, res RunResult, names []string, member func(string) Backup, dumped func()) RunResult {
+	results := make([]RunResult, len(names))
+	// sem bounds the uploads in flight, and with them the finished dumps
+	// waiting on local disk.
+	sem := make(chan struct{}, max(b.ParallelUploads, 1))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		c := member(name)
+		ws, err := newWorkspace(ctx, dest)
+		if err != nil {
+			results[i] = workspaceFailure(c, err)
+			continue
+		}
+		stop := startRun(c.Name)
+		done := func() {
+			removeWorkspace(ws)
+			stop()
+		}
+		dumped, out := dumpBackup(ctx, c, dest, ws)
+		if out == "" {
+			results[i] = dumped
+			done()
+			continue
+		}
+		if b.ParallelUploads <= 0 {
+			results[i] = store(ctx, c, dest, dumped, out)
+			done()
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer done()
+			results[i] = store(ctx, c, dest, dumped, out)
+		}()
+	}
+	if dumped != nil {
+		dumped()
+	}
+	wg.Wait()
+
+	var errs, pruneErrs, copyErrs []error
+	retryable := true
+	for i, db := range names {
+		r := results[i]
+		res.Size += r.Size
+		if r.PruneErr != nil {
+			pruneErrs = append(pruneErrs, fmt.Errorf("%s: %w", db, r.PruneErr))
+		}
+		if r.LocalCopyErr != nil {
+			copyErrs = append(copyErrs, fmt.Errorf("%s: %w", db, r.LocalCopyErr))
+		}
+		if r.Err == nil {
+			continue
+		}
+		log.Printf("[backup] %s: %s failed in %s phase: %v", b.Name, db, r.Phase, r.Err)
+		if len(errs) == 0 {
+			res.Phase, res.Stderr = r.Phase, r.Stderr
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", db, r.Err))
+		retryable = retryable && r.Retryable
+	}
+	res.Err, res.PruneErr, res.LocalCopyErr = errors.Join(errs...), errors.Join(pruneErrs...), errors.Join(copyErrs...)
+	res.Retryable = res.Err != nil && retryable
+	res.Duration = time.Since(res.Started)
+	return res
+}
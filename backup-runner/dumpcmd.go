@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+/*
+   dump writes one backup's dump to stdout, for ad-hoc use as a plain dump
+   utility in scripts:
+
+       backup-runner dump --backup app --stdout | ssh elsewhere 'cat > app.dump'
+
+   No destination is involved: nothing is uploaded, pruned, reported or
+   notified. The output is pg_dump's custom format as pg_restore reads it;
+   an external compressor the backup configures is not applied (pg_dump
+   compresses with its own default instead), so pipe through one if
+   needed. stdout carries nothing but the dump; logs and errors go to
+   stderr, and a failed dump exits non-zero, its output being truncated.
+*/
+
+func dumpCmd(args []string) int {
+	// Nothing but the dump may reach stdout.
+	log.SetOutput(os.Stderr)
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	name := fs.String("backup", "", "backup to dump")
+	stdout := fs.Bool("stdout", false, "write the dump to stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner dump --backup name --stdout")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *name == "" || !*stdout || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	var b Backup
+	found := false
+	for _, c := range cfg.Backups {
+		if c.Name == *name {
+			b, found = c, true
+			break
+		}
+	}
+	switch {
+	case !found:
+		fmt.Fprintf(os.Stderr, "unknown backup %q\n", *name)
+		return 2
+	case b.Discover || len(b.Parts) > 0:
+		fmt.Fprintf(os.Stderr, "backup %q dumps several databases or parts; dump --stdout needs a single dump\n", *name)
+		return 2
+	}
+	b.Compression = ""
+
+	// pg_dump writes no files here, but a pgDumpImage container mounts it.
+	dir, err := os.MkdirTemp(workRoot, "pgbackup-dump-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	if err := pgDumpTo(ctx, b, dir, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: dump failed, the output is incomplete: %v\n", b.Name, err)
+		return 1
+	}
+	return 0
+}
+
+// pgDumpTo runs the pg_dump of b like runPgDump, with its output going to
+// w instead of a file. dir is where it may write files.
+func pgDumpTo(ctx context.Context, b Backup, dir string, w io.Writer) error {
+	cmd, err := pgDumpCommand(ctx, b, dir, pgDumpArgs(b))
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = w
+	tail, rules := dumpStderr(ctx, b)
+	return rules.judge(b, runCaptured(cmd, tail))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sync"
+)
+
+/*
+   pg_dump's exit status decides whether a dump is good, unless the backup
+   says otherwise about its stderr. failOnStderr patterns turn a warning
+   into a failure: a dump whose stderr has a matching line fails even though
+   pg_dump exited 0. tolerateStderr patterns do the opposite for known,
+   benign errors: a non-zero exit is accepted, with a warning, when pg_dump
+   printed something and every line of it matches one of them. Every line
+   is checked as it is written, not just the tail that is kept for reports.
+*/
+
+type stderrRules struct {
+	fail, tolerate []*regexp.Regexp
+
+	mu          sync.Mutex
+	lines       int
+	intolerable int
+	failLine    string
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// newStderrRules returns b's stderr rules, or nil if it has none. The
+// patterns were checked by validateConfig.
+func newStderrRules(b Backup) *stderrRules {
+	if len(b.FailOnStderr) == 0 && len(b.TolerateStderr) == 0 {
+		return nil
+	}
+	r := &stderrRules{}
+	r.fail, _ = compilePatterns(b.FailOnStderr)
+	r.tolerate, _ = compilePatterns(b.TolerateStderr)
+	return r
+}
+
+func (r *stderrRules) observe(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines++
+	if r.failLine == "" && matchesAny(r.fail, line) {
+		r.failLine = line
+	}
+	if !matchesAny(r.tolerate, line) {
+		r.intolerable++
+	}
+}
+
+func matchesAny(res []*regexp.Regexp, line string) bool {
+	for _, re := range res {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// judge turns pg_dump's outcome, err, into the dump's.
+func (r *stderrRules) judge(b Backup, err error) error {
+	if r == nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failLine != "" {
+		return fmt.Errorf("stderr matches failOnStderr: %s", r.failLine)
+	}
+	var exitErr *exec.ExitError
+	if err != nil && len(r.tolerate) > 0 && r.lines > 0 && r.intolerable == 0 && errors.As(err, &exitErr) {
+		log.Printf("[backup] WARNING: %s: pg_dump failed (%v), but all of its stderr matches tolerateStderr; keeping the dump", b.Name, err)
+		return nil
+	}
+	return err
+}
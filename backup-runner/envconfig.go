@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+   Config from the environment. For the common one-database deployment a
+   config file is overhead, so with no CONFIG_FILE set, no /config.yaml and
+   BACKUP_URL in the environment, a config with a single backup and
+   destination is put together from the variables below instead. It is
+   validated like a file. A config file, when there is one, always wins.
+*/
+
+const defaultConfigFile = "/config.yaml"
+
+// envConfigName names the destination of an environment config.
+const envConfigName = "default"
+
+// configFromEnv reports whether the config comes from the environment.
+func configFromEnv() bool {
+	if os.Getenv("CONFIG_FILE") != "" || os.Getenv("BACKUP_URL") == "" {
+		return false
+	}
+	if _, err := os.Stat(defaultConfigFile); err == nil {
+		log.Printf("[config] %s exists, ignoring BACKUP_URL and the other environment config variables", defaultConfigFile)
+		return false
+	}
+	return true
+}
+
+// envConfig builds the one-backup config from the environment.
+func envConfig() (Config, error) {
+	var errs []error
+	atoi := func(name string) int {
+		v := os.Getenv(name)
+		if v == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not a number", name, v))
+		}
+		return n
+	}
+	boolean := func(name string) bool {
+		v := os.Getenv(name)
+		if v == "" {
+			return false
+		}
+		t, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q is not true or false", name, v))
+		}
+		return t
+	}
+	duration := func(name string) time.Duration {
+		v := os.Getenv(name)
+		if v == "" {
+			return 0
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+		return d
+	}
+
+	dest := Destination{
+		Type:           os.Getenv("DEST_TYPE"),
+		Bucket:         os.Getenv("DEST_BUCKET"),
+		Prefix:         os.Getenv("DEST_PREFIX"),
+		Endpoint:       os.Getenv("DEST_ENDPOINT"),
+		Region:         os.Getenv("DEST_REGION"),
+		ForcePathStyle: boolean("DEST_FORCE_PATH_STYLE"),
+	}
+	fillDestFromEnv(&dest)
+	b := Backup{
+		Name:         os.Getenv("BACKUP_NAME"),
+		URL:          os.Getenv("BACKUP_URL"),
+		Destination:  envConfigName,
+		Schedule:     os.Getenv("BACKUP_SCHEDULE"),
+		Interval:     duration("BACKUP_INTERVAL"),
+		MaxHistory:   atoi("BACKUP_MAX_HISTORY"),
+		KeepPerDay:   atoi("BACKUP_KEEP_PER_DAY"),
+		MaxAge:       duration("BACKUP_MAX_AGE"),
+		Compression:  os.Getenv("BACKUP_COMPRESSION"),
+		HeartbeatURL: os.Getenv("BACKUP_HEARTBEAT_URL"),
+	}
+	if b.Schedule == "" && b.Interval == 0 {
+		b.Schedule = "@daily"
+	}
+	cfg := Config{
+		Destinations: map[string]Destination{envConfigName: dest},
+		Backups:      []Backup{b},
+		Notify: Notify{
+			Webhook:   os.Getenv("NOTIFY_WEBHOOK"),
+			OnFailure: os.Getenv("NOTIFY_WEBHOOK") != "",
+		},
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, fmt.Errorf("config from environment: %w", err)
+	}
+	return cfg, nil
+}
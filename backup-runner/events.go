@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Events. With events.type set, the lifecycle of every run is published as
+   JSON to a Kafka or NATS topic, so other systems can react to backups
+   without polling: "started" when a run begins, "succeeded", "failed" or
+   "skipped" when it ends, with the run as it appears in the report file
+   (reportEntry), and "pruned" when retention deleted objects.
+
+   Publishing never holds up a run. Events go into a bounded buffer that a
+   single goroutine drains; when the buffer is full the event is dropped and
+   counted in pgbackup_events_dropped_total. Kafka messages are produced with
+   kcat, like the other tools the runner shells out to; NATS speaks its text
+   protocol directly over a short-lived connection per event.
+*/
+
+const (
+	defaultEventBuffer  = 100
+	eventPublishTimeout = 10 * time.Second
+	// eventFlushTimeout bounds how long run waits for buffered events
+	// before it exits.
+	eventFlushTimeout = 15 * time.Second
+)
+
+var eventsDropped = newCounter("pgbackup_events_dropped_total", "Events dropped because the publish buffer was full.", "event")
+
+type Events struct {
+	// Type is kafka or nats; empty disables events.
+	Type string `yaml:"type"`
+	// Brokers are the Kafka bootstrap brokers, host:port.
+	Brokers []string `yaml:"brokers"`
+	// URL is the NATS server, nats://[user:password@]host:port.
+	URL   string `yaml:"url"`
+	Topic string `yaml:"topic"`
+	// Buffer is how many events may wait to be published (default 100).
+	Buffer int `yaml:"buffer"`
+	// KcatPath is the kcat binary used for Kafka (default: PATH).
+	KcatPath string `yaml:"kcatPath"`
+}
+
+func (e Events) validate() error {
+	switch e.Type {
+	case "":
+		if len(e.Brokers) > 0 || e.URL != "" || e.Topic != "" {
+			return fmt.Errorf("events: brokers, url and topic need type")
+		}
+		return nil
+	case "kafka":
+		if len(e.Brokers) == 0 {
+			return fmt.Errorf("events: kafka needs brokers")
+		}
+		if e.URL != "" {
+			return fmt.Errorf("events: url is for nats, use brokers for kafka")
+		}
+	case "nats":
+		if e.URL == "" {
+			return fmt.Errorf("events: nats needs url")
+		}
+		if len(e.Brokers) > 0 {
+			return fmt.Errorf("events: brokers are for kafka, use url for nats")
+		}
+		if _, err := natsAddr(e.URL); err != nil {
+			return fmt.Errorf("events.url: %w", err)
+		}
+		if strings.ContainsAny(e.Topic, " \t\r\n") {
+			return fmt.Errorf("events.topic: %q is not a NATS subject", e.Topic)
+		}
+	default:
+		return fmt.Errorf("events.type must be kafka or nats, got %q", e.Type)
+	}
+	if e.Topic == "" {
+		return fmt.Errorf("events: %s needs topic", e.Type)
+	}
+	if e.Buffer < 0 {
+		return fmt.Errorf("events.buffer must not be negative")
+	}
+	return nil
+}
+
+// event is one message on the topic.
+type event struct {
+	Event  string            `json:"event"`
+	Time   time.Time         `json:"time"`
+	Backup string            `json:"backup"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Run is set for the end of a run.
+	Run *reportEntry `json:"run,omitempty"`
+	// Prune is set for pruned.
+	Prune *pruneEvent `json:"prune,omitempty"`
+}
+
+type pruneEvent struct {
+	Bucket string   `json:"bucket"`
+	Prefix string   `json:"prefix"`
+	Count  int      `json:"count"`
+	Bytes  int64    `json:"bytes"`
+	Keys   []string `json:"keys"`
+}
+
+type publisher struct {
+	cfg  Events
+	ch   chan event
+	done chan struct{}
+}
+
+var (
+	eventsMu  sync.RWMutex
+	eventsPub *publisher
+)
+
+// setEvents replaces the publisher. Events still buffered for the previous
+// one are published to its own topic before its goroutine ends.
+func setEvents(e Events) {
+	var p *publisher
+	if e.Type != "" {
+		size := e.Buffer
+		if size == 0 {
+			size = defaultEventBuffer
+		}
+		p = &publisher{cfg: e, ch: make(chan event, size), done: make(chan struct{})}
+		go p.loop()
+	}
+	eventsMu.Lock()
+	old := eventsPub
+	eventsPub = p
+	eventsMu.Unlock()
+	if old != nil {
+		close(old.ch)
+	}
+}
+
+// flushEvents stops the publisher and waits, up to eventFlushTimeout, for
+// the events still buffered to go out.
+func flushEvents() {
+	eventsMu.Lock()
+	p := eventsPub
+	eventsPub = nil
+	eventsMu.Unlock()
+	if p == nil {
+		return
+	}
+	close(p.ch)
+	select {
+	case <-p.done:
+	case <-time.After(eventFlushTimeout):
+		log.Printf("[events] WARNING: %d events not published before exit", len(p.ch))
+	}
+}
+
+// publishEvent queues ev without blocking, dropping it if the buffer is
+// full.
+func publishEvent(ev event) {
+	eventsMu.RLock()
+	defer eventsMu.RUnlock()
+	p := eventsPub
+	if p == nil {
+		return
+	}
+	ev.Time = time.Now().UTC()
+	ev.Labels = backupLabels(ev.Backup)
+	select {
+	case p.ch <- ev:
+	default:
+		eventsDropped.Inc(ev.Event)
+	}
+}
+
+func publishStarted(b Backup) {
+	publishEvent(event{Event: "started", Backup: b.Name})
+}
+
+func publishFinished(b Backup, r RunResult) {
+	name := map[string]string{"success": "succeeded", "failed": "failed", "skipped": "skipped"}[r.status()]
+	entry := newReportEntry(r)
+	publishEvent(event{Event: name, Backup: b.Name, Run: &entry})
+}
+
+func publishPruned(b Backup, pe pruneEvent) {
+	publishEvent(event{Event: "pruned", Backup: b.Name, Prune: &pe})
+}
+
+func (p *publisher) loop() {
+	defer close(p.done)
+	for ev := range p.ch {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			log.Printf("[events] encode %s: %v", ev.Event, err)
+			continue
+		}
+		if err := p.send(body); err != nil {
+			log.Printf("[events] WARNING: publishing %s for %s to %s failed: %v", ev.Event, ev.Backup, p.cfg.Topic, err)
+		}
+	}
+}
+
+func (p *publisher) send(body []byte) error {
+	if p.cfg.Type == "kafka" {
+		return kafkaPublish(p.cfg, body)
+	}
+	return natsPublish(p.cfg, body)
+}
+
+// kafkaPublish produces body as one message with kcat.
+func kafkaPublish(e Events, body []byte) error {
+	cmd := exec.Command(binPath(e.KcatPath, "kcat"), "-P", "-b", strings.Join(e.Brokers, ","), "-t", e.Topic,
+		"-m", fmt.Sprint(int(eventPublishTimeout.Seconds())))
+	// JSON encoding escapes newlines, so the message is a single line.
+	cmd.Stdin = strings.NewReader(string(body))
+	_, err := outputCaptured(cmd)
+	return err
+}
+
+// natsAddr returns the host:port of a nats:// URL.
+func natsAddr(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return "", fmt.Errorf("%q is not a nats://host:port URL", redactConn(raw))
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "4222"), nil
+	}
+	return u.Host, nil
+}
+
+// natsPublish connects to the server, publishes body and waits for the
+// PONG that confirms the server processed it.
+func natsPublish(e Events, body []byte) error {
+	addr, err := natsAddr(e.URL)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, eventPublishTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(eventPublishTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading INFO: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	opts := map[string]any{"verbose": false, "pedantic": false, "name": "pg-backup-runner", "lang": "go"}
+	if u, _ := url.Parse(e.URL); u.User != nil {
+		if pw, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pw
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	msg := fmt.Sprintf("CONNECT %s\r\nPUB %s %d\r\n%s\r\nPING\r\n", connect, e.Topic, len(body), body)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("waiting for PONG: %w", err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// +OK, PING and INFO updates are of no interest here.
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+   Fan-out. A backup with fanout uploads each dump to those destinations
+   as well as its own, from the same local file, so one dump ends up in
+   several places (another region, another provider). fanoutPolicy decides
+   what the run's outcome is when only some uploads succeed: all (the
+   default) fails the run unless every destination has the dump, any is
+   content with one, quorum with a majority. Retention and latest pointers
+   only advance on a successful run, on the destinations that have the new
+   dump, so a destination that keeps failing never has its history pruned
+   away. fanoutPrune narrows down where retention runs: succeeded (the
+   default) prunes every destination that has the new dump, all only
+   prunes when every destination has it, so a partial run leaves all of
+   them as they were, and never prunes only the backup's own destination,
+   leaving the fanout copies to lifecycle rules. Each destination's outcome,
+   upload and prune, is logged and reported either way, and each goes
+   through its own breaker.
+*/
+
+type fanoutTarget struct {
+	name string
+	dest Destination
+}
+
+// DestinationResult is the outcome of one destination of a fan-out run.
+type DestinationResult struct {
+	Destination string
+	Key         string
+	Err         error
+	// Prune is what retention did on the destination: pruned, failed
+	// (PruneErr says why) or skipped; empty without retention.
+	Prune    string
+	PruneErr error
+}
+
+// destinationEntry is a DestinationResult in reports and on /status.
+type destinationEntry struct {
+	Destination string `json:"destination"`
+	Key         string `json:"key,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Prune       string `json:"prune,omitempty"`
+	PruneError  string `json:"pruneError,omitempty"`
+}
+
+func destinationEntries(rs []DestinationResult) []destinationEntry {
+	var out []destinationEntry
+	for _, r := range rs {
+		e := destinationEntry{Destination: r.Destination, Key: r.Key, Prune: r.Prune}
+		if r.Err != nil {
+			e.Error = r.Err.Error()
+		}
+		if r.PruneErr != nil {
+			e.PruneError = r.PruneErr.Error()
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// resolveFanout checks b's fanout and looks up its destinations.
+func (b *Backup) resolveFanout(dests map[string]Destination) []error {
+	var errs []error
+	switch b.FanoutPolicy {
+	case "", "all", "any", "quorum":
+	default:
+		errs = append(errs, fmt.Errorf("fanoutPolicy must be all, any or quorum, got %q", b.FanoutPolicy))
+	}
+	switch b.FanoutPrune {
+	case "", "succeeded", "all", "never":
+	default:
+		errs = append(errs, fmt.Errorf("fanoutPrune must be succeeded, all or never, got %q", b.FanoutPrune))
+	}
+	if len(b.Fanout) == 0 {
+		if b.FanoutPolicy != "" {
+			errs = append(errs, errors.New("fanoutPolicy needs fanout"))
+		}
+		if b.FanoutPrune != "" {
+			errs = append(errs, errors.New("fanoutPrune needs fanout"))
+		}
+		return errs
+	}
+	if dests[b.Destination].Type == "restic" {
+		errs = append(errs, errors.New("fanout is not supported from restic destinations"))
+	}
+	seen := map[string]bool{b.Destination: true}
+	b.fanoutTo = nil
+	for _, name := range b.Fanout {
+		d, ok := dests[name]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("fanout: unknown destination %q", name))
+		case seen[name]:
+			errs = append(errs, fmt.Errorf("fanout: destination %q is listed twice", name))
+		case d.Type == "restic":
+			errs = append(errs, fmt.Errorf("fanout: destination %q is restic, which is not supported", name))
+		default:
+			b.fanoutTo = append(b.fanoutTo, fanoutTarget{name: name, dest: d})
+		}
+		seen[name] = true
+	}
+	return errs
+}
+
+// fanoutNeeds is how many of n destinations must succeed under b's policy.
+func (b Backup) fanoutNeeds(n int) int {
+	switch b.FanoutPolicy {
+	case "any":
+		return 1
+	case "quorum":
+		return n/2 + 1
+	}
+	return n
+}
+
+// fanoutPruneSkip is why retention doesn't run on target i of n, of which
+// stored have the new dump, or "" if it does. Target 0 is the backup's own
+// destination.
+func (b Backup) fanoutPruneSkip(i, stored, n int) string {
+	switch {
+	case b.FanoutPrune == "all" && stored < n:
+		return fmt.Sprintf("fanoutPrune is all and %d of %d destinations have the dump", stored, n)
+	case b.FanoutPrune == "never" && i > 0:
+		return "fanoutPrune is never"
+	}
+	return ""
+}
+
+// store uploads a finished dump to b's destination, or to all of them with
+// fanout, and applies retention.
+func store(ctx context.Context, b Backup, dest Destination, dumped RunResult, out string) RunResult {
+	if len(b.fanoutTo) > 0 {
+		return storeFanout(ctx, b, dest, dumped, out)
+	}
+	return storeBackup(ctx, b, dest, dumped, out)
+}
+
+// storeFanout is storeBackup for a backup with fanout.
+func storeFanout(ctx context.Context, b Backup, dest Destination, dumped RunResult, out string) (res RunResult) {
+	res = dumped
+	defer func() { res.Duration = time.Since(res.Started) }()
+	targets := append([]fanoutTarget{{name: b.Destination, dest: dest}}, b.fanoutTo...)
+
+	type stored struct {
+		i      int
+		target fanoutTarget
+		b      Backup
+		up     uploaded
+	}
+	var ok []stored
+	var errs []error
+	for i, t := range targets {
+		c := b
+		c.Destination = t.name
+		r := dumped
+		if i > 0 {
+			// Only the backup's own destination can have been streamed to.
+			r.Key = ""
+		}
+		var up uploaded
+		err := admit(c, t.dest)
+		if err != nil {
+			r.fail(PhaseUpload, err)
+		} else {
+			up, err = uploadDump(ctx, c, t.dest, &r, out)
+			observe(c, t.dest, r)
+		}
+		res.Destinations = append(res.Destinations, DestinationResult{Destination: t.name, Key: r.Key, Err: err})
+		if err != nil {
+			log.Printf("[backup] %s: upload to destination %q failed: %v", b.Name, t.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", t.name, err))
+			if b.hasRetention() {
+				res.Destinations[i].Prune = "skipped"
+			}
+			continue
+		}
+		if len(ok) == 0 {
+			res.Key, res.SHA256 = r.Key, r.SHA256
+		}
+		ok = append(ok, stored{i: i, target: t, b: c, up: up})
+	}
+
+	keepLocal(ctx, b, &res, out)
+	need := b.fanoutNeeds(len(targets))
+	var names []string
+	for _, s := range ok {
+		names = append(names, s.target.name)
+	}
+	log.Printf("[backup] %s: stored on %d of %d destinations (%s), %d needed", b.Name, len(ok), len(targets), strings.Join(names, ", "), need)
+	if len(ok) < need {
+		res.fail(PhaseUpload, fmt.Errorf("fanout: %d of %d destinations succeeded, %d needed: %w", len(ok), len(targets), need, errors.Join(errs...)))
+		if b.hasRetention() {
+			for _, s := range ok {
+				res.Destinations[s.i].Prune = "skipped"
+			}
+		}
+		return res
+	}
+	if b.hasRetention() {
+		for _, s := range ok {
+			d := &res.Destinations[s.i]
+			if why := b.fanoutPruneSkip(s.i, len(ok), len(targets)); why != "" {
+				log.Printf("[prune] %s: not pruning destination %q: %s", b.Name, s.target.name, why)
+				d.Prune = "skipped"
+				continue
+			}
+			d.Prune = "pruned"
+			if d.PruneErr = applyRetention(ctx, s.b, s.target.dest, &res, s.up); d.PruneErr != nil {
+				d.Prune = "failed"
+			}
+		}
+	}
+	if b.PostMaintenance != nil {
+		postMaintenance(ctx, b)
+	}
+	for _, s := range ok {
+		s.up.finish(ctx, s.b, s.target.dest)
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Each destination of a fan-out run reports whether it was pruned, as
+// fanoutPrune has it.
+func TestFanoutPrune(t *testing.T) {
+	storageBackoff = time.Millisecond
+	t.Cleanup(func() { storageBackoff = 5 * time.Second })
+	// Uploads to bucket "down" fail; every listing is empty.
+	fakeBins(t, map[string]string{"aws": `case "$1 $2" in
+"s3api head-object") echo "An error occurred (404) when calling the HeadObject operation: Not Found" >&2; exit 254 ;;
+"s3api list-objects-v2") echo '{"Contents": []}' ;;
+"s3 cp") case "$4" in s3://down/*) echo "upload failed" >&2; exit 1 ;; esac ;;
+esac`})
+	dests := map[string]Destination{
+		"own":  {Bucket: "own"},
+		"copy": {Bucket: "copy"},
+		"down": {Bucket: "down"},
+	}
+	out := filepath.Join(t.TempDir(), "pgdump.dump")
+	if err := os.WriteFile(out, []byte("dump"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		prune  string
+		fanout []string
+		want   []string // prune outcome of own, then each of fanout
+	}{
+		{"", []string{"copy", "down"}, []string{"pruned", "pruned", "skipped"}},
+		{"succeeded", []string{"copy"}, []string{"pruned", "pruned"}},
+		{"all", []string{"copy", "down"}, []string{"skipped", "skipped", "skipped"}},
+		{"all", []string{"copy"}, []string{"pruned", "pruned"}},
+		{"never", []string{"copy", "down"}, []string{"pruned", "skipped", "skipped"}},
+	} {
+		t.Run(tc.prune+"/"+tc.fanout[len(tc.fanout)-1], func(t *testing.T) {
+			b := Backup{Name: "app", URL: "postgres://db/app", Destination: "own", MaxHistory: 3,
+				Fanout: tc.fanout, FanoutPolicy: "any", FanoutPrune: tc.prune}
+			if errs := b.resolveFanout(dests); len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			res := storeFanout(context.Background(), b, dests["own"], RunResult{Backup: b.Name, Started: time.Now()}, out)
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			var got []string
+			for _, d := range res.Destinations {
+				got = append(got, d.Prune)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("prune per destination = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveFanoutPrune(t *testing.T) {
+	dests := map[string]Destination{"own": {Bucket: "own"}, "copy": {Bucket: "copy"}}
+	for _, tc := range []struct {
+		fanout []string
+		prune  string
+		ok     bool
+	}{
+		{[]string{"copy"}, "", true},
+		{[]string{"copy"}, "succeeded", true},
+		{[]string{"copy"}, "all", true},
+		{[]string{"copy"}, "never", true},
+		{[]string{"copy"}, "always", false},
+		{nil, "never", false},
+	} {
+		b := Backup{Destination: "own", Fanout: tc.fanout, FanoutPrune: tc.prune}
+		if errs := b.resolveFanout(dests); (len(errs) == 0) != tc.ok {
+			t.Errorf("fanout %q, fanoutPrune %q: errors %v, want ok %v", tc.fanout, tc.prune, errs, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+)
+
+/*
+   Free space. A dump that runs the work volume full fails halfway with
+   ENOSPC and leaves a partial file behind. Before dumping, the free space
+   where the run's workspace lives is compared with what the dump is
+   expected to need: minFreeSpace, or the most the previous run of the
+   backup had on disk (dump plus compressed copy) with headroom for growth,
+   whichever is more. Below that the run is skipped and notified instead.
+   Peak sizes are remembered per backup while the process runs; after a
+   restart only minFreeSpace applies until the first run.
+*/
+
+const (
+	defaultMinFreeSpace ByteSize = 256 << 20
+	// freeSpaceHeadroom allows the next dump to be this much larger than
+	// the previous one.
+	freeSpaceHeadroom = 1.2
+)
+
+var (
+	peakMu    sync.Mutex
+	peakUsage = map[string]int64{}
+)
+
+func (b Backup) minFreeSpace() ByteSize {
+	if b.MinFreeSpace == 0 {
+		return defaultMinFreeSpace
+	}
+	return b.MinFreeSpace
+}
+
+// recordPeakUsage remembers the most disk a run of b took.
+func recordPeakUsage(name string, n int64) {
+	peakMu.Lock()
+	peakUsage[name] = n
+	peakMu.Unlock()
+}
+
+// neededSpace is how much free space a dump of b should find.
+func neededSpace(b Backup) (need ByteSize, estimated bool) {
+	need = b.minFreeSpace()
+	peakMu.Lock()
+	peak, ok := peakUsage[b.Name]
+	peakMu.Unlock()
+	if est := ByteSize(float64(peak) * freeSpaceHeadroom); ok && est > need {
+		return est, true
+	}
+	return need, false
+}
+
+func freeSpace(dir string) (ByteSize, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return ByteSize(int64(st.Bavail) * int64(st.Bsize)), nil
+}
+
+// checkFreeSpace reports whether ws has room for a dump of b. A failed
+// check doesn't block the backup.
+func checkFreeSpace(b Backup, ws string) bool {
+	free, err := freeSpace(ws)
+	if err != nil {
+		log.Printf("[backup] %s: free space check failed, dumping anyway: %v", b.Name, err)
+		return true
+	}
+	need, estimated := neededSpace(b)
+	if free >= need {
+		return true
+	}
+	basis := "minFreeSpace"
+	if estimated {
+		basis = "the previous run"
+	}
+	msg := fmt.Sprintf("only %s free in %s, %s needed going by %s, skipping dump", free, ws, need, basis)
+	log.Printf("[backup] %s: %s", b.Name, msg)
+	notify("disk_space_low", fmt.Sprintf("%s: %s", b.Name, msg), map[string]any{
+		"backup": b.Name,
+		"path":   ws,
+		"free":   int64(free),
+		"needed": int64(need),
+	})
+	return false
+}
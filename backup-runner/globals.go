@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Globals. pg_dump leaves out what belongs to the cluster rather than the
+   database: roles, their grants and tablespaces. With globals set on a
+   backup or its destination, every successful run also stores
+   pg_dumpall --globals-only as globals-<ts>.sql next to the dumps, so a
+   per-database backup can be restored onto an empty server. A discovery
+   backup stores them once per run, under the prefix of the database it
+   connects to. Globals keep their own retention, globalsMaxHistory. A
+   failure is reported on the run but doesn't fail it: the dump is there.
+   pg_dumpall writes plain SQL, which goes through the backup's compressor
+   like a dump does: globals-<ts>.sql.gz or .sql.zst.
+*/
+
+const globalsPrefix = "globals-"
+
+// dumpsGlobals reports whether runs of b also store the globals.
+func (b Backup) dumpsGlobals(dest Destination) bool {
+	return b.Globals || dest.Globals
+}
+
+func (b Backup) globalsMaxHistory() int {
+	if b.GlobalsMaxHistory > 0 {
+		return b.GlobalsMaxHistory
+	}
+	return b.MaxHistory
+}
+
+func isGlobalsKey(key string) bool {
+	name := filepath.Base(key)
+	if !strings.HasPrefix(name, globalsPrefix) {
+		return false
+	}
+	for _, ext := range []string{".sql", ".sql.gz", ".sql.zst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// globalsCompressor is the external compressor for b's globals. zstd that
+// pg_dump does inside the custom format has no such thing for plain SQL, so
+// the zstd binary is used if there is one.
+func globalsCompressor(b Backup) string {
+	if b.Compression != "" {
+		return b.Compression
+	}
+	if strings.HasPrefix(b.pgDumpCompress, "zstd") {
+		if _, err := exec.LookPath("zstd"); err == nil {
+			return "zstd"
+		}
+	}
+	return ""
+}
+
+// storeGlobals dumps, uploads and prunes the globals of b's server.
+func storeGlobals(ctx context.Context, b Backup, dest Destination) error {
+	err := uploadGlobals(ctx, b, dest)
+	if err == nil {
+		err = pruneGlobals(ctx, b, dest)
+	}
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: globals: %v", b.Name, err)
+		notify("globals_failed", fmt.Sprintf("storing the globals for %s failed: %v", b.Name, err), map[string]any{
+			"backup": b.Name,
+			"error":  err.Error(),
+		})
+		return err
+	}
+	return nil
+}
+
+func uploadGlobals(ctx context.Context, b Backup, dest Destination) error {
+	ws, err := newWorkspace(ctx, dest)
+	if err != nil {
+		return fmt.Errorf("workspace: %w", err)
+	}
+	defer removeWorkspace(ws)
+	name := globalsPrefix + time.Now().UTC().Format(tsLayout) + ".sql"
+	out := filepath.Join(ws, name)
+	cmd, err := pgDumpallCommand(ctx, b, ws, []string{"--globals-only", "-f", out})
+	if err != nil {
+		return err
+	}
+	if err := runCaptured(cmd, nil); err != nil {
+		return fmt.Errorf("pg_dumpall: %w", err)
+	}
+	c := b
+	c.Compression = globalsCompressor(b)
+	if st, err := os.Stat(out); c.Compression != "" && err == nil && !c.skipsCompression(st.Size()) {
+		if out, err = compressFile(ctx, c, out); err != nil {
+			return err
+		}
+		name = filepath.Base(out)
+	}
+	key := basePrefix(b, dest) + name
+	err = storageOp(ctx, dest, "upload "+key, 0, func(ctx context.Context) error {
+		return dest.store().put(ctx, key, out)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[backup] uploaded %s", dest.store().url(key))
+	return nil
+}
+
+// pgDumpallCommand builds a pg_dumpall invocation for b, taken from the
+// same place as its pg_dump: next to pgDumpPath, or from pgDumpImage.
+func pgDumpallCommand(ctx context.Context, b Backup, dir string, args []string) (*exec.Cmd, error) {
+	env, err := pgEnv(b)
+	if err != nil {
+		return nil, err
+	}
+	// pg_dumpall ignores PGDATABASE and connects to postgres or template1
+	// unless told otherwise.
+	if db := dbName(b.URL); db != "all" {
+		args = append([]string{"-l", db}, args...)
+	}
+	if b.PgDumpImage != "" {
+		return containerTool(ctx, b, dir, "pg_dumpall", args, env)
+	}
+	bin := "pg_dumpall"
+	if b.PgDumpPath != "" {
+		bin = filepath.Join(filepath.Dir(b.PgDumpPath), bin)
+	}
+	cmd := runCommand(ctx, bin, args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// pruneGlobals keeps the newest globalsMaxHistory globals of b. Like
+// pruneHistory it deletes at most maxDeletePerRun of them, oldest first.
+func pruneGlobals(ctx context.Context, b Backup, dest Destination) error {
+	keep := b.globalsMaxHistory()
+	if keep <= 0 {
+		return nil
+	}
+	prefix := basePrefix(b, dest)
+	store := dest.store()
+	var objs []s3Object
+	err := storageOp(ctx, dest, "list "+store.url(prefix), pruneTimeout, func(ctx context.Context) error {
+		var err error
+		objs, err = store.list(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	var keys []string
+	for _, o := range objs {
+		if !strings.Contains(strings.TrimPrefix(o.Key, prefix), "/") && isGlobalsKey(o.Key) {
+			keys = append(keys, o.Key)
+		}
+	}
+	if len(keys) <= keep {
+		return nil
+	}
+	// The timestamp in the name sorts chronologically.
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	expired := keys[keep:]
+	if limit := b.deleteCap(); limit > 0 && len(expired) > limit {
+		log.Printf("[prune] WARNING: %d globals under %s exceed globalsMaxHistory but maxDeletePerRun is %d; "+
+			"deleting the oldest %d only, manual intervention required", len(expired), store.url(prefix), limit, limit)
+		notify("prune_capped", fmt.Sprintf("globals prune for %s wanted to delete %d globals from %s but is capped at %d; please investigate",
+			b.Name, len(expired), store.url(prefix), limit), map[string]any{
+			"backup":  b.Name,
+			"bucket":  dest.Bucket,
+			"prefix":  prefix,
+			"expired": len(expired),
+			"cap":     limit,
+			"globals": true,
+		})
+		expired = expired[len(expired)-limit:]
+	}
+	log.Printf("[prune] deleting %d old globals under %s", len(expired), store.url(prefix))
+	err = storageOp(ctx, dest, "delete from "+store.url(prefix), pruneTimeout, func(ctx context.Context) error {
+		locked, err := store.remove(ctx, expired)
+		if len(locked) > 0 {
+			log.Printf("[prune] %d globals retained by object lock: %s", len(locked), strings.Join(locked, ", "))
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	return nil
+}
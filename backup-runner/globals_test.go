@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A globals prune past maxDeletePerRun deletes only the oldest and says so.
+func TestPruneGlobalsCapped(t *testing.T) {
+	var list struct {
+		Contents []s3Object `json:"Contents"`
+	}
+	var keys []string
+	for day := 1; day <= 10; day++ {
+		k := fmt.Sprintf("app/globals-202401%02dT020000Z.sql", day)
+		keys = append(keys, k)
+		list.Contents = append(list.Contents, s3Object{Key: k})
+	}
+	listing := filepath.Join(t.TempDir(), "list.json")
+	body, _ := json.Marshal(list)
+	if err := os.WriteFile(listing, body, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deletes := filepath.Join(t.TempDir(), "deletes")
+	t.Setenv("LISTING", listing)
+	t.Setenv("DELETES", deletes)
+	fakeBins(t, map[string]string{"aws": `case "$2" in
+list-objects-v2) cat "$LISTING" ;;
+delete-objects) for a; do last=$a; done; echo "$last" >> "$DELETES" ;;
+esac`})
+
+	var (
+		mu     sync.Mutex
+		events []map[string]any
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev map[string]any
+		json.NewDecoder(r.Body).Decode(&ev)
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	setNotifier(Notify{Webhook: srv.URL})
+	t.Cleanup(func() { setNotifier(Notify{}) })
+
+	b := Backup{Name: "app", URL: "postgres://db/app", GlobalsMaxHistory: 2, MaxDeletePerRun: 3}
+	if err := pruneGlobals(context.Background(), b, Destination{Bucket: "bucket"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := os.ReadFile(deletes)
+	var deleted []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		var req struct{ Objects []struct{ Key string } }
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatalf("delete request %q: %v", line, err)
+		}
+		for _, o := range req.Objects {
+			deleted = append(deleted, o.Key)
+		}
+	}
+	slices.Sort(deleted)
+	if want := keys[:3]; !slices.Equal(deleted, want) {
+		t.Errorf("deleted %q, want the oldest three %q", deleted, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 || events[0]["event"] != "prune_capped" || events[0]["expired"] != float64(8) || events[0]["cap"] != float64(3) {
+		t.Errorf("notifications = %v, want one prune_capped for 8 expired, cap 3", events)
+	}
+}
@@ -0,0 +1,158 @@
+//go:build integration
+
+package main
+
+/*
+   End-to-end test against a real MinIO and PostgreSQL, both started in
+   Docker: three backups of one database with maxHistory: 2, through an
+   http:// endpoint with an explicit port and path-style addressing, leave
+   the two newest dumps and their manifests in the bucket. Opt-in, as it
+   needs Docker, pg_dump and the aws CLI on the host:
+
+       go test -tags integration -run Integration ./...
+*/
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	minioImage    = "minio/minio:latest"
+	postgresImage = "postgres:16-alpine"
+)
+
+func TestIntegrationBackupAndPrune(t *testing.T) {
+	for _, bin := range []string{"docker", "pg_dump", "psql", "aws"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("%s not found: %v", bin, err)
+		}
+	}
+
+	minio := startContainer(t, "-e", "MINIO_ROOT_USER=minioadmin", "-e", "MINIO_ROOT_PASSWORD=minioadmin",
+		"-p", "127.0.0.1::9000", minioImage, "server", "/data")
+	pg := startContainer(t, "-e", "POSTGRES_PASSWORD=secret", "-p", "127.0.0.1::5432", postgresImage)
+	endpoint := "http://" + hostPort(t, minio, "9000")
+	url := "postgres://postgres:secret@" + hostPort(t, pg, "5432") + "/postgres?sslmode=disable"
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	t.Setenv("AWS_REGION", "us-east-1")
+	waitFor(t, "minio", func() error {
+		return exec.Command("aws", "--endpoint-url", endpoint, "s3", "mb", "s3://backups").Run()
+	})
+	waitFor(t, "postgres", func() error {
+		return exec.Command("psql", url, "-c", "CREATE TABLE IF NOT EXISTS t AS SELECT generate_series(1, 1000) AS n").Run()
+	})
+
+	config := path.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(config, []byte(fmt.Sprintf(`destinations:
+  minio:
+    bucket: backups
+    prefix: it
+    endpoint: %s
+    forcePathStyle: true
+backups:
+  - name: it
+    url: %s
+    destination: minio
+    schedule: "@daily"
+    compression: gzip
+    maxHistory: 2
+    writeManifest: true
+`, endpoint, url)), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", config)
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cfg.Backups[0]
+	dest := cfg.Destinations[b.Destination]
+
+	var newest string
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			// Keys have second resolution.
+			time.Sleep(1100 * time.Millisecond)
+		}
+		res := runBackup(context.Background(), b, dest)
+		if res.Err != nil || res.PruneErr != nil {
+			t.Fatalf("run %d: %v, prune: %v", i+1, res.Err, res.PruneErr)
+		}
+		newest = res.Key
+	}
+
+	objs, err := dest.store().list(context.Background(), basePrefix(b, dest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dumps, manifests int
+	kept := false
+	for _, o := range objs {
+		switch {
+		case isDumpKey(o.Key, b.dumpPrefix()):
+			kept = kept || o.Key == newest
+			if !strings.HasSuffix(o.Key, ".dump.gz") || o.Size == 0 {
+				t.Errorf("unexpected dump %s (%d bytes)", o.Key, o.Size)
+			}
+			dumps++
+		case strings.HasSuffix(o.Key, ".json"):
+			manifests++
+		}
+	}
+	if dumps != 2 || manifests != 2 {
+		t.Errorf("after 3 runs with maxHistory 2: %d dumps and %d manifests, want 2 and 2: %v", dumps, manifests, objs)
+	}
+	if !kept {
+		t.Errorf("newest dump %s was pruned", newest)
+	}
+}
+
+// startContainer runs a detached container, removed when the test ends.
+func startContainer(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("docker", append([]string{"run", "-d", "--rm"}, args...)...).Output()
+	if err != nil {
+		t.Skipf("docker run: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", id).Run() })
+	return id
+}
+
+// hostPort returns the host address the container's port is published on.
+func hostPort(t *testing.T, id, port string) string {
+	t.Helper()
+	out, err := exec.Command("docker", "port", id, port+"/tcp").Output()
+	if err != nil {
+		t.Fatalf("docker port: %v", err)
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
+
+func waitFor(t *testing.T, what string, ready func() error) {
+	t.Helper()
+	deadline := time.Now().Add(time.Minute)
+	for {
+		err := ready()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s not ready: %v", what, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   S3 Inventory as a prune source. With pruneSource: inventory, retention
+   reads the objects under a backup's prefix from the newest CSV inventory
+   report of the destination bucket instead of listing the bucket, which is
+   slow and costly with millions of objects. Dumps uploaded after the report
+   are missing from it, so a prune deletes at most what a live listing would
+   have; they are picked up by a later report. A stale or unreadable report
+   falls back to live listing.
+*/
+
+const defaultInventoryMaxAge = 48 * time.Hour
+
+// Inventory locates a destination bucket's S3 Inventory reports.
+type Inventory struct {
+	// Location is where the reports are delivered:
+	// s3://<inventory bucket>/<prefix>/<source bucket>/<configuration id>.
+	Location string `yaml:"location"`
+	// MaxAge is how old the newest report may be before live listing is
+	// used instead. Default 48h, as reports are delivered daily.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+func (i Inventory) maxAge() time.Duration {
+	if i.MaxAge <= 0 {
+		return defaultInventoryMaxAge
+	}
+	return i.MaxAge
+}
+
+// split returns the inventory bucket and the report root within it.
+func (i Inventory) split() (bucket, root string, err error) {
+	rest, ok := strings.CutPrefix(i.Location, "s3://")
+	if !ok {
+		return "", "", fmt.Errorf("inventory location %q must be an s3:// URL", i.Location)
+	}
+	bucket, root, _ = strings.Cut(rest, "/")
+	if bucket == "" || strings.Trim(root, "/") == "" {
+		return "", "", fmt.Errorf("inventory location %q must be s3://<bucket>/<path to the inventory configuration>", i.Location)
+	}
+	return bucket, strings.Trim(root, "/") + "/", nil
+}
+
+// inventoryManifest is the manifest.json of one inventory report.
+type inventoryManifest struct {
+	SourceBucket      string `json:"sourceBucket"`
+	FileFormat        string `json:"fileFormat"`
+	FileSchema        string `json:"fileSchema"`
+	CreationTimestamp string `json:"creationTimestamp"`
+	Files             []struct {
+		Key string `json:"key"`
+	} `json:"files"`
+}
+
+// inventoryObjects returns the current objects under prefix according to the
+// newest inventory report of dest.
+func inventoryObjects(ctx context.Context, dest Destination, prefix string) ([]s3Object, error) {
+	bucket, root, err := dest.Inventory.split()
+	if err != nil {
+		return nil, err
+	}
+	// Reports may live in another bucket, reached with the same credentials.
+	inv := dest
+	inv.Bucket = bucket
+	store := inv.store()
+
+	var reports []s3Object
+	err = storageOp(ctx, inv, "list "+store.url(root), pruneTimeout, func(ctx context.Context) error {
+		var err error
+		reports, err = store.list(ctx, root)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Reports are in <root>/<YYYY-MM-DDTHH-MMZ>/manifest.json; the dated
+	// directories sort chronologically.
+	var newest string
+	for _, o := range reports {
+		rel := strings.TrimPrefix(o.Key, root)
+		if strings.Count(rel, "/") == 1 && path.Base(rel) == "manifest.json" && o.Key > newest {
+			newest = o.Key
+		}
+	}
+	if newest == "" {
+		return nil, fmt.Errorf("no inventory report under %s", store.url(root))
+	}
+
+	dir, err := os.MkdirTemp("", "pginventory-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	get := func(key string) (string, error) {
+		file := filepath.Join(dir, path.Base(key))
+		return file, storageOp(ctx, inv, "download "+key, pruneTimeout, func(ctx context.Context) error {
+			return store.get(ctx, key, file)
+		})
+	}
+
+	file, err := get(newest)
+	if err != nil {
+		return nil, err
+	}
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m inventoryManifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", newest, err)
+	}
+	if m.SourceBucket != dest.Bucket {
+		return nil, fmt.Errorf("%s is an inventory of bucket %q, not %q", newest, m.SourceBucket, dest.Bucket)
+	}
+	if m.FileFormat != "CSV" {
+		return nil, fmt.Errorf("%s: only CSV inventories are supported, got %s", newest, m.FileFormat)
+	}
+	ms, err := strconv.ParseInt(m.CreationTimestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: creationTimestamp: %w", newest, err)
+	}
+	if age := time.Since(time.UnixMilli(ms)); age > dest.Inventory.maxAge() {
+		return nil, fmt.Errorf("newest inventory report %s is %s old, more than maxAge %s", newest, age.Round(time.Minute), dest.Inventory.maxAge())
+	}
+
+	var objs []s3Object
+	for _, f := range m.Files {
+		file, err := get(f.Key)
+		if err != nil {
+			return nil, err
+		}
+		found, err := readInventoryCSV(file, m.FileSchema, prefix)
+		os.Remove(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Key, err)
+		}
+		objs = append(objs, found...)
+	}
+	return objs, nil
+}
+
+// readInventoryCSV reads the objects under prefix from a gzipped CSV report
+// file whose columns are given by schema.
+func readInventoryCSV(file, schema, prefix string) ([]s3Object, error) {
+	col := map[string]int{}
+	for i, name := range strings.Split(schema, ",") {
+		col[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"Key", "Size", "LastModifiedDate"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("inventory has no %s field", name)
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return rec[i]
+		}
+		return ""
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	r := csv.NewReader(zr)
+	r.FieldsPerRecord = -1
+	var objs []s3Object
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return objs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Inventories that include versions list noncurrent versions and
+		// delete markers too; only current objects count.
+		if field(rec, "IsLatest") == "false" || field(rec, "IsDeleteMarker") == "true" {
+			continue
+		}
+		key, err := url.QueryUnescape(field(rec, "Key"))
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		o := s3Object{Key: key, ETag: field(rec, "ETag"), StorageClass: field(rec, "StorageClass")}
+		o.Size, _ = strconv.ParseInt(field(rec, "Size"), 10, 64)
+		if o.LastModified, err = time.Parse(time.RFC3339, field(rec, "LastModifiedDate")); err != nil {
+			return nil, fmt.Errorf("key %s: LastModifiedDate: %w", key, err)
+		}
+		objs = append(objs, o)
+	}
+}
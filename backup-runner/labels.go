@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backup labels are free-form key/value pairs (team, env, ...) attached to a
+// backup's metric series, log lines and notifications. Every label name adds
+// a dimension to every per-backup series, so names must be declared up front
+// in the top-level labels list; values are whatever the backups set.
+
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels can't be used as backup labels: they are the exporter's own
+// label names, or ones Prometheus attaches to every scraped series.
+var reservedLabels = map[string]bool{"job": true, "instance": true, "le": true, "quantile": true}
+
+func init() {
+	for _, m := range registry {
+		for _, l := range m.labels {
+			reservedLabels[l] = true
+		}
+	}
+}
+
+var (
+	labelsMu    sync.RWMutex
+	labelNames  []string
+	labelValues = map[string]map[string]string{}
+)
+
+// validateLabels checks the declared label names and every backup's labels.
+func validateLabels(names []string, backups []Backup) []error {
+	var errs []error
+	declared := map[string]bool{}
+	for _, n := range names {
+		switch {
+		case !labelNamePattern.MatchString(n) || strings.HasPrefix(n, "__"):
+			errs = append(errs, fmt.Errorf("labels: %q is not a valid label name", n))
+		case reservedLabels[n]:
+			errs = append(errs, fmt.Errorf("labels: %q collides with a built-in label", n))
+		}
+		declared[n] = true
+	}
+	for _, b := range backups {
+		for k := range b.Labels {
+			if !declared[k] {
+				errs = append(errs, fmt.Errorf("backup %q: label %q is not in the top-level labels list", b.Name, k))
+			}
+		}
+	}
+	return errs
+}
+
+// setLabels installs the label names and per-backup values from a validated
+// config. Series already recorded under a previous label set stay as they
+// were until the process restarts.
+func setLabels(names []string, backups []Backup) {
+	values := map[string]map[string]string{}
+	for _, b := range backups {
+		values[b.Name] = b.Labels
+	}
+	labelsMu.Lock()
+	labelNames, labelValues = names, values
+	labelsMu.Unlock()
+}
+
+// backupLabels returns the labels of the named backup.
+func backupLabels(name string) map[string]string {
+	labelsMu.RLock()
+	defer labelsMu.RUnlock()
+	return labelValues[name]
+}
+
+// metricLabelPairs renders the configured labels of a backup for a series
+// key. Unset labels are rendered empty so every series has the same names.
+func metricLabelPairs(name string) []string {
+	labelsMu.RLock()
+	defer labelsMu.RUnlock()
+	pairs := make([]string, len(labelNames))
+	for i, n := range labelNames {
+		pairs[i] = n + `="` + escapeLabel(labelValues[name][n]) + `"`
+	}
+	return pairs
+}
+
+// labelSuffix formats a backup's labels for a log line, e.g. " [env=prod team=db]".
+func labelSuffix(name string) string {
+	l := backupLabels(name)
+	if len(l) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(l))
+	for k, v := range l {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return " [" + strings.Join(parts, " ") + "]"
+}
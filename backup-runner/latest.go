@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+   Latest pointer. With latestPointer: true every successful run ends by
+   writing latest.json next to its dumps: a small document naming the newest
+   dump's key, size, checksum and time. Tooling finds the newest dump with a
+   single GET instead of listing the prefix, and without a full-size copy of
+   it. The pointer is replaced in one PUT, so a reader sees either the old or
+   the new one, never a mix. Schema-only and data-only dumps get their own
+   latest-schema.json and latest-data.json. Retention never deletes the
+   pointer; if it prunes the dump the pointer names (a newer upload from a
+   run that failed later can make it so), the pointer is moved to the newest
+   dump that is kept.
+*/
+
+type latestPointer struct {
+	Backup    string    `json:"backup"`
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// latestKey is the pointer's key for b's dumps under basePrefix.
+func latestKey(b Backup, basePrefix string) string {
+	name := "latest"
+	switch {
+	case b.SchemaOnly:
+		name += "-schema"
+	case b.DataOnly:
+		name += "-data"
+	}
+	return basePrefix + name + ".json"
+}
+
+// newLatest describes the dump just uploaded from out as key.
+func newLatest(b Backup, key, out string) (latestPointer, error) {
+	st, err := os.Stat(out)
+	if err != nil {
+		return latestPointer{}, err
+	}
+	sum, err := fileSHA256(out)
+	if err != nil {
+		return latestPointer{}, err
+	}
+	created, _ := dumpTime(key, b.dumpPrefix())
+	return latestPointer{Backup: b.Name, Key: key, Size: st.Size(), SHA256: sum, CreatedAt: created}, nil
+}
+
+func putLatest(ctx context.Context, dest Destination, key string, p latestPointer) error {
+	body, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp("", "pg-backup-latest-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return storageOp(ctx, dest, "upload "+key, 0, func(ctx context.Context) error {
+		return dest.store().put(ctx, key, f.Name())
+	})
+}
+
+// readLatest fetches the pointer at key; ok is false if there is none.
+func readLatest(ctx context.Context, dest Destination, key string) (p latestPointer, ok bool, err error) {
+	err = storageOp(ctx, dest, "head "+key, pruneTimeout, func(ctx context.Context) error {
+		var err error
+		ok, err = dest.store().exists(ctx, key)
+		return err
+	})
+	if err != nil || !ok {
+		return p, false, err
+	}
+	f, err := os.CreateTemp("", "pg-backup-latest-*.json")
+	if err != nil {
+		return p, false, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	err = storageOp(ctx, dest, "download "+key, pruneTimeout, func(ctx context.Context) error {
+		return dest.store().get(ctx, key, f.Name())
+	})
+	if err != nil {
+		return p, false, err
+	}
+	body, err := os.ReadFile(f.Name())
+	if err != nil {
+		return p, false, err
+	}
+	return p, true, json.Unmarshal(body, &p)
+}
+
+// repointLatest moves b's pointer to kept, the newest remaining dump, if
+// prune just deleted the dump it named.
+func repointLatest(ctx context.Context, b Backup, dest Destination, basePrefix string, deleted []string, kept s3Object) {
+	key := latestKey(b, basePrefix)
+	p, ok, err := readLatest(ctx, dest, key)
+	if err != nil {
+		log.Printf("[prune] WARNING: %s: reading %s failed, it may point at a pruned dump: %v", b.Name, key, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	for _, k := range deleted {
+		if k != p.Key {
+			continue
+		}
+		created, found := dumpTime(kept.Key, b.dumpPrefix())
+		if !found {
+			created = kept.LastModified
+		}
+		np := latestPointer{Backup: b.Name, Key: kept.Key, Size: kept.Size, CreatedAt: created}
+		if err := putLatest(ctx, dest, key, np); err != nil {
+			log.Printf("[prune] WARNING: %s: %s points at pruned %s and moving it failed: %v", b.Name, key, p.Key, err)
+			return
+		}
+		log.Printf("[prune] %s: %s pointed at pruned %s, now %s", b.Name, key, p.Key, kept.Key)
+		return
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+   Dump layers. What is stored can be a dump wrapped in outer layers:
+   compression (gzip, zstd) and encryption (age), nested in any order, e.g.
+   pgdump-<ts>.dump.gz.age. unwrapDump peels them off by looking at the
+   content rather than the name, so an oddly named or layered file still
+   restores, and reports what is left: a custom-format archive or a tar
+   archive for pg_restore, or plain SQL for psql. Custom-format dumps are
+   compressed internally, which pg_restore handles; that is not a layer.
+*/
+
+// Layers and inner dump formats sniffLayer tells apart.
+const (
+	layerGzip   = "gzip"
+	layerZstd   = "zstd"
+	layerAge    = "age"
+	dumpCustom  = "custom"
+	dumpTar     = "tar"
+	dumpSQL     = "sql"
+	maxDumpWrap = 8
+)
+
+var layerExts = map[string]string{layerGzip: ".gz", layerZstd: ".zst", layerAge: ".age"}
+
+// sniffLayer identifies the outermost layer of file from its first bytes.
+func sniffLayer(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return layerGzip, nil
+	case bytes.HasPrefix(head, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return layerZstd, nil
+	case bytes.HasPrefix(head, []byte("age-encryption.org/")),
+		bytes.HasPrefix(head, []byte("-----BEGIN AGE ENCRYPTED FILE-----")):
+		return layerAge, nil
+	case bytes.HasPrefix(head, []byte("PGDMP")):
+		return dumpCustom, nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return dumpTar, nil
+	}
+	return dumpSQL, nil
+}
+
+// unwrapDump strips every outer layer of file, writing each step next to
+// it, and returns the inner dump and its format. ageIdentity is the age
+// identity file for encrypted dumps.
+func unwrapDump(file, ageIdentity string) (string, string, error) {
+	for range maxDumpWrap {
+		layer, err := sniffLayer(file)
+		if err != nil {
+			return "", "", err
+		}
+		if _, ok := layerExts[layer]; !ok {
+			return file, layer, nil
+		}
+		if file, err = unwrapLayer(file, layer, ageIdentity); err != nil {
+			return "", "", err
+		}
+	}
+	return "", "", fmt.Errorf("%s: more than %d layers of compression or encryption", file, maxDumpWrap)
+}
+
+// unwrapLayer strips the outer layer of file, which is layer, and returns
+// the file it wrote next to it.
+func unwrapLayer(file, layer, ageIdentity string) (string, error) {
+	out := strings.TrimSuffix(file, layerExts[layer])
+	if out == file {
+		out = file + ".unwrapped"
+	}
+	var err error
+	switch layer {
+	case layerGzip:
+		err = gunzipFile(file, out)
+	case layerZstd:
+		err = runCaptured(exec.Command("zstd", "-q", "-d", "-f", "-o", out, file), nil)
+	case layerAge:
+		if ageIdentity == "" {
+			return "", fmt.Errorf("%s is age-encrypted; pass --age-identity", file)
+		}
+		err = runCaptured(exec.Command("age", "--decrypt", "-i", ageIdentity, "-o", out, file), nil)
+	default:
+		err = fmt.Errorf("unknown layer")
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", layer, err)
+	}
+	return out, nil
+}
+
+// gunzipFile decompresses path into out.
+func gunzipFile(path, out string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	zr, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, zr); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
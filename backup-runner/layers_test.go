@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Inner dumps as pg_dump writes them, cut down to what sniffLayer looks at.
+func innerDumps(t *testing.T) map[string][]byte {
+	t.Helper()
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	body := []byte("-- data\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "toc.dat", Mode: 0o600, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(body)
+	tw.Close()
+	return map[string][]byte{
+		dumpCustom: append([]byte("PGDMP\x01\x0e\x00\x04\x08\x01\x01"), bytes.Repeat([]byte{0x78, 0x9c, 0x01}, 200)...),
+		dumpSQL:    []byte(strings.Repeat("--\n-- PostgreSQL database dump\n--\nSET statement_timeout = 0;\n", 20)),
+		dumpTar:    tarball.Bytes(),
+	}
+}
+
+// wrap applies layer to file, the way a backup run stores it, and returns
+// the new file.
+func wrap(t *testing.T, file, layer, recipient string) string {
+	t.Helper()
+	out := file + layerExts[layer]
+	switch layer {
+	case layerGzip:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		if err := os.WriteFile(out, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	case layerZstd:
+		if err := exec.Command("zstd", "-q", "-f", "-o", out, file).Run(); err != nil {
+			t.Fatal(err)
+		}
+	case layerAge:
+		if err := exec.Command("age", "-r", recipient, "-o", out, file).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out
+}
+
+// layerOrders returns every order of every subset of layers.
+func layerOrders(layers []string) [][]string {
+	orders := [][]string{nil}
+	for i, l := range layers {
+		rest := append(append([]string{}, layers[:i]...), layers[i+1:]...)
+		for _, o := range layerOrders(rest) {
+			orders = append(orders, append([]string{l}, o...))
+		}
+	}
+	return orders
+}
+
+func TestUnwrapDumpLayers(t *testing.T) {
+	layers := []string{layerGzip}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		layers = append(layers, layerZstd)
+	} else {
+		t.Log("zstd not installed, not testing zstd layers")
+	}
+	var identity, recipient string
+	if _, err := exec.LookPath("age-keygen"); err == nil {
+		identity = filepath.Join(t.TempDir(), "key.txt")
+		if err := exec.Command("age-keygen", "-o", identity).Run(); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command("age-keygen", "-y", identity).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipient = strings.TrimSpace(string(out))
+		layers = append(layers, layerAge)
+	} else {
+		t.Log("age not installed, not testing age layers")
+	}
+
+	seen := map[string]bool{}
+	for format, data := range innerDumps(t) {
+		for _, order := range layerOrders(layers) {
+			key := format + "/" + strings.Join(order, "+")
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			t.Run(key, func(t *testing.T) {
+				file := filepath.Join(t.TempDir(), "pgdump-20240101T020000Z.dump")
+				if err := os.WriteFile(file, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				for _, l := range order {
+					file = wrap(t, file, l, recipient)
+				}
+				if len(order) > 0 {
+					if got, _ := sniffLayer(file); got != order[len(order)-1] {
+						t.Errorf("outer layer %s, want %s", got, order[len(order)-1])
+					}
+				}
+				inner, got, err := unwrapDump(file, identity)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != format {
+					t.Errorf("format %s, want %s", got, format)
+				}
+				if b, err := os.ReadFile(inner); err != nil || !bytes.Equal(b, data) {
+					t.Errorf("inner dump differs from the original (%v)", err)
+				}
+			})
+		}
+	}
+}
+
+// A misleading name doesn't matter; the content decides.
+func TestUnwrapDumpIgnoresName(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "pgdump-20240101T020000Z.dump")
+	if err := os.WriteFile(file, innerDumps(t)[dumpCustom], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	gz := wrap(t, file, layerGzip, "")
+	renamed := filepath.Join(dir, "pgdump-20240101T020000Z.dump.zst")
+	if err := os.Rename(gz, renamed); err != nil {
+		t.Fatal(err)
+	}
+	if _, format, err := unwrapDump(renamed, ""); err != nil || format != dumpCustom {
+		t.Errorf("unwrapDump = %s, %v, want %s", format, err, dumpCustom)
+	}
+}
+
+func TestUnwrapDumpTruncated(t *testing.T) {
+	tools := []string{layerGzip}
+	if _, err := exec.LookPath("zstd"); err == nil {
+		tools = append(tools, layerZstd)
+	}
+	for _, layer := range tools {
+		t.Run(layer, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "pgdump-20240101T020000Z.dump")
+			// Incompressible, so the wrapped file is big enough to cut.
+			data := make([]byte, 64<<10)
+			rand.New(rand.NewSource(1)).Read(data)
+			if err := os.WriteFile(file, append([]byte("PGDMP"), data...), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			wrapped := wrap(t, file, layer, "")
+			st, err := os.Stat(wrapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Truncate(wrapped, st.Size()/2); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := unwrapDump(wrapped, ""); err == nil {
+				t.Error("truncated dump unwrapped without an error")
+			}
+		})
+	}
+}
+
+func TestUnwrapDumpAgeNeedsIdentity(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "pgdump-20240101T020000Z.dump.age")
+	if err := os.WriteFile(file, []byte("age-encryption.org/v1\n-> X25519 abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := unwrapDump(file, ""); err == nil || !strings.Contains(err.Error(), "--age-identity") {
+		t.Errorf("unwrapDump without identity: %v", err)
+	}
+}
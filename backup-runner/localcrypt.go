@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+/*
+   Local copy encryption. The copy kept in /backups is the uploaded object
+   as it is, which on a shared or backed-up volume may be more exposed than
+   the bucket. With localEncryption, the local copy is encrypted with age to
+   the configured recipients instead (pgdump-<ts>.dump.gz.age), whatever is
+   uploaded. Only the public recipients are in the config; the identity
+   that decrypts stays wherever restores are done. The encrypted copy is
+   written under a temporary name and renamed, so /backups never holds a
+   partial one.
+*/
+
+type LocalEncryption struct {
+	// Recipients are age recipients: age1... public keys or SSH public
+	// keys.
+	Recipients []string `yaml:"recipients"`
+	// RecipientsFile holds further recipients, one per line.
+	RecipientsFile string `yaml:"recipientsFile"`
+}
+
+func (e LocalEncryption) enabled() bool {
+	return len(e.Recipients) > 0 || e.RecipientsFile != ""
+}
+
+func (e LocalEncryption) validate() error {
+	if !e.enabled() {
+		return nil
+	}
+	for _, r := range e.Recipients {
+		if strings.TrimSpace(r) == "" {
+			return errors.New("localEncryption: empty recipient")
+		}
+	}
+	if e.RecipientsFile != "" {
+		if _, err := os.Stat(e.RecipientsFile); err != nil {
+			return fmt.Errorf("localEncryption.recipientsFile: %w", err)
+		}
+	}
+	if _, err := exec.LookPath("age"); err != nil {
+		return fmt.Errorf("localEncryption: %w", err)
+	}
+	return nil
+}
+
+// keepEncryptedCopy encrypts out into localCopyDir. The caller removes
+// out.
+func keepEncryptedCopy(ctx context.Context, e LocalEncryption, out string) error {
+	dst := filepath.Join(localCopyDir, filepath.Base(out)+layerExts[layerAge])
+	tmp := dst + ".partial"
+	args := []string{"--encrypt", "-o", tmp}
+	for _, r := range e.Recipients {
+		args = append(args, "-r", r)
+	}
+	if e.RecipientsFile != "" {
+		args = append(args, "-R", e.RecipientsFile)
+	}
+	if err := runCaptured(runCommand(ctx, "age", append(args, out)...), nil); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("age: %w", err)
+	}
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
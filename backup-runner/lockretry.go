@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+   Lock timeouts. pg_dump takes an ACCESS SHARE lock on every table it dumps
+   and otherwise waits behind concurrent DDL indefinitely. With
+   lockWaitTimeout set it gives up after that long instead
+   (--lock-wait-timeout), and the dump is retried up to lockRetries times,
+   since the DDL is usually over by then. Only lock timeouts are retried;
+   any other pg_dump failure fails the run as before.
+*/
+
+const (
+	defaultLockRetries = 2
+	lockRetryDelay     = 30 * time.Second
+)
+
+func (b Backup) lockRetries() int {
+	if b.LockWaitTimeout <= 0 {
+		return 0
+	}
+	if b.LockRetries == 0 {
+		return defaultLockRetries
+	}
+	return max(b.LockRetries, 0)
+}
+
+// isLockTimeout reports whether a failed dump gave up waiting for a lock.
+func isLockTimeout(err error) bool {
+	var ce *cmdError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	for _, line := range ce.stderr {
+		if strings.Contains(line, "lock timeout") || strings.Contains(line, "could not obtain lock") {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpRetryingLocks runs dump, retrying it while it fails on lock timeouts.
+func dumpRetryingLocks(ctx context.Context, b Backup, ws string, dump func(context.Context, Backup, string) (string, error)) (string, error) {
+	delay := lockRetryDelay
+	for attempt := 1; ; attempt++ {
+		out, err := dump(ctx, b, ws)
+		if err == nil || attempt > b.lockRetries() || !isLockTimeout(err) || ctx.Err() != nil {
+			return out, err
+		}
+		os.Remove(out)
+		log.Printf("[backup] %s: pg_dump timed out waiting for a lock after %s (attempt %d/%d), retrying in %s: %v",
+			b.Name, b.LockWaitTimeout, attempt, b.lockRetries()+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
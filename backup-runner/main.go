@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -18,22 +25,455 @@ import (
 type Config struct {
 	Destinations map[string]Destination `yaml:"destinations"`
 	Backups      []Backup               `yaml:"backups"`
+	Notify       Notify                 `yaml:"notify"`
+	// PgRestorePath and PsqlPath are the client binaries the restore
+	// subcommand uses unless overridden by its flags. Default: PATH lookup.
+	PgRestorePath string `yaml:"pgRestorePath"`
+	PsqlPath      string `yaml:"psqlPath"`
+	// Labels declares the label names backups may set; see labels.go.
+	Labels []string `yaml:"labels"`
+	// Workers caps how many backup runs execute at once (0: no limit).
+	// WhenBusy decides what a run does when all are busy: queue (default)
+	// or drop. See pool.go.
+	Workers  int    `yaml:"workers"`
+	WhenBusy string `yaml:"whenBusy"`
+	// Report writes finished runs to a JSON file; see report.go.
+	Report Report `yaml:"report"`
+	// Catalog inserts every finished run into a PostgreSQL table; see
+	// catalog.go.
+	Catalog Catalog `yaml:"catalog"`
+	// Events publishes run lifecycle events to Kafka or NATS; see
+	// events.go.
+	Events Events `yaml:"events"`
 }
 
 type Destination struct {
+	// Type is the storage backend: s3 (default), b2 or restic.
+	Type     string `yaml:"type"`
 	Bucket   string `yaml:"bucket"`
 	Prefix   string `yaml:"prefix"`
 	Endpoint string `yaml:"endpoint"`
 	Access   string `yaml:"accessKey"`
 	Secret   string `yaml:"secretKey"`
 	Region   string `yaml:"region"`
+	// OperationTimeout is a hard deadline for each storage operation attempt
+	// (upload, list, delete); the CLI process is killed when it expires.
+	OperationTimeout time.Duration `yaml:"operationTimeout"`
+	// ObjectLockMode (GOVERNANCE or COMPLIANCE) and ObjectLockRetention put
+	// an Object Lock retention on every uploaded object.
+	ObjectLockMode      string        `yaml:"objectLockMode"`
+	ObjectLockRetention time.Duration `yaml:"objectLockRetention"`
+	// ChecksumAlgorithm (SHA256, SHA1, CRC32 or CRC32C) makes S3 verify each
+	// upload's integrity and reject it if corrupted in transit.
+	ChecksumAlgorithm string `yaml:"checksumAlgorithm"`
+	// Repository and Password/PasswordFile configure type: restic.
+	Repository   string `yaml:"repository"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+	// ForcePathStyle addresses buckets as <endpoint>/<bucket> instead of
+	// <bucket>.<endpoint>, as MinIO and most self-hosted S3 servers need.
+	ForcePathStyle bool `yaml:"forcePathStyle"`
+	// UserAgent is appended to the pg-backup/<version> user agent of storage
+	// requests, so bucket owners can attribute traffic in access logs.
+	UserAgent string `yaml:"userAgent"`
+	// SessionToken goes with temporary (STS/SSO) access keys.
+	SessionToken string `yaml:"sessionToken"`
+	// Inventory locates the bucket's S3 Inventory reports, for backups
+	// with pruneSource: inventory; see inventory.go.
+	Inventory Inventory `yaml:"inventory"`
+	// VerifyUpload reads back each uploaded object's size before the run
+	// counts as successful and retention runs.
+	VerifyUpload bool `yaml:"verifyUpload"`
+	// Accelerate sends S3 requests through the bucket's Transfer
+	// Acceleration endpoint.
+	Accelerate bool `yaml:"accelerate"`
+	// ResumableUploads checkpoints multipart uploads to /backups so an
+	// interrupted upload is finished on the next start; see resumable.go.
+	ResumableUploads bool `yaml:"resumableUploads"`
+	// PartSize is the multipart part size of resumable uploads.
+	PartSize ByteSize `yaml:"partSize"`
+	// Breaker stops backing up to the destination for a while after
+	// repeated upload failures; see breaker.go.
+	Breaker Breaker `yaml:"breaker"`
+	// DeleteConcurrency is how many delete batches of 1000 keys a prune
+	// sends at once (default 1).
+	DeleteConcurrency int `yaml:"deleteConcurrency"`
+	// Globals dumps roles and tablespaces with every backup stored here,
+	// as if each had globals set.
+	Globals bool `yaml:"globals"`
+
+	// envCreds is set when the keys come from the environment, to be read
+	// again on rotation; see rotation.go.
+	envCreds bool
 }
 
 type Backup struct {
+	Name        string `yaml:"name"`
 	URL         string `yaml:"url"`
 	Destination string `yaml:"destination"`
 	Schedule    string `yaml:"schedule"`
 	MaxHistory  int    `yaml:"maxHistory"`
+	SchemaOnly  bool   `yaml:"schemaOnly"`
+	DataOnly    bool   `yaml:"dataOnly"`
+	// MaxDeletePerRun caps how many objects a single prune may delete.
+	// 0 uses defaultMaxDeletePerRun, a negative value disables the cap.
+	MaxDeletePerRun int `yaml:"maxDeletePerRun"`
+	// MaxDbSize skips (or, with MaxDbSizeAction "warn", just reports) a dump
+	// when pg_database_size() is above it.
+	MaxDbSize       ByteSize `yaml:"maxDbSize"`
+	MaxDbSizeAction string   `yaml:"maxDbSizeAction"`
+	WriteManifest   bool     `yaml:"writeManifest"`
+	// Interval is a simpler alternative to Schedule, e.g. "6h".
+	Interval   time.Duration `yaml:"interval"`
+	RunOnStart bool          `yaml:"runOnStart"`
+	// Compression wraps the dump in an external compressor: gzip, or pigz for
+	// multi-core gzip. pg_dump's own compression is turned off when set.
+	// zstd is done by pg_dump itself where it can; see resolveCompressor.
+	Compression        string `yaml:"compression"`
+	CompressionThreads int    `yaml:"compressionThreads"`
+	// HeartbeatURL is pinged after every successful run, and HeartbeatURL/fail
+	// after a failed one if HeartbeatOnFailure is set.
+	HeartbeatURL       string `yaml:"heartbeatUrl"`
+	HeartbeatOnFailure bool   `yaml:"heartbeatOnFailure"`
+	// KeyCollision decides what happens when the key for a run already exists
+	// (two runs in the same second): overwrite (default), suffix, or fail.
+	KeyCollision string `yaml:"keyCollision"`
+	// PgDumpPath and PsqlPath select client binaries matching the server's
+	// major version when several are installed. Default: PATH lookup.
+	PgDumpPath string `yaml:"pgDumpPath"`
+	PsqlPath   string `yaml:"psqlPath"`
+	// Schedules replaces Schedule/Interval with several schedules for the
+	// same database, each optionally with its own dump mode and retention.
+	Schedules []ScheduleEntry `yaml:"schedules"`
+	// Labels are attached to this backup's metrics, logs and notifications.
+	Labels map[string]string `yaml:"labels"`
+	// PruneByKeyTimestamp orders dumps for retention by the timestamp in
+	// their key rather than the object's LastModified.
+	PruneByKeyTimestamp bool `yaml:"pruneByKeyTimestamp"`
+	// Archive (monthly, weekly or yearly) keeps the first dump of each period
+	// forever under <prefix>/archive/<database>/; see archive.go.
+	Archive string `yaml:"archive"`
+	// PgpassFile is a libpq password file (PGPASSFILE) for connecting without
+	// a password in the URL. Default: libpq's own, ~/.pgpass.
+	PgpassFile string `yaml:"pgpassFile"`
+	// Precondition is a SQL query returning one boolean; when it returns
+	// false the run is skipped.
+	Precondition string `yaml:"precondition"`
+	// Discover backs up every database on the server instead of the one in
+	// URL, narrowed down by Include and Exclude glob patterns; Bundle packs
+	// them into one object per run. See discover.go and bundle.go.
+	Discover bool     `yaml:"discover"`
+	Include  []string `yaml:"include"`
+	Exclude  []string `yaml:"exclude"`
+	Bundle   bool     `yaml:"bundle"`
+	// MinDumpSize and MaxDumpSize fail a run before upload when the finished
+	// (compressed) dump is smaller or larger than expected.
+	MinDumpSize ByteSize `yaml:"minDumpSize"`
+	MaxDumpSize ByteSize `yaml:"maxDumpSize"`
+	// PostMaintenance runs a statement such as VACUUM ANALYZE after each
+	// successful run; see maintenance.go.
+	PostMaintenance *Maintenance `yaml:"postMaintenance"`
+	// PruneSource is where retention finds existing dumps: list (default),
+	// inventory, the destination's S3 Inventory reports, or partitions,
+	// listing only the recent dates; see partitions.go.
+	PruneSource string `yaml:"pruneSource"`
+	// ParallelUploads lets a discovery backup upload up to this many
+	// finished dumps while it dumps the next database. Dumps themselves
+	// always run one at a time. 0 runs everything serially.
+	ParallelUploads int `yaml:"parallelUploads"`
+	// StaleGrace is how many schedule intervals may pass without a success
+	// before pgbackup_backup_stale turns 1. Default 2.
+	StaleGrace float64 `yaml:"staleGrace"`
+	// Tier (e.g. hourly, daily, monthly) is inserted into the key path as
+	// <prefix>/<tier>/<database>/, so S3 lifecycle rules can expire each
+	// tier differently. Retention applies per tier.
+	Tier string `yaml:"tier"`
+	// PgDumpImage runs pg_dump in a container of this image instead of a
+	// local binary; see container.go.
+	PgDumpImage string `yaml:"pgDumpImage"`
+	// Prefix is appended to the destination's prefix, so several backups
+	// can keep their dumps apart on one destination.
+	Prefix string `yaml:"prefix"`
+	// FailOnStderr and TolerateStderr are regular expressions matched
+	// against pg_dump's stderr lines; see dumpstderr.go.
+	FailOnStderr   []string `yaml:"failOnStderr"`
+	TolerateStderr []string `yaml:"tolerateStderr"`
+	// LockWaitTimeout bounds how long pg_dump waits for a table lock;
+	// LockRetries is how often a dump that timed out is retried. See
+	// lockretry.go.
+	LockWaitTimeout time.Duration `yaml:"lockWaitTimeout"`
+	LockRetries     int           `yaml:"lockRetries"`
+	// LatestPointer keeps a latest.json naming the newest dump next to the
+	// dumps; see latest.go.
+	LatestPointer bool `yaml:"latestPointer"`
+	// Stream pipes pg_dump through the compressor ("compress") and on into
+	// the upload ("upload") instead of running them one after the other;
+	// see stream.go.
+	Stream string `yaml:"stream"`
+	// KeepPerDay keeps the newest N dumps of each day and MaxAge drops
+	// dumps older than it; both combine with MaxHistory. See retention.go.
+	KeepPerDay int           `yaml:"keepPerDay"`
+	MaxAge     time.Duration `yaml:"maxAge"`
+	// Globals also stores pg_dumpall --globals-only (roles, grants,
+	// tablespaces) with each run, keeping GlobalsMaxHistory of them
+	// (default: maxHistory). See globals.go.
+	Globals           bool `yaml:"globals"`
+	GlobalsMaxHistory int  `yaml:"globalsMaxHistory"`
+	// CompressMinSize uploads dumps smaller than this uncompressed; only
+	// larger ones go through Compression.
+	CompressMinSize ByteSize `yaml:"compressMinSize"`
+	// VerboseProgress runs pg_dump --verbose and counts the tables it has
+	// dumped; see verbose.go.
+	VerboseProgress bool `yaml:"verboseProgress"`
+	// Fanout uploads each dump to these destinations too; FanoutPolicy
+	// (all, any or quorum) decides when that counts as success and
+	// FanoutPrune (succeeded, all or never) where retention runs. See
+	// fanout.go.
+	Fanout       []string `yaml:"fanout"`
+	FanoutPolicy string   `yaml:"fanoutPolicy"`
+	FanoutPrune  string   `yaml:"fanoutPrune"`
+
+	// MinFreeSpace skips a dump when the work directory has less free
+	// space than this (default 256MiB), or than the previous run needed;
+	// see freespace.go.
+	MinFreeSpace ByteSize `yaml:"minFreeSpace"`
+	// CompressionLevel is the compressor's level, 1-9 for gzip and pigz or
+	// 1-19 for zstd (default: the compressor's own).
+	CompressionLevel int `yaml:"compressionLevel"`
+	// SuppressAlertsDuring lists maintenance windows in which failure
+	// notifications are only logged; see suppress.go.
+	SuppressAlertsDuring []SuppressWindow `yaml:"suppressAlertsDuring"`
+	// Description is recorded in the manifest for whoever picks a dump to
+	// restore, e.g. "production orders DB". With DatabaseComment the
+	// database's COMMENT ON DATABASE is recorded too.
+	Description     string `yaml:"description"`
+	DatabaseComment bool   `yaml:"databaseComment"`
+	// SanitizeKeys encodes the database segment of keys so that only
+	// lowercase letters, digits, _ and - appear in it; see sanitize.go.
+	SanitizeKeys bool `yaml:"sanitizeKeys"`
+	// Rules override settings for the discovered databases they match;
+	// see discover.go.
+	Rules []DatabaseRule `yaml:"rules"`
+	// ExcludeTableData are pg_dump table patterns whose rows are left out
+	// of the dump; their definitions are still dumped. Their data can't be
+	// restored from these backups.
+	ExcludeTableData []string `yaml:"excludeTableData"`
+	// VersionMismatch is what a pg_dump older than the server's major
+	// version does to a run: warn (default), fail or ignore; see
+	// pgversion.go.
+	VersionMismatch string `yaml:"versionMismatch"`
+	// SkipTest leaves the backup out of `test` runs over all backups.
+	// It only affects the test subcommand: the daemon runs no preflight
+	// and schedules the backup as usual. See testcmd.go.
+	SkipTest bool `yaml:"skipTest"`
+	// ReplicateTo copies each uploaded dump server-side to this
+	// destination too; see replicate.go.
+	ReplicateTo string `yaml:"replicateTo"`
+	// AllowEmpty accepts a dump below MinDumpSize when the database has no
+	// user tables, so an empty database isn't mistaken for a broken dump.
+	AllowEmpty bool `yaml:"allowEmpty"`
+	// Priority orders startup runs and `run`: higher first, config order
+	// among equal priorities (default 0).
+	Priority int `yaml:"priority"`
+	// LocalEncryption encrypts the copy kept in /backups with age; see
+	// localcrypt.go.
+	LocalEncryption LocalEncryption `yaml:"localEncryption"`
+	// CatchUpOnStart runs the backup at startup if a scheduled run was
+	// missed while the daemon was down; see catchup.go.
+	CatchUpOnStart bool `yaml:"catchUpOnStart"`
+	// CompressionAutoTune adjusts the compression level between runs to
+	// fit a time window; see autotune.go.
+	CompressionAutoTune AutoTune `yaml:"compressionAutoTune"`
+	// Parts dumps subsets of the database from one shared snapshot; see
+	// snapshot.go.
+	Parts []DumpPart `yaml:"parts"`
+	// SkipUnchanged skips runs while the server's WAL position is the one
+	// recorded with the newest dump; see walpos.go.
+	SkipUnchanged bool `yaml:"skipUnchanged"`
+
+	fanoutTo []fanoutTarget
+	replica  *fanoutTarget
+	// part names the part this is the backup of, partArgs select its
+	// subset, snapshot is the snapshot it is dumped from and partNames are
+	// all the parts dumped from it.
+	part, snapshot string
+	partArgs       []string
+	partNames      []string
+	// pgDumpCompress is pg_dump's -Z when compression happens inside the
+	// custom format instead of in an external compressor.
+	pgDumpCompress string
+}
+
+// ScheduleEntry is one item of a backup's schedules list. Written as a plain
+// string it is just a cron spec; as a mapping it can also override the dump
+// mode, compression and retention for runs on that schedule.
+type ScheduleEntry struct {
+	Name        string         `yaml:"name"`
+	Schedule    string         `yaml:"schedule"`
+	Interval    time.Duration  `yaml:"interval"`
+	SchemaOnly  *bool          `yaml:"schemaOnly"`
+	DataOnly    *bool          `yaml:"dataOnly"`
+	Compression *string        `yaml:"compression"`
+	MaxHistory  *int           `yaml:"maxHistory"`
+	Tier        *string        `yaml:"tier"`
+	KeepPerDay  *int           `yaml:"keepPerDay"`
+	MaxAge      *time.Duration `yaml:"maxAge"`
+}
+
+func (e *ScheduleEntry) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		e.Schedule = n.Value
+		return nil
+	}
+	type plain ScheduleEntry
+	return n.Decode((*plain)(e))
+}
+
+// expand turns a backup with a schedules list into one backup per entry,
+// each named <name>-<n> unless the entry names itself. Dumps of every entry
+// share the database's key prefix; entries with different dump modes are
+// kept and pruned apart by their file prefix.
+func (b Backup) expand() []Backup {
+	if len(b.Schedules) == 0 {
+		return []Backup{b}
+	}
+	out := make([]Backup, 0, len(b.Schedules))
+	for i, e := range b.Schedules {
+		c := b
+		c.Schedules = nil
+		c.Schedule, c.Interval = e.Schedule, e.Interval
+		c.Name = e.Name
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%s-%d", b.Name, i+1)
+		}
+		if e.SchemaOnly != nil {
+			c.SchemaOnly = *e.SchemaOnly
+		}
+		if e.DataOnly != nil {
+			c.DataOnly = *e.DataOnly
+		}
+		if e.Compression != nil {
+			c.Compression = *e.Compression
+		}
+		if e.MaxHistory != nil {
+			c.MaxHistory = *e.MaxHistory
+		}
+		if e.Tier != nil {
+			c.Tier = *e.Tier
+		}
+		if e.KeepPerDay != nil {
+			c.KeepPerDay = *e.KeepPerDay
+		}
+		if e.MaxAge != nil {
+			c.MaxAge = *e.MaxAge
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+const defaultMaxDeletePerRun = 50
+
+// Storage operations are retried; pruneTimeout is the default deadline for the
+// list/delete calls of a prune when the destination sets no operationTimeout,
+// since pruning runs after a successful upload and mustn't hold up the job.
+const (
+	storageAttempts = 3
+	pruneTimeout    = 2 * time.Minute
+)
+
+// storageBackoff is the delay before the first retry; tests shorten it.
+var storageBackoff = 5 * time.Second
+
+// cpArgs returns the extra `aws s3 cp` flags this destination needs.
+func (d Destination) cpArgs() []string {
+	var args []string
+	if d.ChecksumAlgorithm != "" {
+		args = append(args, "--checksum-algorithm", d.ChecksumAlgorithm)
+	}
+	return args
+}
+
+// opContext bounds one storage operation by the destination's
+// OperationTimeout, or by fallback if unset (0 means no deadline).
+func (d Destination) opContext(ctx context.Context, fallback time.Duration) (context.Context, context.CancelFunc) {
+	timeout := d.OperationTimeout
+	if timeout <= 0 {
+		timeout = fallback
+	}
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// storageOp runs op with a fresh deadline per attempt and retries it, so an
+// attempt that timed out is retried like any other failure. Cancelling ctx
+// stops it.
+func storageOp(ctx context.Context, d Destination, what string, fallback time.Duration, op func(ctx context.Context) error) error {
+	return retry(ctx, what, storageAttempts, storageBackoff, func() error {
+		ctx, cancel := d.opContext(ctx, fallback)
+		defer cancel()
+		err := op(ctx)
+		if err != nil && authFailure(err) && reloadCredentials(d) {
+			err = op(ctx)
+		}
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out: %w", err)
+		}
+		return err
+	})
+}
+
+func (b Backup) deleteCap() int {
+	if b.MaxDeletePerRun == 0 {
+		return defaultMaxDeletePerRun
+	}
+	return b.MaxDeletePerRun
+}
+
+const tsLayout = "20060102T150405Z"
+
+// dumpPrefix returns the object name prefix for this backup's dumps. Schema-only
+// and data-only dumps get their own prefix so they never collide with, or get
+// pruned against, full dumps stored under the same database prefix.
+func (b Backup) dumpPrefix() string {
+	prefix := "pgdump-"
+	if b.Bundle {
+		prefix = "pgbundle-"
+	}
+	switch {
+	case b.SchemaOnly:
+		return prefix + "schema-"
+	case b.DataOnly:
+		return prefix + "data-"
+	}
+	return prefix
+}
+
+// dumpTime parses the timestamp out of a dump key written with the given name
+// prefix, i.e. <namePrefix><timestamp>[-N] followed by one of dumpExts. The
+// optional -N is added by the "suffix" key collision strategy.
+func dumpTime(key, namePrefix string) (time.Time, bool) {
+	name, ok := trimDumpExt(filepath.Base(key))
+	if !ok || !strings.HasPrefix(name, namePrefix) {
+		return time.Time{}, false
+	}
+	ts := strings.TrimPrefix(name, namePrefix)
+	if i := strings.IndexByte(ts, '-'); i >= 0 {
+		if _, err := strconv.Atoi(ts[i+1:]); err != nil {
+			return time.Time{}, false
+		}
+		ts = ts[:i]
+	}
+	t, err := time.Parse(tsLayout, ts)
+	return t, err == nil
+}
+
+// isDumpKey reports whether key is a dump written with the given name prefix.
+func isDumpKey(key, namePrefix string) bool {
+	_, ok := dumpTime(key, namePrefix)
+	return ok
 }
 
 type s3Object struct {
@@ -92,13 +532,65 @@ func expandAllEnv(s string) string {
 	})
 }
 
+// strictEnvPattern is envPattern plus "$$", which strict mode turns into a
+// literal "$".
+var strictEnvPattern = regexp.MustCompile(`\$\$|` + envPattern.String())
+
+// expandEnvStrict is the ENV_ALLOWLIST mode of expandAllEnv: only variables
+// matching allow (exact names, or prefixes ending in "*") are expanded, any
+// other reference is left verbatim, "$$" escapes a literal "$", and an
+// allowed variable that is unset and has no default is an error rather than
+// an empty string.
+func expandEnvStrict(s string, allow []string) (string, error) {
+	allowed := func(name string) bool {
+		for _, a := range allow {
+			if a == name || (strings.HasSuffix(a, "*") && strings.HasPrefix(name, strings.TrimSuffix(a, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+	var missing []string
+	out := strictEnvPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := envPattern.FindStringSubmatch(m)
+		name, braced := sub[1], true
+		if name == "" {
+			name, braced = sub[4], false
+		}
+		if !allowed(name) {
+			return m
+		}
+		if val, ok := os.LookupEnv(name); ok && (val != "" || sub[2] != "-") {
+			return val
+		}
+		if braced && strings.Contains(m, ":") {
+			return sub[3]
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
 func fillDestFromEnv(d *Destination) {
 	// Values are already expanded; these are fallbacks if still empty.
+	env := readEnvCredentials()
+	d.envCreds = d.Access == "" && d.Secret == "" && d.SessionToken == "" && env.access != ""
 	if d.Access == "" {
-		d.Access = os.Getenv("AWS_ACCESS_KEY_ID")
+		d.Access = env.access
+		// A session token only belongs with the key it was issued for.
+		if d.SessionToken == "" {
+			d.SessionToken = env.token
+		}
 	}
 	if d.Secret == "" {
-		d.Secret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		d.Secret = env.secret
 	}
 	if d.Region == "" {
 		d.Region = os.Getenv("AWS_DEFAULT_REGION")
@@ -108,64 +600,421 @@ func fillDestFromEnv(d *Destination) {
 	}
 }
 
-func runPgDump(url string) (string, error) {
-	ts := time.Now().UTC().Format("20060102T150405Z")
-	out := filepath.Join("/tmp", "pgdump-"+ts+".dump")
-	cmd := exec.Command("pg_dump", "-Fc", url, "-f", out)
-	cmd.Env = append(os.Environ(), "PGCONNECT_TIMEOUT=10")
+// runPgDump dumps the backup's database into a new file in dir.
+func runPgDump(ctx context.Context, b Backup, dir string) (string, error) {
+	ts := time.Now().UTC().Format(tsLayout)
+	// A unique name keeps the dumps of a bundle, which share a workspace,
+	// apart.
+	f, err := os.CreateTemp(dir, b.dumpPrefix()+ts+"-*.dump")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	out := f.Name()
+	cmd, err := pgDumpCommand(ctx, b, dir, append(pgDumpArgs(b), "-f", out))
+	if err != nil {
+		os.Remove(out)
+		return "", err
+	}
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return out, cmd.Run()
+	tail, rules := dumpStderr(ctx, b)
+	stop := watchProgress(b.Name, out)
+	defer stop()
+	return out, rules.judge(b, runCaptured(cmd, tail))
+}
+
+// pgDumpArgs are the pg_dump flags of b, without the output file.
+func pgDumpArgs(b Backup) []string {
+	args := []string{"-Fc"}
+	switch {
+	case b.Compression != "" || b.Bundle:
+		args = append(args, "-Z0")
+	case b.pgDumpCompress != "":
+		args = append(args, "-Z", b.pgDumpCompress)
+	}
+	if b.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	if b.DataOnly {
+		args = append(args, "--data-only")
+	}
+	if b.VerboseProgress {
+		args = append(args, "--verbose")
+	}
+	if b.LockWaitTimeout > 0 {
+		args = append(args, "--lock-wait-timeout="+strconv.FormatInt(b.LockWaitTimeout.Milliseconds(), 10))
+	}
+	for _, t := range b.ExcludeTableData {
+		args = append(args, "--exclude-table-data="+t)
+	}
+	if b.snapshot != "" {
+		args = append(args, "--snapshot="+b.snapshot)
+	}
+	return append(args, b.partArgs...)
 }
 
-func awsEnv(endpoint, region, access, secret string) []string {
+// pgDumpCommand builds the pg_dump invocation of b, local or in
+// pgDumpImage. dir is where it may write files.
+func pgDumpCommand(ctx context.Context, b Backup, dir string, args []string) (*exec.Cmd, error) {
+	env, err := pgEnv(b)
+	if err != nil {
+		return nil, err
+	}
+	if b.PgDumpImage != "" {
+		return containerPgDump(ctx, b, dir, args, env)
+	}
+	cmd := runCommand(ctx, binPath(b.PgDumpPath, "pg_dump"), args...)
+	cmd.Env = env
+	return cmd, nil
+}
+
+// dumpStderr returns the stderr capture of a pg_dump of b, published on
+// /status, and the rules judging it.
+func dumpStderr(ctx context.Context, b Backup) (*tailWriter, *stderrRules) {
+	tail := &tailWriter{}
+	if p := newDumpProgress(ctx, b); p != nil {
+		tail.skip = p.observe
+	}
+	rules := newStderrRules(b)
+	if rules != nil {
+		tail.onLine = rules.observe
+	}
+	setRunStderr(b.Name, tail)
+	return tail, rules
+}
+
+// pgEnv is the environment for the client tools run against a backup's
+// database. The connection itself is passed as PG* variables, never as an
+// argument; see pgconn.go.
+func pgEnv(b Backup) ([]string, error) {
+	conn, err := connEnv(b.URL)
+	if err != nil {
+		return nil, err
+	}
+	env := append(os.Environ(), "PGCONNECT_TIMEOUT=10")
+	env = append(env, conn...)
+	if b.PgpassFile != "" {
+		env = append(env, "PGPASSFILE="+b.PgpassFile)
+	}
+	return env, nil
+}
+
+// binPath returns the configured binary, or name to be looked up in PATH.
+func binPath(configured, name string) string {
+	if configured != "" {
+		return configured
+	}
+	return name
+}
+
+// psqlQuery runs a single query against the backup's database and returns its
+// trimmed, unaligned output.
+func psqlQuery(ctx context.Context, b Backup, query string) (string, error) {
+	env, err := pgEnv(b)
+	if err != nil {
+		return "", err
+	}
+	cmd := runCommand(ctx, binPath(b.PsqlPath, "psql"), "-X", "-A", "-t", "-c", query)
+	cmd.Env = env
+	out, err := outputCaptured(cmd)
+	return strings.TrimSpace(string(out)), err
+}
+
+func databaseSize(ctx context.Context, b Backup) (ByteSize, error) {
+	out, err := psqlQuery(ctx, b, "SELECT pg_database_size(current_database())")
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected pg_database_size output %q", out)
+	}
+	return ByteSize(n), nil
+}
+
+// checkPrecondition runs the backup's precondition query and reports whether
+// it returned true. A query that fails or doesn't return a boolean is an
+// error, not a reason to skip.
+func checkPrecondition(ctx context.Context, b Backup) (bool, error) {
+	if b.Precondition == "" {
+		return true, nil
+	}
+	out, err := psqlQuery(ctx, b, b.Precondition)
+	if err != nil {
+		return false, fmt.Errorf("precondition: %w", err)
+	}
+	switch strings.ToLower(out) {
+	case "t", "true", "1", "yes", "on":
+		return true, nil
+	case "f", "false", "0", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("precondition: expected a single boolean, got %q", out)
+}
+
+// userTablesQuery counts the tables outside the system schemas, which is
+// what tells an empty database from a broken dump.
+const userTablesQuery = `SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p') AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg\_toast%'`
+
+func userTableCount(ctx context.Context, b Backup) (int, error) {
+	out, err := psqlQuery(ctx, b, userTablesQuery)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(out)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected table count %q", out)
+	}
+	return n, nil
+}
+
+// checkDumpSize enforces MinDumpSize and MaxDumpSize on a finished dump,
+// notifying when one is violated. With AllowEmpty a dump below MinDumpSize
+// passes if the database has no user tables.
+func checkDumpSize(ctx context.Context, b Backup, size int64) error {
+	var event, msg string
+	switch {
+	case b.MaxDumpSize > 0 && ByteSize(size) > b.MaxDumpSize:
+		event, msg = "dump_size_exceeded", fmt.Sprintf("dump is %s, above maxDumpSize %s", ByteSize(size), b.MaxDumpSize)
+	case b.MinDumpSize > 0 && ByteSize(size) < b.MinDumpSize:
+		event, msg = "dump_too_small", fmt.Sprintf("dump is %s, below minDumpSize %s", ByteSize(size), b.MinDumpSize)
+		if b.AllowEmpty {
+			// A small dump is only a problem when there was something to
+			// dump.
+			n, err := userTableCount(ctx, b)
+			switch {
+			case err != nil:
+				msg += fmt.Sprintf(" (counting user tables for allowEmpty failed: %v)", err)
+			case n == 0:
+				log.Printf("[backup] %s: dump is %s, below minDumpSize %s, but the database has no user tables (allowEmpty)",
+					b.Name, ByteSize(size), b.MinDumpSize)
+				return nil
+			default:
+				msg += fmt.Sprintf(" although the database has %d user tables", n)
+			}
+		}
+	default:
+		return nil
+	}
+	log.Printf("[backup] %s: %s, not uploading", b.Name, msg)
+	notify(event, fmt.Sprintf("%s: %s, not uploaded", b.Name, msg), map[string]any{
+		"backup": b.Name,
+		"size":   size,
+		"min":    int64(b.MinDumpSize),
+		"max":    int64(b.MaxDumpSize),
+	})
+	return errors.New(msg)
+}
+
+// checkDbSize reports whether the dump should go ahead given MaxDbSize. A
+// failed size query doesn't block the backup.
+func checkDbSize(ctx context.Context, b Backup) bool {
+	if b.MaxDbSize <= 0 {
+		return true
+	}
+	size, err := databaseSize(ctx, b)
+	if err != nil {
+		log.Printf("[backup] %s: size check failed, dumping anyway: %v", b.Name, err)
+		return true
+	}
+	if size <= b.MaxDbSize {
+		return true
+	}
+	skip := b.MaxDbSizeAction != "warn"
+	action := "skipping dump"
+	if !skip {
+		action = "dumping anyway"
+	}
+	log.Printf("[backup] %s: database size %s exceeds maxDbSize %s, %s", b.Name, size, b.MaxDbSize, action)
+	notify("db_size_exceeded", fmt.Sprintf("%s: database size %s exceeds maxDbSize %s, %s", b.Name, size, b.MaxDbSize, action),
+		map[string]any{
+			"backup":  b.Name,
+			"size":    int64(size),
+			"limit":   int64(b.MaxDbSize),
+			"skipped": skip,
+		})
+	return !skip
+}
+
+func awsEnv(d Destination) []string {
+	d = d.current()
 	env := os.Environ()
-	if access != "" {
-		env = append(env, "AWS_ACCESS_KEY_ID="+access)
+	if d.Access != "" {
+		env = append(env, "AWS_ACCESS_KEY_ID="+d.Access)
+	}
+	if d.Secret != "" {
+		env = append(env, "AWS_SECRET_ACCESS_KEY="+d.Secret)
+	}
+	if d.Access != "" {
+		// Always set, so a token inherited from the environment is never
+		// paired with a different, explicitly configured key.
+		env = append(env, "AWS_SESSION_TOKEN="+d.SessionToken)
+	}
+	if d.Region != "" {
+		env = append(env, "AWS_DEFAULT_REGION="+d.Region)
 	}
-	if secret != "" {
-		env = append(env, "AWS_SECRET_ACCESS_KEY="+secret)
+	if d.Endpoint != "" {
+		env = append(env, "AWS_ENDPOINT_URL="+d.Endpoint)
 	}
-	if region != "" {
-		env = append(env, "AWS_DEFAULT_REGION="+region)
+	// The CLI adds these to its User-Agent as exec-env/... and app/...
+	env = append(env, "AWS_EXECUTION_ENV=pg-backup/"+version)
+	if d.UserAgent != "" {
+		env = append(env, "AWS_SDK_UA_APP_ID="+d.UserAgent)
 	}
-	if endpoint != "" {
-		env = append(env, "AWS_ENDPOINT_URL="+endpoint)
+	if path, err := s3ConfigFile(d); err != nil {
+		log.Printf("[backup] path-style addressing and acceleration unavailable: %v", err)
+	} else if path != "" {
+		env = append(env, "AWS_CONFIG_FILE="+path)
 	}
 	return env
 }
 
-func awsCp(endpoint, region, access, secret, bucket, key, file string) error {
-	args := []string{"s3", "cp", file, "s3://" + bucket + "/" + strings.TrimLeft(key, "/")}
-	if endpoint != "" {
-		args = append(args, "--endpoint-url", endpoint)
+var (
+	s3ConfigMu    sync.Mutex
+	s3ConfigFiles = map[string]string{}
+)
+
+// s3ConfigFile writes, once per process and combination of settings, an AWS
+// CLI config file with d's s3 settings: path-style addressing and transfer
+// acceleration, which the CLI has no flag or environment variable for. It
+// replaces the user's config file for these calls, which is fine since
+// credentials, region and endpoint are passed in the environment. The path
+// is empty when d needs neither.
+func s3ConfigFile(d Destination) (string, error) {
+	var settings []string
+	if d.ForcePathStyle {
+		settings = append(settings, "addressing_style = path")
+	}
+	if d.Accelerate {
+		settings = append(settings, "use_accelerate_endpoint = true")
+	}
+	if len(settings) == 0 {
+		return "", nil
+	}
+	body := "s3 =\n    " + strings.Join(settings, "\n    ") + "\n"
+
+	s3ConfigMu.Lock()
+	defer s3ConfigMu.Unlock()
+	if path, ok := s3ConfigFiles[body]; ok {
+		return path, nil
+	}
+	section := "default"
+	if p := os.Getenv("AWS_PROFILE"); p != "" && p != "default" {
+		section = "profile " + p
+	}
+	f, err := os.CreateTemp("", "pg-backup-aws-*.cfg")
+	if err != nil {
+		return "", err
+	}
+	_, err = fmt.Fprintf(f, "[%s]\n%s", section, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	s3ConfigFiles[body] = f.Name()
+	return f.Name(), nil
+}
+
+// awsCommand builds an aws CLI invocation against destination d, adding the
+// endpoint and region flags and the credentials environment.
+func awsCommand(ctx context.Context, d Destination, args ...string) *exec.Cmd {
+	if d.Endpoint != "" {
+		args = append(args, "--endpoint-url", d.Endpoint)
+	}
+	if d.Region != "" {
+		args = append(args, "--region", d.Region)
 	}
-	if region != "" {
-		args = append(args, "--region", region)
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	cmd.Env = awsEnv(d)
+	if d.Access == "" {
+		if c, ok := chainCredentials(ctx, d, cmd.Env); ok {
+			cmd.Env = append(cmd.Env, "AWS_ACCESS_KEY_ID="+c.access, "AWS_SECRET_ACCESS_KEY="+c.secret, "AWS_SESSION_TOKEN="+c.token)
+		}
 	}
-	cmd := exec.Command("aws", args...)
-	cmd.Env = awsEnv(endpoint, region, access, secret)
+	return cmd
+}
+
+func awsCp(ctx context.Context, d Destination, key, file string, extra ...string) error {
+	args := []string{"s3", "cp", file, "s3://" + d.Bucket + "/" + strings.TrimLeft(key, "/")}
+	args = append(args, extra...)
+	cmd := awsCommand(ctx, d, args...)
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return runCaptured(cmd, nil)
+}
+
+// awsObjectExists reports whether key exists, treating a 404 from head-object
+// as "no" rather than an error.
+func awsObjectExists(ctx context.Context, d Destination, key string) (bool, error) {
+	args := []string{"s3api", "head-object", "--bucket", d.Bucket, "--key", strings.TrimLeft(key, "/")}
+	cmd := awsCommand(ctx, d, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := stderr.String(); strings.Contains(msg, "Not Found") || strings.Contains(msg, "404") {
+			return false, nil
+		}
+		return false, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return true, nil
+}
+
+type s3Head struct {
+	ContentLength  int64  `json:"ContentLength"`
+	ETag           string `json:"ETag"`
+	ChecksumSHA256 string `json:"ChecksumSHA256"`
+	ChecksumSHA1   string `json:"ChecksumSHA1"`
+	ChecksumCRC32  string `json:"ChecksumCRC32"`
+	ChecksumCRC32C string `json:"ChecksumCRC32C"`
 }
 
-func awsListObjects(endpoint, region, access, secret, bucket, prefix string) ([]s3Object, error) {
+// checksum returns the stored checksum for algorithm, if S3 reported one.
+func (h s3Head) checksum(algorithm string) string {
+	switch algorithm {
+	case "SHA256":
+		return h.ChecksumSHA256
+	case "SHA1":
+		return h.ChecksumSHA1
+	case "CRC32":
+		return h.ChecksumCRC32
+	case "CRC32C":
+		return h.ChecksumCRC32C
+	}
+	return ""
+}
+
+func awsHeadObject(ctx context.Context, d Destination, key string) (s3Head, error) {
 	args := []string{
-		"s3api", "list-objects-v2",
-		"--bucket", bucket,
-		"--prefix", strings.TrimLeft(prefix, "/"),
+		"s3api", "head-object",
+		"--bucket", d.Bucket,
+		"--key", strings.TrimLeft(key, "/"),
+		"--checksum-mode", "ENABLED",
 		"--output", "json",
 	}
-	if endpoint != "" {
-		args = append(args, "--endpoint-url", endpoint)
+	cmd := awsCommand(ctx, d, args...)
+	out, err := outputCaptured(cmd)
+	if err != nil {
+		return s3Head{}, err
 	}
-	if region != "" {
-		args = append(args, "--region", region)
+	var head s3Head
+	if err := json.Unmarshal(out, &head); err != nil {
+		return s3Head{}, err
 	}
-	cmd := exec.Command("aws", args...)
-	cmd.Env = awsEnv(endpoint, region, access, secret)
-	out, err := cmd.Output()
+	return head, nil
+}
+
+func awsListObjects(ctx context.Context, d Destination, prefix string) ([]s3Object, error) {
+	args := []string{
+		"s3api", "list-objects-v2",
+		"--bucket", d.Bucket,
+		"--prefix", strings.TrimLeft(prefix, "/"),
+		"--output", "json",
+	}
+	cmd := awsCommand(ctx, d, args...)
+	out, err := outputCaptured(cmd)
 	if err != nil {
 		return nil, err
 	}
@@ -178,163 +1027,934 @@ func awsListObjects(endpoint, region, access, secret, bucket, prefix string) ([]
 	return payload.Contents, nil
 }
 
-func awsDeleteObjects(endpoint, region, access, secret, bucket string, keys []string) error {
+// isObjectLockError reports whether a delete-objects error was caused by S3
+// Object Lock (retention or legal hold) protecting the object.
+func isObjectLockError(code, message string) bool {
+	msg := strings.ToLower(message)
+	return code == "ObjectLocked" ||
+		(code == "AccessDenied" && (strings.Contains(msg, "object lock") || strings.Contains(msg, "retention") || strings.Contains(msg, "legal hold")))
+}
+
+const (
+	// deleteBatchSize is the most keys one delete-objects request takes.
+	deleteBatchSize = 1000
+	// maxDeleteConcurrency keeps a prune well clear of S3's request rate
+	// limits per prefix.
+	maxDeleteConcurrency = 8
+)
+
+// awsDeleteObjects deletes keys in batches, deleteConcurrency of them at a
+// time. Objects protected by Object Lock are returned as locked rather than
+// treated as a failure. A failed batch, throttling included, stops further
+// batches from starting, so the caller's retry backs off for all of them.
+func awsDeleteObjects(ctx context.Context, d Destination, keys []string) (locked []string, err error) {
 	if len(keys) == 0 {
-		return nil
+		return nil, nil
+	}
+	var batches [][]string
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		batches = append(batches, keys[start:min(start+deleteBatchSize, len(keys))])
 	}
-	for start := 0; start < len(keys); start += 1000 {
-		end := start + 1000
-		if end > len(keys) {
-			end = len(keys)
+	var (
+		mu      sync.Mutex
+		deleted int
+		errs    []error
+		wg      sync.WaitGroup
+	)
+	sem := make(chan struct{}, d.deleteConcurrency())
+	for _, batch := range batches {
+		sem <- struct{}{}
+		mu.Lock()
+		failed := len(errs) > 0
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
 		}
-		batch := keys[start:end]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			l, err := awsDeleteBatch(ctx, d, batch)
+			mu.Lock()
+			defer mu.Unlock()
+			locked = append(locked, l...)
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			deleted += len(batch) - len(l)
+		}()
+	}
+	wg.Wait()
+	if len(batches) > 1 || len(errs) > 0 {
+		log.Printf("[prune] deleted %d of %d objects in s3://%s (%d batches, %d at a time)", deleted, len(keys), d.Bucket, len(batches), d.deleteConcurrency())
+	}
+	return locked, errors.Join(errs...)
+}
 
-		type delObj struct {
-			Key string `json:"Key"`
+// awsDeleteBatch deletes up to deleteBatchSize keys in one request.
+func awsDeleteBatch(ctx context.Context, d Destination, batch []string) (locked []string, err error) {
+	type delObj struct {
+		Key string `json:"Key"`
+	}
+	body, _ := json.Marshal(struct {
+		Objects []delObj `json:"Objects"`
+		Quiet   bool     `json:"Quiet"`
+	}{
+		Objects: func() []delObj {
+			out := make([]delObj, len(batch))
+			for i, k := range batch {
+				out[i] = delObj{Key: k}
+			}
+			return out
+		}(),
+		Quiet: true,
+	})
+
+	args := []string{
+		"s3api", "delete-objects",
+		"--bucket", d.Bucket,
+		"--delete", string(body),
+	}
+	cmd := awsCommand(ctx, d, args...)
+	out, err := outputCaptured(cmd)
+	if err != nil {
+		return locked, err
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+	var result struct {
+		Errors []struct {
+			Key     string `json:"Key"`
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		} `json:"Errors"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return locked, fmt.Errorf("parse delete-objects output: %w", err)
+	}
+	var failed []string
+	for _, e := range result.Errors {
+		if isObjectLockError(e.Code, e.Message) {
+			locked = append(locked, e.Key)
+			continue
 		}
-		body, _ := json.Marshal(struct {
-			Objects []delObj `json:"Objects"`
-			Quiet   bool     `json:"Quiet"`
-		}{
-			Objects: func() []delObj {
-				out := make([]delObj, len(batch))
-				for i, k := range batch {
-					out[i] = delObj{Key: k}
-				}
-				return out
-			}(),
-			Quiet: true,
-		})
+		failed = append(failed, fmt.Sprintf("%s: %s %s", e.Key, e.Code, e.Message))
+	}
+	if len(failed) > 0 {
+		return locked, fmt.Errorf("%d objects not deleted: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return locked, nil
+}
+
+// deleteConcurrency is how many delete-objects batches run at once.
+func (d Destination) deleteConcurrency() int {
+	return max(d.DeleteConcurrency, 1)
+}
 
-		args := []string{
-			"s3api", "delete-objects",
-			"--bucket", bucket,
-			"--delete", string(body),
+// awsPutRetention places an Object Lock retention on key until the given time.
+func awsPutRetention(ctx context.Context, d Destination, key, mode string, until time.Time) error {
+	args := []string{
+		"s3api", "put-object-retention",
+		"--bucket", d.Bucket,
+		"--key", strings.TrimLeft(key, "/"),
+		"--retention", "Mode=" + mode + ",RetainUntilDate=" + until.UTC().Format(time.RFC3339),
+	}
+	cmd := awsCommand(ctx, d, args...)
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+// dbName extracts the database name from a connection string, falling back to
+// "all" when it doesn't name one. It follows libpq: a dbname query parameter
+// overrides the URL path, the path is percent-decoded, and keyword/value
+// strings ("host=... dbname=...") are understood too. URLs that net/url
+// rejects but libpq accepts, such as a percent-encoded socket directory as
+// the host, are split by hand.
+func dbName(conn string) string {
+	var name string
+	if u, err := url.Parse(conn); err == nil && u.Scheme != "" {
+		name = u.Query().Get("dbname")
+		if name == "" {
+			name = strings.Trim(u.Path, "/")
 		}
-		if endpoint != "" {
-			args = append(args, "--endpoint-url", endpoint)
+	} else if _, rest, ok := strings.Cut(conn, "://"); ok {
+		rest, query, _ := strings.Cut(rest, "?")
+		if q, err := url.ParseQuery(query); err == nil {
+			name = q.Get("dbname")
 		}
-		if region != "" {
-			args = append(args, "--region", region)
+		if i := strings.LastIndex(rest, "@"); i >= 0 {
+			rest = rest[i+1:]
 		}
-		cmd := exec.Command("aws", args...)
-		cmd.Env = awsEnv(endpoint, region, access, secret)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
+		if _, path, found := strings.Cut(rest, "/"); found && name == "" {
+			if name, err = url.PathUnescape(strings.Trim(path, "/")); err != nil {
+				name = strings.Trim(path, "/")
+			}
+		}
+	} else {
+		for _, f := range strings.Fields(conn) {
+			if v, ok := strings.CutPrefix(f, "dbname="); ok {
+				name = strings.Trim(v, "'")
+			}
 		}
 	}
-	return nil
+	if name == "" {
+		return "all"
+	}
+	return name
 }
 
-func pruneHistory(dest Destination, basePrefix string, keep int) {
-	if keep <= 0 {
-		return
+func uploadManifest(ctx context.Context, b Backup, dest Destination, key, out string, res RunResult) error {
+	m, err := buildManifest(ctx, b, key, out, res)
+	if err != nil {
+		return err
 	}
-	objs, err := awsListObjects(dest.Endpoint, dest.Region, dest.Access, dest.Secret, dest.Bucket, basePrefix)
+	return putManifest(ctx, dest, key, out, m)
+}
+
+// putManifest uploads m, the manifest of the dump out stored at key.
+func putManifest(ctx context.Context, dest Destination, key, out string, m Manifest) error {
+	path, err := writeManifestFile(m, out)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	err = storageOp(ctx, dest, "upload "+manifestKey(key), 0, func(ctx context.Context) error {
+		return dest.store().put(ctx, manifestKey(key), path)
+	})
 	if err != nil {
-		log.Printf("[prune] list failed for s3://%s/%s: %v", dest.Bucket, basePrefix, err)
-		return
+		return err
 	}
+	log.Printf("[backup] uploaded %s", dest.store().url(manifestKey(key)))
+	return nil
+}
+
+// basePrefix is the key prefix all of a backup's dumps are written under.
+func basePrefix(b Backup, dest Destination) string {
+	return filepath.Join(b.rootPrefix(dest), b.Tier, b.keyName()) + "/"
+}
 
+// rootPrefix is the destination's prefix followed by the backup's own.
+func (b Backup) rootPrefix(dest Destination) string {
+	return path.Join(strings.Trim(dest.Prefix, "/"), strings.Trim(b.Prefix, "/"))
+}
+
+// prefixName names the directory under the destination prefix: the database,
+// or the backup's name for a bundle, which holds many databases.
+func (b Backup) prefixName() string {
+	if b.Bundle {
+		return b.Name
+	}
+	return dbName(b.URL)
+}
+
+// pruneOnStartConcurrency bounds how many prunes the PRUNE_ON_START pass runs at once.
+const pruneOnStartConcurrency = 4
+
+// pruneAll runs pruneHistory for every backup with a retention policy,
+// concurrently but bounded. Each prune still honours its own delete cap.
+func pruneAll(ctx context.Context, cfg Config) {
+	sem := make(chan struct{}, pruneOnStartConcurrency)
+	var wg sync.WaitGroup
+	for _, b := range cfg.Backups {
+		if !b.hasRetention() {
+			continue
+		}
+		dest := cfg.Destinations[b.Destination]
+		for _, b := range b.members() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				pruneHistory(ctx, b, dest, basePrefix(b, dest))
+			}()
+		}
+	}
+	wg.Wait()
+	log.Printf("[prune] startup pass finished")
+}
+
+// pruneHistory applies the backup's retention. Failures are logged and
+// counted here; the returned error is informational for the run result.
+func pruneHistory(ctx context.Context, b Backup, dest Destination, basePrefix string) error {
+	if !b.hasRetention() {
+		return nil
+	}
+	if dest.Type == "restic" {
+		return pruneRestic(ctx, b, dest)
+	}
+	store := dest.store()
+	var objs []s3Object
+	var err error
+	fromInventory := false
+	if b.PruneSource == "inventory" {
+		if objs, err = inventoryObjects(ctx, dest, basePrefix); err != nil {
+			log.Printf("[prune] %s: inventory unusable, listing instead: %v", b.Name, err)
+		} else {
+			fromInventory = true
+		}
+	}
+	if !fromInventory {
+		prefixes := []string{basePrefix}
+		if b.PruneSource == "partitions" {
+			if p, ok := partitionPrefixes(b, basePrefix, time.Now()); ok {
+				prefixes = p
+			}
+		}
+		err = storageOp(ctx, dest, "list "+store.url(basePrefix), pruneTimeout, func(ctx context.Context) error {
+			objs = nil
+			for _, p := range prefixes {
+				part, err := store.list(ctx, p)
+				if err != nil {
+					return err
+				}
+				objs = append(objs, part...)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[prune] list failed for %s: %v", store.url(basePrefix), err)
+			pruneFailures.Inc(b.Name)
+			return err
+		}
+	}
+
+	// Only direct children of the database prefix are dumps under retention;
+	// anything deeper, such as a database named "archive" seeing the archive
+	// prefix, is left alone.
 	filtered := make([]s3Object, 0, len(objs))
 	for _, o := range objs {
-		if strings.HasSuffix(o.Key, ".dump") && strings.HasPrefix(filepath.Base(o.Key), "pgdump-") {
+		if strings.Contains(strings.TrimPrefix(o.Key, basePrefix), "/") {
+			continue
+		}
+		if isDumpKey(o.Key, b.dumpPrefix()) {
 			filtered = append(filtered, o)
 		}
 	}
 
-	sort.Slice(filtered, func(i, j int) bool {
-		return filtered[i].LastModified.After(filtered[j].LastModified)
+	// LastModified is the upload time, which a bucket migration or re-upload
+	// resets; with pruneByKeyTimestamp the dump time in the key is used.
+	when := func(o s3Object) time.Time {
+		if b.PruneByKeyTimestamp {
+			if t, ok := dumpTime(o.Key, b.dumpPrefix()); ok {
+				return t
+			}
+		}
+		return o.LastModified
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		ti, tj := when(filtered[i]), when(filtered[j])
+		if ti.Equal(tj) {
+			return filtered[i].LastModified.After(filtered[j].LastModified)
+		}
+		return ti.After(tj)
 	})
 
-	if len(filtered) <= keep {
-		return
+	expired := b.retention().expiredDumps(filtered, when, time.Now())
+	if len(expired) == 0 {
+		if b.PruneSource == "partitions" {
+			setPruneFloor(b, basePrefix, filtered, nil)
+		}
+		return nil
+	}
+	if limit := b.deleteCap(); limit > 0 && len(expired) > limit {
+		// Delete the oldest first and leave the rest for a human to look at:
+		// a prune this large usually means something is misconfigured.
+		log.Printf("[prune] WARNING: %d backups under %s exceed retention but maxDeletePerRun is %d; "+
+			"deleting the oldest %d only, manual intervention required", len(expired), store.url(basePrefix), limit, limit)
+		notify("prune_capped", fmt.Sprintf("prune for %s wanted to delete %d backups from %s but is capped at %d; please investigate",
+			b.Name, len(expired), store.url(basePrefix), limit), map[string]any{
+			"backup":  b.Name,
+			"bucket":  dest.Bucket,
+			"prefix":  basePrefix,
+			"expired": len(expired),
+			"cap":     limit,
+		})
+		expired = expired[len(expired)-limit:]
 	}
 
-	toDelete := make([]string, 0, len(filtered)-keep)
-	for _, o := range filtered[keep:] {
+	// Manifests are deleted together with the dump they describe.
+	sizes := make(map[string]int64, len(objs))
+	for _, o := range objs {
+		sizes[o.Key] = o.Size
+	}
+	toDelete := make([]string, 0, len(expired))
+	var freed int64
+	for _, o := range expired {
 		toDelete = append(toDelete, o.Key)
+		freed += o.Size
+		if size, ok := sizes[manifestKey(o.Key)]; ok {
+			toDelete = append(toDelete, manifestKey(o.Key))
+			freed += size
+		}
 	}
-	log.Printf("[prune] deleting %d old backups under s3://%s/%s", len(toDelete), dest.Bucket, basePrefix)
-	if err := awsDeleteObjects(dest.Endpoint, dest.Region, dest.Access, dest.Secret, dest.Bucket, toDelete); err != nil {
+	sample := toDelete
+	if len(sample) > 10 {
+		sample = sample[:10]
+	}
+	log.Printf("[prune] deleting %d old backups (%d objects, %d bytes) under %s: %s",
+		len(expired), len(toDelete), freed, store.url(basePrefix), strings.Join(sample, ", "))
+	var locked []string
+	err = storageOp(ctx, dest, "delete from "+store.url(basePrefix), pruneTimeout, func(ctx context.Context) error {
+		var err error
+		locked, err = store.remove(ctx, toDelete)
+		return err
+	})
+	if err != nil {
 		log.Printf("[prune] delete failed: %v", err)
+		pruneFailures.Inc(b.Name)
+		return err
+	}
+	if len(locked) > 0 {
+		// Object Lock is doing its job; these age out of the lock and get
+		// picked up by a later prune.
+		log.Printf("[prune] %d objects retained by object lock: %s", len(locked), strings.Join(locked, ", "))
+		isLocked := make(map[string]bool, len(locked))
+		for _, k := range locked {
+			isLocked[k] = true
+			freed -= sizes[k]
+		}
+		deleted := toDelete[:0:0]
+		for _, k := range toDelete {
+			if !isLocked[k] {
+				deleted = append(deleted, k)
+			}
+		}
+		toDelete = deleted
+	}
+	if b.PruneSource == "partitions" {
+		setPruneFloor(b, basePrefix, filtered, toDelete)
+	}
+	if b.LatestPointer && len(toDelete) > 0 {
+		repointLatest(ctx, b, dest, basePrefix, toDelete, filtered[0])
+	}
+	prunedObjects.Add(float64(len(toDelete)), b.Name)
+	prunedBytes.Add(float64(freed), b.Name)
+	if len(toDelete) > 0 {
+		publishPruned(b, pruneEvent{Bucket: dest.Bucket, Prefix: basePrefix, Count: len(toDelete), Bytes: freed, Keys: toDelete})
 	}
+	if notifier().OnPrune && len(toDelete) > 0 {
+		notify("prune", fmt.Sprintf("pruned %d old backups (%d objects, %d bytes) for %s from %s",
+			len(expired), len(toDelete), freed, b.Name, store.url(basePrefix)), map[string]any{
+			"backup": b.Name,
+			"bucket": dest.Bucket,
+			"prefix": basePrefix,
+			"count":  len(toDelete),
+			"bytes":  freed,
+			"keys":   toDelete,
+		})
+	}
+	return nil
 }
 
-func main() {
+// loadConfig reads CONFIG_FILE (default /config.yaml), expands env vars and
+// fills destination credentials from the environment.
+func loadConfig() (Config, error) {
+	if configFromEnv() {
+		return envConfig()
+	}
 	cfgFile := os.Getenv("CONFIG_FILE")
 	if cfgFile == "" {
-		cfgFile = "/config.yaml"
+		cfgFile = defaultConfigFile
 	}
 	raw, err := os.ReadFile(cfgFile)
 	if err != nil {
-		log.Fatalf("read config: %v", err)
+		return Config{}, fmt.Errorf("read config: %w", err)
+	}
+	if method := configEncryption(cfgFile, raw); method != "" {
+		if raw, err = decryptConfig(cfgFile, raw, method); err != nil {
+			return Config{}, fmt.Errorf("decrypt config: %w", err)
+		}
 	}
 
 	// Expand env across the entire YAML so all fields support env vars.
-	expanded := expandAllEnv(string(raw))
+	expanded := string(raw)
+	if allow := os.Getenv("ENV_ALLOWLIST"); allow != "" {
+		if expanded, err = expandEnvStrict(expanded, strings.Fields(strings.ReplaceAll(allow, ",", " "))); err != nil {
+			return Config{}, err
+		}
+	} else {
+		expanded = expandAllEnv(expanded)
+	}
 
 	var cfg Config
 	if err := yaml.Unmarshal([]byte(expanded), &cfg); err != nil {
-		log.Fatalf("parse config: %v", err)
+		return Config{}, fmt.Errorf("parse config: %w", err)
 	}
 
 	for k, d := range cfg.Destinations {
 		fillDestFromEnv(&d)
 		cfg.Destinations[k] = d
 	}
+	return cfg, nil
+}
 
-	parser := cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
-	c := cron.New(cron.WithParser(parser), cron.WithChain(cron.Recover(cron.DefaultLogger)))
+// validateConfig checks the whole config and fills in derived defaults
+// (backup names, the resolved compressor) and expands multi-schedule backups
+// into one backup per schedule. It reports every problem at once
+// rather than stopping at the first, and never exits: at startup main treats
+// an error as fatal, on reload it is logged and the running config is kept.
+func validateConfig(cfg *Config) error {
+	var errs []error
+	for k, d := range cfg.Destinations {
+		switch d.Type {
+		case "", "s3":
+		case "b2":
+			if d.ChecksumAlgorithm != "" || d.ObjectLockRetention > 0 {
+				errs = append(errs, fmt.Errorf("destination %q: checksumAlgorithm and object lock are only supported on s3", k))
+			}
+		case "restic":
+			if d.Repository == "" || (d.Password == "" && d.PasswordFile == "") {
+				errs = append(errs, fmt.Errorf("destination %q: restic needs repository and password or passwordFile", k))
+			}
+			if d.VerifyUpload {
+				errs = append(errs, fmt.Errorf("destination %q: verifyUpload is not supported on restic, which verifies its own uploads", k))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("destination %q: unknown type %q", k, d.Type))
+		}
+		switch d.ChecksumAlgorithm {
+		case "", "SHA256", "SHA1", "CRC32", "CRC32C":
+		default:
+			errs = append(errs, fmt.Errorf("destination %q: unsupported checksumAlgorithm %q", k, d.ChecksumAlgorithm))
+		}
+		if d.ObjectLockRetention > 0 && d.ObjectLockMode != "GOVERNANCE" && d.ObjectLockMode != "COMPLIANCE" {
+			errs = append(errs, fmt.Errorf("destination %q: objectLockMode must be GOVERNANCE or COMPLIANCE", k))
+		}
+		if d.Accelerate {
+			switch {
+			case d.Type != "" && d.Type != "s3":
+				errs = append(errs, fmt.Errorf("destination %q: accelerate is only supported on s3", k))
+			case d.Endpoint != "":
+				errs = append(errs, fmt.Errorf("destination %q: accelerate uses the AWS accelerate endpoint and can't be combined with endpoint", k))
+			case d.ForcePathStyle:
+				errs = append(errs, fmt.Errorf("destination %q: accelerate requires virtual-hosted addressing, drop forcePathStyle", k))
+			case strings.Contains(d.Bucket, "."):
+				errs = append(errs, fmt.Errorf("destination %q: accelerate doesn't work with bucket names containing dots", k))
+			}
+		}
+		if d.ResumableUploads && d.Type != "" && d.Type != "s3" {
+			errs = append(errs, fmt.Errorf("destination %q: resumableUploads is only supported on s3", k))
+		}
+		if d.PartSize != 0 && d.PartSize < minPartSize {
+			errs = append(errs, fmt.Errorf("destination %q: partSize must be at least 5MiB", k))
+		}
+		errs = append(errs, d.Breaker.validate(k, d)...)
+		if d.DeleteConcurrency < 0 || d.DeleteConcurrency > maxDeleteConcurrency {
+			errs = append(errs, fmt.Errorf("destination %q: deleteConcurrency must be between 1 and %d", k, maxDeleteConcurrency))
+		} else if d.DeleteConcurrency > 1 && d.Type != "" && d.Type != "s3" {
+			errs = append(errs, fmt.Errorf("destination %q: deleteConcurrency is only supported on s3", k))
+		}
+		if len(d.UserAgent) > 50 || strings.ContainsAny(d.UserAgent, " \t\n") {
+			errs = append(errs, fmt.Errorf("destination %q: userAgent must be at most 50 characters without spaces", k))
+		}
+		if d.Inventory.Location != "" {
+			if _, _, err := d.Inventory.split(); err != nil {
+				errs = append(errs, fmt.Errorf("destination %q: %v", k, err))
+			}
+			if d.Type != "" && d.Type != "s3" {
+				errs = append(errs, fmt.Errorf("destination %q: inventory is only supported on s3", k))
+			}
+		}
+		if d.Endpoint != "" {
+			if u, err := url.Parse(d.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("destination %q: endpoint %q must be an http:// or https:// URL, e.g. http://localhost:9000", k, d.Endpoint))
+			}
+		}
+	}
 
+	if cfg.Workers < 0 {
+		errs = append(errs, fmt.Errorf("workers must not be negative"))
+	}
+	switch cfg.WhenBusy {
+	case "", "queue", "drop":
+	default:
+		errs = append(errs, fmt.Errorf("whenBusy must be queue or drop, got %q", cfg.WhenBusy))
+	}
+	if err := cfg.Catalog.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.Events.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Report.Path != "" {
+		if st, err := os.Stat(filepath.Dir(cfg.Report.Path)); err != nil || !st.IsDir() {
+			errs = append(errs, fmt.Errorf("report.path: directory of %s does not exist", cfg.Report.Path))
+		}
+	}
+
+	var backups []Backup
 	for _, b := range cfg.Backups {
-		b := b
-		dest, ok := cfg.Destinations[b.Destination]
-		if !ok {
-			log.Fatalf("unknown destination %q", b.Destination)
+		if b.Name == "" {
+			b.Name = dbName(b.URL)
 		}
-		_, err := c.AddFunc(b.Schedule, func() {
-			log.Printf("[backup] start %s", b.URL)
-			out, err := runPgDump(b.URL)
-			if err != nil {
-				log.Printf("[backup] pg_dump failed: %v", err)
-				return
-			}
-			defer os.Remove(out)
+		if len(b.Schedules) > 0 && (b.Schedule != "" || b.Interval != 0) {
+			errs = append(errs, fmt.Errorf("backup %q: schedules replaces schedule and interval, set only one", b.Name))
+		}
+		backups = append(backups, b.expand()...)
+	}
+	cfg.Backups = backups
 
-			dbname := "all"
-			if i := strings.LastIndex(b.URL, "/"); i >= 0 && i < len(b.URL)-1 {
-				dbname = b.URL[i+1:]
-				if strings.Contains(dbname, "?") {
-					dbname = strings.SplitN(dbname, "?", 2)[0]
-				}
+	for i := range cfg.Backups {
+		b := &cfg.Backups[i]
+		bad := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("backup %q: "+format, append([]any{b.Name}, args...)...))
+		}
+		if _, ok := cfg.Destinations[b.Destination]; !ok {
+			bad("unknown destination %q", b.Destination)
+		}
+		for _, err := range b.resolveFanout(cfg.Destinations) {
+			bad("%v", err)
+		}
+		if err := b.resolveReplica(cfg.Destinations); err != nil {
+			bad("%v", err)
+		}
+		if b.SchemaOnly && b.DataOnly {
+			bad("schemaOnly and dataOnly are mutually exclusive")
+		}
+		for _, t := range b.ExcludeTableData {
+			if strings.TrimSpace(t) == "" {
+				bad("excludeTableData: empty pattern")
+			}
+		}
+		if err := b.LocalEncryption.validate(); err != nil {
+			bad("%v", err)
+		}
+		if err := validateCatchUp(*b, cfg.Destinations[b.Destination]); err != nil {
+			bad("%v", err)
+		}
+		if err := validateParts(*b); err != nil {
+			bad("%v", err)
+		}
+		if b.SkipUnchanged && (!b.WriteManifest || cfg.Destinations[b.Destination].Type == "restic") {
+			bad("skipUnchanged needs writeManifest, which records the WAL position, and isn't supported on restic destinations")
+		}
+		if b.AllowEmpty && (b.MinDumpSize == 0 || b.Bundle) {
+			bad("allowEmpty needs minDumpSize and can't be used with bundle")
+		}
+		if len(b.ExcludeTableData) > 0 && b.SchemaOnly {
+			bad("excludeTableData has no effect with schemaOnly")
+		}
+		if b.PgpassFile != "" {
+			if st, err := os.Stat(b.PgpassFile); err != nil {
+				bad("pgpassFile: %v", err)
+			} else if st.Mode().Perm()&0o077 != 0 {
+				bad("pgpassFile %s must not be accessible by group or others (chmod 0600), libpq ignores it otherwise", b.PgpassFile)
+			}
+		}
+		if _, err := parseConn(b.URL); err != nil {
+			bad("url: %v", err)
+		}
+		if b.PgDumpImage != "" {
+			if b.PgDumpPath != "" {
+				bad("pgDumpImage and pgDumpPath are mutually exclusive")
+			}
+			if _, err := containerRuntime(); err != nil {
+				bad("%v", err)
+			}
+		} else if _, err := exec.LookPath(binPath(b.PgDumpPath, "pg_dump")); err != nil {
+			bad("%v", err)
+		}
+		// Rules resolve their compressors from the configured one.
+		for j := range b.Rules {
+			if err := b.Rules[j].validate(*b); err != nil {
+				bad("rules[%d]: %v", j, err)
+			}
+		}
+		if err := resolveCompressor(context.Background(), b); err != nil {
+			bad("%v", err)
+		} else if err := b.CompressionAutoTune.validate(*b); err != nil {
+			bad("%v", err)
+		}
+		switch d := cfg.Destinations[b.Destination]; {
+		case b.Stream == "":
+		case b.Stream != "compress" && b.Stream != "upload":
+			bad("stream must be compress or upload, got %q", b.Stream)
+		case b.Bundle:
+			bad("stream is not supported with bundle, which compresses the whole tar")
+		case b.Stream == "compress" && b.Compression == "" && b.pgDumpCompress == "":
+			bad("stream: compress needs compression")
+		case b.Stream == "upload" && d.Type != "" && d.Type != "s3":
+			bad("stream: upload is only supported on s3 destinations")
+		case b.Stream == "upload" && d.ResumableUploads:
+			bad("stream: upload and resumableUploads on destination %q are mutually exclusive", b.Destination)
+		}
+		if b.CompressMinSize > 0 && b.Stream != "" {
+			bad("compressMinSize is not supported with stream, which compresses before the size is known")
+		}
+		if b.LockWaitTimeout < 0 || (b.LockWaitTimeout > 0 && b.LockWaitTimeout < time.Millisecond) {
+			bad("lockWaitTimeout must be at least 1ms")
+		}
+		if _, err := compilePatterns(b.FailOnStderr); err != nil {
+			bad("failOnStderr: %v", err)
+		}
+		if _, err := compilePatterns(b.TolerateStderr); err != nil {
+			bad("tolerateStderr: %v", err)
+		}
+		switch b.KeyCollision {
+		case "", "overwrite", "suffix", "fail":
+		default:
+			bad("keyCollision must be overwrite, suffix or fail, got %q", b.KeyCollision)
+		}
+		switch b.Archive {
+		case "", "monthly", "weekly", "yearly":
+			if b.Archive != "" && cfg.Destinations[b.Destination].Type == "restic" {
+				bad("archive is not supported on restic destinations")
+			}
+		default:
+			bad("archive must be monthly, weekly or yearly, got %q", b.Archive)
+		}
+		if b.KeepPerDay < 0 || b.MaxAge < 0 {
+			bad("keepPerDay and maxAge must not be negative")
+		}
+		if (b.KeepPerDay > 0 || b.MaxAge > 0) && cfg.Destinations[b.Destination].Type == "restic" {
+			bad("keepPerDay and maxAge are not supported on restic destinations, which only keep maxHistory")
+		}
+		if b.LatestPointer && cfg.Destinations[b.Destination].Type == "restic" {
+			bad("latestPointer is not supported on restic destinations")
+		}
+		if b.GlobalsMaxHistory < 0 {
+			bad("globalsMaxHistory must not be negative")
+		}
+		if b.dumpsGlobals(cfg.Destinations[b.Destination]) && cfg.Destinations[b.Destination].Type == "restic" {
+			bad("globals is not supported on restic destinations")
+		}
+		switch b.MaxDbSizeAction {
+		case "", "skip", "warn":
+		default:
+			bad("maxDbSizeAction must be skip or warn, got %q", b.MaxDbSizeAction)
+		}
+		switch b.VersionMismatch {
+		case "", "warn", "fail", "ignore":
+		default:
+			bad("versionMismatch must be warn, fail or ignore, got %q", b.VersionMismatch)
+		}
+		if _, err := b.schedule(); err != nil {
+			bad("%v", err)
+		}
+		switch b.PruneSource {
+		case "", "list", "partitions":
+		case "inventory":
+			if cfg.Destinations[b.Destination].Inventory.Location == "" {
+				bad("pruneSource inventory needs inventory.location on destination %q", b.Destination)
+			}
+		default:
+			bad("pruneSource must be list, inventory or partitions, got %q", b.PruneSource)
+		}
+		if b.MinDumpSize > 0 && b.MaxDumpSize > 0 && b.MinDumpSize > b.MaxDumpSize {
+			bad("minDumpSize %s is above maxDumpSize %s", b.MinDumpSize, b.MaxDumpSize)
+		}
+		for _, p := range append(append([]string(nil), b.Include...), b.Exclude...) {
+			if _, err := path.Match(p, ""); err != nil {
+				bad("invalid include/exclude pattern %q", p)
+			}
+		}
+		for j := range b.SuppressAlertsDuring {
+			if err := b.SuppressAlertsDuring[j].validate(); err != nil {
+				bad("suppressAlertsDuring[%d]: %v", j, err)
+			}
+		}
+		if b.StaleGrace != 0 && b.StaleGrace < 1 {
+			bad("staleGrace must be at least 1, got %g", b.StaleGrace)
+		}
+		if b.ParallelUploads < 0 {
+			bad("parallelUploads must not be negative")
+		}
+		if b.ParallelUploads > 0 && (!b.Discover || b.Bundle) && len(b.Parts) == 0 {
+			bad("parallelUploads needs parts, or discover: true without bundle")
+		}
+		if !b.Discover && (b.Bundle || len(b.Include) > 0 || len(b.Exclude) > 0) {
+			bad("bundle, include and exclude need discover: true")
+		}
+		if len(b.Rules) > 0 && (!b.Discover || b.Bundle) {
+			bad("rules need discover: true without bundle")
+		}
+		if b.Bundle {
+			if b.Compression != "" || b.pgDumpCompress != "" {
+				bad("bundles are always zstd-compressed, remove compression")
+			}
+			if b.MaxDbSize > 0 {
+				bad("maxDbSize is not supported with bundle")
 			}
-			basePrefix := filepath.Join(strings.Trim(dest.Prefix, "/"), dbname) + "/"
+			if _, err := exec.LookPath("zstd"); err != nil {
+				bad("bundle: %v", err)
+			}
+		}
+	}
+	errs = append(errs, validateTiers(cfg)...)
+	errs = append(errs, validateLabels(cfg.Labels, cfg.Backups)...)
+	return errors.Join(errs...)
+}
 
-			ts := time.Now().UTC().Format("20060102T150405Z")
-			key := basePrefix + "pgdump-" + ts + ".dump"
+var tierPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
 
-			if err := awsCp(dest.Endpoint, dest.Region, dest.Access, dest.Secret, dest.Bucket, key, out); err != nil {
-				log.Printf("[backup] upload failed: %v", err)
-				return
+// validateTiers checks that tiers and backup prefixes keep every backup's
+// retention to itself. A tier is a single path segment other than archive,
+// and must not shadow an untiered database prefix on the same destination;
+// a backup prefix is one or more such segments. Backups sharing a
+// prefix and dump mode prune each other's dumps, so they must agree on
+// maxHistory.
+func validateTiers(cfg *Config) []error {
+	var errs []error
+	untiered := map[[2]string]bool{}
+	for _, b := range cfg.Backups {
+		if b.Tier == "" && !(b.Discover && !b.Bundle) {
+			untiered[[2]string{b.Destination, path.Join(b.Prefix, b.keyName())}] = true
+		}
+		if b.Prefix == "" {
+			continue
+		}
+		for _, seg := range strings.Split(strings.Trim(b.Prefix, "/"), "/") {
+			if !tierPattern.MatchString(seg) || seg == "archive" {
+				errs = append(errs, fmt.Errorf("backup %q: prefix %q must be /-separated letters, digits, _ or -, and not contain archive", b.Name, b.Prefix))
+				break
 			}
-			log.Printf("[backup] uploaded s3://%s/%s", dest.Bucket, key)
-
-			if _, err := os.Stat("/backups"); err == nil {
-				_ = os.Rename(out, filepath.Join("/backups", filepath.Base(out)))
+		}
+		if cfg.Destinations[b.Destination].Type == "restic" {
+			errs = append(errs, fmt.Errorf("backup %q: prefix is not supported on restic destinations", b.Name))
+		}
+	}
+	type space struct{ dest, prefix, mode string }
+	seen := map[space]Backup{}
+	for _, b := range cfg.Backups {
+		if b.Tier != "" {
+			switch {
+			case !tierPattern.MatchString(b.Tier):
+				errs = append(errs, fmt.Errorf("backup %q: tier %q must be letters, digits, _ or -", b.Name, b.Tier))
+			case b.Tier == "archive":
+				errs = append(errs, fmt.Errorf("backup %q: tier archive is reserved for archive copies", b.Name))
+			case untiered[[2]string{b.Destination, path.Join(b.Prefix, b.Tier)}]:
+				errs = append(errs, fmt.Errorf("backup %q: tier %q is also the prefix of an untiered backup on destination %q", b.Name, b.Tier, b.Destination))
+			case cfg.Destinations[b.Destination].Type == "restic":
+				errs = append(errs, fmt.Errorf("backup %q: tier is not supported on restic destinations", b.Name))
 			}
+		}
+		if !b.hasRetention() || (b.Discover && !b.Bundle) || len(b.Parts) > 0 {
+			continue
+		}
+		k := space{b.Destination, basePrefix(b, cfg.Destinations[b.Destination]), b.dumpPrefix()}
+		if other, ok := seen[k]; ok && other.retention() != b.retention() {
+			errs = append(errs, fmt.Errorf("backups %q and %q prune the same dumps under %s with different retention (%s and %s); give them different tiers or the same retention",
+				other.Name, b.Name, k.prefix, other.retention(), b.retention()))
+		}
+		seen[k] = b
+	}
+	return errs
+}
 
-			if b.MaxHistory > 0 {
-				pruneHistory(dest, basePrefix, b.MaxHistory)
-			}
-		})
-		if err != nil {
-			log.Fatalf("schedule %q: %v", b.Schedule, err)
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// scheduleSpec returns the cron spec for the backup, translating interval
+// into an @every descriptor.
+func (b Backup) scheduleSpec() (string, error) {
+	switch {
+	case b.Schedule != "" && b.Interval != 0:
+		return "", fmt.Errorf("set either schedule or interval, not both")
+	case b.Interval < 0:
+		return "", fmt.Errorf("interval must be positive")
+	case b.Interval > 0:
+		return "@every " + b.Interval.String(), nil
+	case b.Schedule == "":
+		return "", fmt.Errorf("one of schedule or interval is required")
+	}
+	return b.Schedule, nil
+}
+
+func (b Backup) schedule() (cron.Schedule, error) {
+	spec, err := b.scheduleSpec()
+	if err != nil {
+		return nil, err
+	}
+	sched, err := cronParser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", spec, err)
+	}
+	return sched, nil
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			os.Exit(restoreCmd(os.Args[2:]))
+		case "--version", "version":
+			fmt.Println(versionString())
+			return
+		case "run", "--once":
+			os.Exit(runOnceCmd(os.Args[2:]))
+		case "print-config", "--print-config":
+			os.Exit(printConfigCmd(os.Args[2:]))
+		case "audit":
+			os.Exit(auditCmd(os.Args[2:]))
+		case "test":
+			os.Exit(testCmd(os.Args[2:]))
+		case "dump":
+			os.Exit(dumpCmd(os.Args[2:]))
+		case "benchmark":
+			os.Exit(benchmarkCmd(os.Args[2:]))
+		}
+	}
+
+	log.Printf("starting %s", versionString())
+
+	// Configuration problems are fatal only here, before the daemon is up.
+	// After that nothing a single backup does may exit the process: runtime
+	// failures are reported per run and a bad reload keeps the old config.
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	trig, err := triggerSignal()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setNotifier(cfg.Notify)
+	setLabels(cfg.Labels, cfg.Backups)
+
+	if addr := os.Getenv("HTTP_ADDR"); addr != "" {
+		go serveHTTP(addr)
+	}
+
+	ctx := context.Background()
+	// Collected before anything is scheduled, so no new run's workspace is
+	// taken for an interrupted one.
+	go resumeUploads(ctx, cfg, interruptedWorkspaces())
+
+	d := &daemon{}
+	d.start(cfg)
+
+	if os.Getenv("PRUNE_ON_START") == "true" {
+		log.Printf("[prune] PRUNE_ON_START set, pruning all backups")
+		go pruneAll(ctx, cfg)
+	}
+
+	runAll := os.Getenv("RUN_ON_START") == "true"
+	jobs := d.jobs
+	onStart := map[*job]bool{}
+	for _, j := range jobs {
+		if runAll || j.b.RunOnStart {
+			onStart[j] = true
 		}
 	}
+	go func() {
+		// Catch-up runs only start once every backup is checked, so
+		// they all go by priority with the runOnStart ones.
+		catchUp := catchUps(ctx, jobs, onStart)
+		var run []*job
+		for _, j := range jobs {
+			if onStart[j] || catchUp[j] {
+				run = append(run, j)
+			}
+		}
+		runAllOnStart(run)
+	}()
 
 	log.Printf("scheduler running…")
-	c.Run()
+	d.waitForSignals(trig)
 }
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestDbName(t *testing.T) {
+	for _, tc := range []struct{ conn, want string }{
+		{"postgres://u:p@db:5432/app", "app"},
+		{"postgres://u:p@db:5432/app?sslmode=require", "app"},
+		{"postgresql://u:p@db/app?sslmode=require&connect_timeout=10", "app"},
+		{"postgres://u:p@db/app?dbname=other", "other"},
+		{"postgres://u:p@db:5432", "all"},
+		{"postgres://u:p@db:5432/", "all"},
+		{"postgres://u:p@db:5432/?sslmode=disable", "all"},
+		{"postgres://u:p@db/my%20db", "my db"},
+		{"postgres://u:p@db/caf%C3%A9", "café"},
+		{"postgres://u:p@db/app-v2_test.1", "app-v2_test.1"},
+		{"postgres://u:p%40ss@db/app", "app"},
+		{"postgres://u@%2Fvar%2Frun%2Fpostgresql/app", "app"},
+		{"postgres://u@%2Fvar%2Frun%2Fpostgresql/my%2Ddb?sslmode=disable", "my-db"},
+		{"host=db port=5432 dbname=app user=u", "app"},
+		{"host=db dbname='app' sslmode=require", "app"},
+		{"host=db user=u", "all"},
+	} {
+		if got := dbName(tc.conn); got != tc.want {
+			t.Errorf("dbName(%q) = %q, want %q", tc.conn, got, tc.want)
+		}
+	}
+}
+
+func TestExpandEnvStrictKeepsDollarSecrets(t *testing.T) {
+	t.Setenv("PG_PASSWORD", "pa$$w0rd$HOME${X}")
+	t.Setenv("PG_HOST", "db")
+	t.Setenv("SECRET", "leaked")
+	in := `url: postgres://app:${PG_PASSWORD}@${PG_HOST}/app
+password: "s3cr$t$SECRET"
+escaped: "pa$$word"
+match: "^app_.*$"
+`
+	want := `url: postgres://app:pa$$w0rd$HOME${X}@db/app
+password: "s3cr$t$SECRET"
+escaped: "pa$word"
+match: "^app_.*$"
+`
+	got, err := expandEnvStrict(in, []string{"PG_*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("expandEnvStrict:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExpandEnvStrictUnset(t *testing.T) {
+	if _, err := expandEnvStrict("url: ${PG_UNSET_URL}", []string{"PG_UNSET_URL"}); err == nil {
+		t.Error("unset allowed variable: no error")
+	}
+	got, err := expandEnvStrict("url: ${PG_UNSET_URL:-postgres://db/app}", []string{"PG_UNSET_URL"})
+	if err != nil || got != "url: postgres://db/app" {
+		t.Errorf("default: got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultMaintenanceStatement = "VACUUM ANALYZE"
+	defaultMaintenanceTimeout   = time.Hour
+)
+
+// Maintenance is a statement run against the database after a successful
+// backup, e.g. to piggyback VACUUM on the backup window. Written as a plain
+// string it is just the statement.
+type Maintenance struct {
+	Statement string        `yaml:"statement"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+func (m *Maintenance) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		m.Statement = n.Value
+		return nil
+	}
+	type plain Maintenance
+	return n.Decode((*plain)(m))
+}
+
+func (m Maintenance) statement() string {
+	if m.Statement == "" {
+		return defaultMaintenanceStatement
+	}
+	return m.Statement
+}
+
+func (m Maintenance) timeout() time.Duration {
+	if m.Timeout <= 0 {
+		return defaultMaintenanceTimeout
+	}
+	return m.Timeout
+}
+
+// runMaintenance runs the backup's postMaintenance statement. The server
+// enforces the timeout through statement_timeout; psql is killed shortly
+// after in case the server doesn't. Each -c runs in its own transaction, as
+// VACUUM requires.
+func runMaintenance(ctx context.Context, b Backup) error {
+	m := *b.PostMaintenance
+	env, err := pgEnv(b)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.timeout()+30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binPath(b.PsqlPath, "psql"), "-X", "-q", "-v", "ON_ERROR_STOP=1",
+		"-c", fmt.Sprintf("SET statement_timeout = %d", m.timeout().Milliseconds()),
+		"-c", m.statement())
+	cmd.Env = env
+	_, err = outputCaptured(cmd)
+	return err
+}
+
+// postMaintenance runs and logs the maintenance statement. A failure is
+// reported but never fails the backup, which already succeeded.
+func postMaintenance(ctx context.Context, b Backup) {
+	started := time.Now()
+	log.Printf("[maintenance] %s: running %q (timeout %s)", b.Name, b.PostMaintenance.statement(), b.PostMaintenance.timeout())
+	err := runMaintenance(ctx, b)
+	took := time.Since(started).Round(time.Second)
+	if err == nil {
+		log.Printf("[maintenance] %s: finished in %s", b.Name, took)
+		return
+	}
+	log.Printf("[maintenance] WARNING: %s: failed after %s: %v", b.Name, took, err)
+	notify("maintenance_failed", fmt.Sprintf("post-backup maintenance for %s failed: %v", b.Name, err), map[string]any{
+		"backup":    b.Name,
+		"statement": b.PostMaintenance.statement(),
+		"error":     err.Error(),
+		"duration":  took.Seconds(),
+	})
+}
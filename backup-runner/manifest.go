@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Manifest is the JSON document uploaded next to a dump when writeManifest is
+// enabled, making the bucket self-describing for listing and restore tooling.
+type Manifest struct {
+	Backup        string    `json:"backup"`
+	Database      string    `json:"database"`
+	Key           string    `json:"key"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	ServerVersion string    `json:"serverVersion,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	FinishedAt    time.Time `json:"finishedAt"`
+	ToolVersion   string    `json:"toolVersion"`
+	Format        string    `json:"format"`
+	Mode          string    `json:"mode"`
+	Compression   string    `json:"compression"`
+	// Compressed is false when the dump was stored uncompressed, being
+	// below compressMinSize.
+	Compressed bool `json:"compressed"`
+	// UncompressedSize is the dump's size before the external compressor,
+	// when there was one.
+	UncompressedSize int64  `json:"uncompressedSize,omitempty"`
+	Encryption       string `json:"encryption"`
+	// Pipeline describes how the stored object was made, for restore to
+	// reverse; see pipeline.go.
+	Pipeline *Pipeline `json:"pipeline,omitempty"`
+	// Description is the backup's description, DatabaseComment the
+	// database's COMMENT ON DATABASE (with databaseComment).
+	Description     string `json:"description,omitempty"`
+	DatabaseComment string `json:"databaseComment,omitempty"`
+	// ExcludedTableData are the patterns of tables whose rows the dump
+	// doesn't contain.
+	ExcludedTableData []string `json:"excludedTableData,omitempty"`
+	// UserTables is how many tables outside the system schemas the
+	// database had, unset if it couldn't be counted.
+	UserTables *int `json:"userTables,omitempty"`
+	// Part and Snapshot are the part of a backup with parts and the
+	// snapshot it shares with the other parts of the same run, Parts the
+	// names of all of them.
+	Part     string   `json:"part,omitempty"`
+	Snapshot string   `json:"snapshot,omitempty"`
+	Parts    []string `json:"parts,omitempty"`
+	// WalLSN is the server's WAL position before the dump, recorded with
+	// skipUnchanged.
+	WalLSN string `json:"walLsn,omitempty"`
+}
+
+// manifestKey returns the manifest key belonging to a dump key.
+func manifestKey(dumpKey string) string {
+	base, _ := trimDumpExt(dumpKey)
+	return base + ".json"
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func dumpMode(b Backup) string {
+	switch {
+	case b.SchemaOnly:
+		return "schema-only"
+	case b.DataOnly:
+		return "data-only"
+	}
+	return "full"
+}
+
+func manifestCompression(b Backup, path string) string {
+	if b.Bundle {
+		return "zstd"
+	}
+	if !b.compressed(path) {
+		return "none"
+	}
+	if strings.HasPrefix(b.pgDumpCompress, "zstd") {
+		return "pg_dump zstd"
+	}
+	if b.Compression == "" {
+		return "pg_dump default (zlib)"
+	}
+	return b.Compression
+}
+
+func manifestFormat(b Backup) string {
+	if b.Bundle {
+		return "bundle"
+	}
+	return "custom"
+}
+
+// databaseCommentQuery reads the COMMENT ON DATABASE of the connected
+// database, empty if there is none.
+const databaseCommentQuery = "SELECT coalesce(shobj_description(oid, 'pg_database'), '') FROM pg_database WHERE datname = current_database()"
+
+// buildManifest describes the dump at path. The server version, database
+// comment and table count are best effort; a failed query leaves them empty rather than
+// failing the backup.
+func buildManifest(ctx context.Context, b Backup, key, path string, res RunResult) (Manifest, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	serverVersion, _ := psqlQuery(ctx, b, "SHOW server_version")
+	var comment string
+	var tables *int
+	// A bundle's URL is the maintenance database, whose comment and
+	// tables say nothing about the bundle.
+	if !b.Bundle {
+		if b.DatabaseComment {
+			comment, _ = psqlQuery(ctx, b, databaseCommentQuery)
+		}
+		if n, err := userTableCount(ctx, b); err == nil {
+			tables = &n
+		}
+	}
+	return Manifest{
+		Backup:            b.Name,
+		Database:          b.prefixName(),
+		Key:               key,
+		Size:              st.Size(),
+		SHA256:            sum,
+		ServerVersion:     serverVersion,
+		StartedAt:         res.Started.UTC(),
+		FinishedAt:        time.Now().UTC(),
+		ToolVersion:       version,
+		Format:            manifestFormat(b),
+		Mode:              dumpMode(b),
+		Compression:       manifestCompression(b, path),
+		Compressed:        b.compressed(path),
+		UncompressedSize:  res.RawSize,
+		Encryption:        "none",
+		Pipeline:          pipelineOf(b, path),
+		Description:       b.Description,
+		DatabaseComment:   comment,
+		ExcludedTableData: b.ExcludeTableData,
+		UserTables:        tables,
+		Part:              b.part,
+		Snapshot:          b.snapshot,
+		Parts:             b.partNames,
+		WalLSN:            res.WalLSN,
+	}, nil
+}
+
+// describe is the description and database comment of m, for listings.
+func (m Manifest) describe() string {
+	switch {
+	case m.Description == "":
+		return m.DatabaseComment
+	case m.DatabaseComment == "" || m.DatabaseComment == m.Description:
+		return m.Description
+	}
+	return m.Description + " / " + m.DatabaseComment
+}
+
+// fetchManifest downloads and parses the manifest of the dump at key.
+func fetchManifest(ctx context.Context, dest Destination, key string) (Manifest, error) {
+	var m Manifest
+	f, err := os.CreateTemp("", "pgbackup-manifest-")
+	if err != nil {
+		return m, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	ctx, cancel := dest.opContext(ctx, time.Minute)
+	defer cancel()
+	if err := dest.store().get(ctx, manifestKey(key), f.Name()); err != nil {
+		return m, err
+	}
+	body, err := os.ReadFile(f.Name())
+	if err == nil {
+		err = json.Unmarshal(body, &m)
+	}
+	return m, err
+}
+
+// manifestDescription describes the dump at key from its manifest, or
+// returns "" if there is none or it can't be read.
+func manifestDescription(ctx context.Context, dest Destination, key string) string {
+	m, err := fetchManifest(ctx, dest, key)
+	if err != nil {
+		return ""
+	}
+	return m.describe()
+}
+
+// writeManifestFile writes m as JSON next to the dump and returns its path.
+func writeManifestFile(m Manifest, dumpPath string) (string, error) {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := manifestKey(dumpPath)
+	return path, os.WriteFile(path, body, 0o600)
+}
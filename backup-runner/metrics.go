@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+   Minimal Prometheus text exposition. A handful of counters and gauges don't
+   justify pulling in client_golang, so metrics are kept in plain maps keyed by
+   their rendered label set and written out on scrape.
+*/
+
+type metricVec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var registry []*metricVec
+
+func newMetric(typ, name, help string, labels ...string) *metricVec {
+	m := &metricVec{name: name, help: help, typ: typ, labels: labels, values: map[string]float64{}}
+	registry = append(registry, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetric("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetric("gauge", name, help, labels...)
+}
+
+func (m *metricVec) key(lvs []string) string {
+	if len(lvs) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(lvs), len(m.labels)))
+	}
+	parts := make([]string, len(lvs))
+	for i, v := range lvs {
+		parts[i] = m.labels[i] + `="` + escapeLabel(v) + `"`
+	}
+	if len(m.labels) > 0 && m.labels[0] == "backup" {
+		parts = append(parts, metricLabelPairs(lvs[0])...)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *metricVec) Add(v float64, lvs ...string) {
+	k := m.key(lvs)
+	m.mu.Lock()
+	m.values[k] += v
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Inc(lvs ...string) { m.Add(1, lvs...) }
+
+func (m *metricVec) Set(v float64, lvs ...string) {
+	k := m.key(lvs)
+	m.mu.Lock()
+	m.values[k] = v
+	m.mu.Unlock()
+}
+
+// Reset drops every series, for gauges recomputed from scratch.
+func (m *metricVec) Reset() {
+	m.mu.Lock()
+	m.values = map[string]float64{}
+	m.mu.Unlock()
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range registry {
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.values))
+		for k := range m.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, k := range keys {
+			v := strconv.FormatFloat(m.values[k], 'g', -1, 64)
+			if k == "" {
+				fmt.Fprintf(w, "%s %s\n", m.name, v)
+			} else {
+				fmt.Fprintf(w, "%s{%s} %s\n", m.name, k, v)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+var (
+	prunedObjects    = newCounter("pgbackup_pruned_objects_total", "Objects deleted by retention pruning.", "backup")
+	prunedBytes      = newCounter("pgbackup_pruned_bytes_total", "Bytes freed by retention pruning.", "backup")
+	runsTotal        = newCounter("pgbackup_runs_total", "Backup runs by result (success, failed, skipped).", "backup", "result")
+	lastSuccess      = newGauge("pgbackup_last_success_timestamp_seconds", "Unix time of the last successful run.", "backup")
+	lastDuration     = newGauge("pgbackup_last_duration_seconds", "Duration of the last successful run.", "backup")
+	lastSize         = newGauge("pgbackup_last_size_bytes", "Size of the last successful dump as uploaded.", "backup")
+	compressionRatio = newGauge("pgbackup_compression_ratio", "Uncompressed over compressed size of the last successful dump with an external compressor.", "backup")
+	pruneFailures    = newCounter("pgbackup_prune_failures_total", "Prunes that failed after a successful backup.", "backup")
+)
+
+func serveHTTP(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		updateStale()
+		writeMetrics(w)
+	})
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/version", versionHandler)
+	log.Printf("http listening on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Printf("http server: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Notify struct {
+	Webhook   string `yaml:"webhook"`
+	OnPrune   bool   `yaml:"onPrune"`
+	OnFailure bool   `yaml:"onFailure"`
+	OnSuccess bool   `yaml:"onSuccess"`
+}
+
+// notifyCfg holds the active notification settings. It is swapped as a
+// whole on config reload, so readers go through notifier().
+var notifyCfg atomic.Pointer[Notify]
+
+func notifier() Notify {
+	if n := notifyCfg.Load(); n != nil {
+		return *n
+	}
+	return Notify{}
+}
+
+func setNotifier(n Notify) { notifyCfg.Store(&n) }
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify posts a JSON event to the configured webhook. The payload carries a
+// human readable "text" field so Slack-style incoming webhooks render it as-is.
+func notify(event, text string, fields map[string]any) {
+	n := notifier()
+	if n.Webhook == "" || suppressed(event, fields) {
+		return
+	}
+	payload := map[string]any{}
+	for k, v := range fields {
+		payload[k] = v
+	}
+	if name, ok := fields["backup"].(string); ok {
+		if l := backupLabels(name); len(l) > 0 {
+			payload["labels"] = l
+		}
+	}
+	payload["event"] = event
+	payload["text"] = text
+	payload["time"] = time.Now().UTC().Format(time.RFC3339)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[notify] encode %s: %v", event, err)
+		return
+	}
+	resp, err := notifyClient.Post(n.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[notify] %s: %v", event, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[notify] %s: %v", event, fmt.Errorf("webhook returned %s", resp.Status))
+	}
+}
+
+// heartbeat pings the backup's dead-man's-switch URL: the URL itself on
+// success, or URL/fail on failure (the healthchecks.io convention). It is
+// bounded by the client timeout so a slow endpoint never holds up a backup.
+func heartbeat(b Backup, ok bool) {
+	if b.HeartbeatURL == "" {
+		return
+	}
+	url := b.HeartbeatURL
+	if !ok {
+		url = strings.TrimRight(url, "/") + "/fail"
+	}
+	resp, err := notifyClient.Get(url)
+	if err != nil {
+		log.Printf("[heartbeat] %s: %v", b.Name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("[heartbeat] %s: %s returned %s", b.Name, url, resp.Status)
+	}
+}
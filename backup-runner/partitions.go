@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+   Partitioned listing as a prune source. Dump keys carry their timestamp
+   right after the name prefix (pgdump-20240131T020000Z.dump), so the keys
+   of one day or month share a prefix that list-objects-v2 can filter on
+   server side. With pruneSource: partitions, retention remembers the oldest
+   dump still there after each prune; everything older is gone, so the next
+   prune lists only the day (or, for spans over partitionDayLimit days, the
+   month) prefixes from that dump onwards instead of the whole backup prefix
+   with its full history, archive and other objects. The first prune after
+   startup lists everything to find the floor.
+   Like the inventory, a partial listing can only ever make a prune delete
+   less than a full one would.
+*/
+
+const (
+	// partitionDayLimit is the most day prefixes listed before switching
+	// to month prefixes.
+	partitionDayLimit = 31
+	// partitionMargin moves the floor back to cover dumps that were running
+	// while it was set and are uploaded with an older timestamp.
+	partitionMargin = 24 * time.Hour
+)
+
+var (
+	floorMu     sync.Mutex
+	pruneFloors = map[string]time.Time{}
+)
+
+func floorKey(b Backup, basePrefix string) string { return b.Name + "\x00" + basePrefix }
+
+// partitionPrefixes returns the prefixes a prune of b under basePrefix has
+// to list at now, or false if it has to list basePrefix in full.
+func partitionPrefixes(b Backup, basePrefix string, now time.Time) ([]string, bool) {
+	floorMu.Lock()
+	floor, ok := pruneFloors[floorKey(b, basePrefix)]
+	floorMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return datePartitions(basePrefix+b.dumpPrefix(), floor.Add(-partitionMargin), now), true
+}
+
+// datePartitions lists prefix followed by every day from from to to, or
+// every month if that is too many days.
+func datePartitions(prefix string, from, to time.Time) []string {
+	from, to = from.UTC(), to.UTC()
+	day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	if to.Sub(day) <= partitionDayLimit*24*time.Hour {
+		var out []string
+		for ; !day.After(to); day = day.AddDate(0, 0, 1) {
+			out = append(out, prefix+day.Format("20060102"))
+		}
+		return out
+	}
+	var out []string
+	for month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !month.After(to); month = month.AddDate(0, 1, 0) {
+		out = append(out, prefix+month.Format("200601"))
+	}
+	return out
+}
+
+// setPruneFloor records the oldest of dumps that isn't in deleted as where
+// the next partitioned listing starts. Without any dumps left there is no
+// floor, and the next prune lists everything.
+func setPruneFloor(b Backup, basePrefix string, dumps []s3Object, deleted []string) {
+	gone := make(map[string]bool, len(deleted))
+	for _, k := range deleted {
+		gone[k] = true
+	}
+	var floor time.Time
+	for _, o := range dumps {
+		t, ok := dumpTime(o.Key, b.dumpPrefix())
+		if !ok || gone[o.Key] {
+			continue
+		}
+		if floor.IsZero() || t.Before(floor) {
+			floor = t
+		}
+	}
+	floorMu.Lock()
+	defer floorMu.Unlock()
+	if floor.IsZero() {
+		delete(pruneFloors, floorKey(b, basePrefix))
+		return
+	}
+	pruneFloors[floorKey(b, basePrefix)] = floor
+}
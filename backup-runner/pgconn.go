@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+   Connection strings are configured as URLs (or libpq keyword/value strings)
+   but handed to pg_dump and psql as PG* environment variables, so the
+   password never shows up in a command line that `ps` can read. The URL is
+   split by hand rather than with net/url, which rejects forms libpq accepts:
+   multiple hosts (h1:5432,h2:5433) and percent-encoded socket directories.
+*/
+
+// pgEnvVars maps libpq connection keywords to their environment variables.
+var pgEnvVars = map[string]string{
+	"host":                 "PGHOST",
+	"hostaddr":             "PGHOSTADDR",
+	"port":                 "PGPORT",
+	"dbname":               "PGDATABASE",
+	"user":                 "PGUSER",
+	"password":             "PGPASSWORD",
+	"passfile":             "PGPASSFILE",
+	"service":              "PGSERVICE",
+	"options":              "PGOPTIONS",
+	"application_name":     "PGAPPNAME",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"sslmode":              "PGSSLMODE",
+	"sslcert":              "PGSSLCERT",
+	"sslkey":               "PGSSLKEY",
+	"sslrootcert":          "PGSSLROOTCERT",
+	"sslcrl":               "PGSSLCRL",
+	"sslnegotiation":       "PGSSLNEGOTIATION",
+	"sslcompression":       "PGSSLCOMPRESSION",
+	"requirepeer":          "PGREQUIREPEER",
+	"require_auth":         "PGREQUIREAUTH",
+	"channel_binding":      "PGCHANNELBINDING",
+	"gssencmode":           "PGGSSENCMODE",
+	"krbsrvname":           "PGKRBSRVNAME",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+	"load_balance_hosts":   "PGLOADBALANCEHOSTS",
+}
+
+// parseConn splits a postgres:// URL or a keyword/value string into libpq
+// keywords.
+func parseConn(conn string) (map[string]string, error) {
+	kw := map[string]string{}
+	rest, ok := strings.CutPrefix(conn, "postgresql://")
+	if !ok {
+		rest, ok = strings.CutPrefix(conn, "postgres://")
+	}
+	if !ok {
+		if strings.Contains(conn, "://") {
+			return nil, fmt.Errorf("unsupported scheme in %q", redactConn(conn))
+		}
+		for _, f := range strings.Fields(conn) {
+			k, v, found := strings.Cut(f, "=")
+			if !found {
+				return nil, fmt.Errorf("connection string: %q is not keyword=value", k)
+			}
+			kw[k] = strings.Trim(v, "'")
+		}
+		return kw, checkKeywords(kw)
+	}
+
+	rest, query, _ := strings.Cut(rest, "?")
+	rest, _, _ = strings.Cut(rest, "#")
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		user, pass, hasPass := strings.Cut(rest[:i], ":")
+		rest = rest[i+1:]
+		var err error
+		if kw["user"], err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("connection url: user: %w", err)
+		}
+		if hasPass {
+			if kw["password"], err = url.PathUnescape(pass); err != nil {
+				return nil, fmt.Errorf("connection url: invalid percent-encoding in password")
+			}
+		}
+	}
+	hostspec, path, _ := strings.Cut(rest, "/")
+	if path = strings.Trim(path, "/"); path != "" {
+		db, err := url.PathUnescape(path)
+		if err != nil {
+			return nil, fmt.Errorf("connection url: dbname: %w", err)
+		}
+		kw["dbname"] = db
+	}
+	if hostspec != "" {
+		var hosts, ports []string
+		for _, hp := range strings.Split(hostspec, ",") {
+			host, port := hp, ""
+			if strings.HasPrefix(hp, "[") {
+				if end := strings.Index(hp, "]"); end > 0 {
+					host, port = hp[1:end], strings.TrimPrefix(hp[end+1:], ":")
+				}
+			} else if i := strings.LastIndex(hp, ":"); i >= 0 {
+				host, port = hp[:i], hp[i+1:]
+			}
+			h, err := url.PathUnescape(host)
+			if err != nil {
+				return nil, fmt.Errorf("connection url: host: %w", err)
+			}
+			hosts, ports = append(hosts, h), append(ports, port)
+		}
+		kw["host"] = strings.Join(hosts, ",")
+		if strings.Join(ports, "") != "" {
+			kw["port"] = strings.Join(ports, ",")
+		}
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("connection url: query: %w", err)
+	}
+	for k, v := range q {
+		kw[k] = v[len(v)-1]
+	}
+	for k, v := range kw {
+		if v == "" {
+			delete(kw, k)
+		}
+	}
+	return kw, checkKeywords(kw)
+}
+
+func checkKeywords(kw map[string]string) error {
+	var unknown []string
+	for k := range kw {
+		if _, ok := pgEnvVars[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unsupported connection parameters: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// connEnv translates a connection string into PG* environment variables.
+func connEnv(conn string) ([]string, error) {
+	kw, err := parseConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	env := make([]string, 0, len(kw))
+	for k, v := range kw {
+		env = append(env, pgEnvVars[k]+"="+v)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// passwordParam matches a password keyword, in a URL query or a keyword/value
+// string.
+var passwordParam = regexp.MustCompile(`(^|[\s?&])password\s*=\s*('[^']*'|[^\s&]*)`)
+
+// redactConn masks the password of a connection string for logging.
+func redactConn(conn string) string {
+	conn = passwordParam.ReplaceAllString(conn, "${1}password=***")
+	scheme, rest, ok := strings.Cut(conn, "://")
+	if !ok {
+		return conn
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return conn
+	}
+	user, _, hasPass := strings.Cut(rest[:at], ":")
+	if !hasPass {
+		return conn
+	}
+	return scheme + "://" + user + ":***" + rest[at:]
+}
+
+// withDatabase returns conn with the database it names replaced by db.
+func withDatabase(conn, db string) string {
+	scheme, rest, ok := strings.Cut(conn, "://")
+	if !ok {
+		var fields []string
+		for _, f := range strings.Fields(conn) {
+			if !strings.HasPrefix(f, "dbname=") {
+				fields = append(fields, f)
+			}
+		}
+		return strings.Join(append(fields, "dbname="+db), " ")
+	}
+	rest, query, _ := strings.Cut(rest, "?")
+	rest, _, _ = strings.Cut(rest, "#")
+	authority := rest
+	at := strings.LastIndex(rest, "@") + 1
+	if i := strings.Index(rest[at:], "/"); i >= 0 {
+		authority = rest[:at+i]
+	}
+	out := scheme + "://" + authority + "/" + url.PathEscape(db)
+	if q, err := url.ParseQuery(query); err == nil {
+		q.Del("dbname")
+		query = q.Encode()
+	}
+	if query != "" {
+		out += "?" + query
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConnEnv(t *testing.T) {
+	for _, tc := range []struct {
+		conn string
+		want []string
+	}{
+		{"postgres://app:s3cr%40t@db:5433/app?sslmode=require",
+			[]string{"PGDATABASE=app", "PGHOST=db", "PGPASSWORD=s3cr@t", "PGPORT=5433", "PGSSLMODE=require", "PGUSER=app"}},
+		{"postgresql://app@h1:5432,h2:5433/app?target_session_attrs=read-write",
+			[]string{"PGDATABASE=app", "PGHOST=h1,h2", "PGPORT=5432,5433", "PGTARGETSESSIONATTRS=read-write", "PGUSER=app"}},
+		{"postgres://app@%2Fvar%2Frun%2Fpostgresql/app",
+			[]string{"PGDATABASE=app", "PGHOST=/var/run/postgresql", "PGUSER=app"}},
+		{"host=db dbname=app user=app password=s3cr$t",
+			[]string{"PGDATABASE=app", "PGHOST=db", "PGPASSWORD=s3cr$t", "PGUSER=app"}},
+	} {
+		got, err := connEnv(tc.conn)
+		if err != nil || !slices.Equal(got, tc.want) {
+			t.Errorf("connEnv(%q) = %q, %v, want %q", redactConn(tc.conn), got, err, tc.want)
+		}
+	}
+	if _, err := connEnv("postgres://db/app?bogus=1"); err == nil {
+		t.Error("unknown parameter: no error")
+	}
+}
+
+// The password goes to pg_dump in its environment, never on the command
+// line, where ps would show it.
+func TestPgDumpCommandKeepsPasswordOutOfArgs(t *testing.T) {
+	for _, conn := range []string{
+		"postgres://app:s3cr%40t@db/app",
+		"postgres://app@db/app?password=s3cr%40t",
+		"host=db dbname=app user=app password=s3cr@t",
+	} {
+		b := Backup{Name: "app", URL: conn, Compression: "zstd", ExcludeTableData: []string{"audit.*"}}
+		cmd, err := pgDumpCommand(context.Background(), b, t.TempDir(), append(pgDumpArgs(b), "-f", "/tmp/out.dump"))
+		if err != nil {
+			t.Fatalf("%s: %v", redactConn(conn), err)
+		}
+		for _, a := range cmd.Args {
+			if strings.Contains(a, "s3cr") || strings.Contains(a, "db") && strings.Contains(a, "app") {
+				t.Errorf("%s: argument %q carries the connection", redactConn(conn), a)
+			}
+		}
+		if !slices.Contains(cmd.Env, "PGPASSWORD=s3cr@t") {
+			t.Errorf("%s: PGPASSWORD not in the environment", redactConn(conn))
+		}
+		if !slices.Contains(cmd.Env, "PGHOST=db") || !slices.Contains(cmd.Env, "PGDATABASE=app") {
+			t.Errorf("%s: connection not in the environment", redactConn(conn))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/*
+   Client and server versions. pg_dump is meant to be at least as new as
+   the server it dumps: an older one either refuses or, through wrappers and
+   patched builds, produces dumps that don't restore. Before each dump the
+   server's major version is compared to pg_dump's. An older pg_dump is a
+   mismatch, handled per versionMismatch: warn (the default) logs it, fail
+   fails the run in the precheck phase and ignore skips the check. A newer
+   pg_dump is fine and only noted in the log.
+*/
+
+// serverVersion is the server's version, e.g. 16.2, and its major version
+// from server_version_num, which unlike server_version has no distribution
+// suffix.
+func serverVersion(ctx context.Context, b Backup) (string, int, error) {
+	out, err := psqlQuery(ctx, b, "SELECT current_setting('server_version_num') || ' ' || current_setting('server_version')")
+	if err != nil {
+		return "", 0, err
+	}
+	num, v, _ := strings.Cut(out, " ")
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return "", 0, fmt.Errorf("unexpected server version %q", out)
+	}
+	return v, n / 10000, nil
+}
+
+// checkPgDumpVersion compares the versions of pg_dump and the server of b.
+// It only returns an error for a mismatch with versionMismatch fail; when
+// either version can't be determined the dump goes ahead.
+func checkPgDumpVersion(ctx context.Context, b Backup) error {
+	if b.VersionMismatch == "ignore" {
+		return nil
+	}
+	client, err := pgDumpVersion(ctx, b)
+	if err != nil {
+		log.Printf("[backup] %s: version check skipped, pg_dump version unknown: %v", b.Name, err)
+		return nil
+	}
+	clientMajor, _ := majorVersion(client)
+	server, serverMajor, err := serverVersion(ctx, b)
+	if err != nil {
+		log.Printf("[backup] %s: version check skipped, server version unknown: %v", b.Name, err)
+		return nil
+	}
+	switch {
+	case clientMajor > serverMajor:
+		log.Printf("[backup] %s: pg_dump %s is newer than server %s, which is fine", b.Name, client, server)
+	case clientMajor < serverMajor:
+		msg := fmt.Sprintf("pg_dump %s is older than server %s; its dumps may not restore", client, server)
+		if b.VersionMismatch == "fail" {
+			return fmt.Errorf("%s (versionMismatch: fail)", msg)
+		}
+		log.Printf("[backup] WARNING: %s: %s", b.Name, msg)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+/*
+   Pipeline descriptor. The manifest of a dump (writeManifest) records how
+   the stored object was made: the dump format, each layer wrapped around it
+   in the order it was applied (compression, encryption) and how its
+   checksum was taken. Restore reads it and reverses exactly that, checking
+   the checksum first and each layer against the file, rather than guessing
+   from the content; dumps without a manifest, or with one from before the
+   descriptor, are still unwrapped by sniffing. The descriptor is versioned:
+   a dump whose pipeline is newer than this tool understands is refused
+   instead of being half-restored.
+*/
+
+// pipelineVersion is the newest descriptor version this tool writes and
+// reads. It changes only when an older tool would restore a dump wrongly.
+const pipelineVersion = 1
+
+// Pipeline describes how a stored dump was produced.
+type Pipeline struct {
+	Version int `json:"version"`
+	// Format is the innermost dump: custom, tar or sql.
+	Format string `json:"format"`
+	// Layers are in the order they were applied; restore undoes them from
+	// the last.
+	Layers []PipelineLayer `json:"layers"`
+	// Checksum is the algorithm of the manifest's checksum of the stored
+	// object.
+	Checksum string `json:"checksum"`
+}
+
+type PipelineLayer struct {
+	// Type is gzip, zstd or age.
+	Type  string `json:"type"`
+	Level int    `json:"level,omitempty"`
+	// Recipient is the age recipient the dump was encrypted to.
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// pipelineOf describes the finished dump path of b.
+func pipelineOf(b Backup, path string) *Pipeline {
+	p := &Pipeline{Version: pipelineVersion, Format: dumpCustom, Checksum: "sha256"}
+	switch {
+	case b.Bundle:
+		p.Format = dumpTar
+		p.Layers = append(p.Layers, PipelineLayer{Type: layerZstd})
+	case b.Compression == "zstd" && b.compressed(path):
+		p.Layers = append(p.Layers, PipelineLayer{Type: layerZstd, Level: b.CompressionLevel})
+	case b.Compression != "" && b.compressed(path):
+		// pigz writes gzip.
+		p.Layers = append(p.Layers, PipelineLayer{Type: layerGzip, Level: b.CompressionLevel})
+	}
+	return p
+}
+
+// check rejects a descriptor this tool can't reverse.
+func (p *Pipeline) check() error {
+	if p.Version > pipelineVersion || p.Version < 1 {
+		return fmt.Errorf("pipeline version %d is not supported by this version of backup-runner (up to %d); upgrade it to restore this dump", p.Version, pipelineVersion)
+	}
+	if p.Checksum != "" && p.Checksum != "sha256" {
+		return fmt.Errorf("pipeline checksum %q is not supported", p.Checksum)
+	}
+	for _, l := range p.Layers {
+		if _, ok := layerExts[l.Type]; !ok {
+			return fmt.Errorf("pipeline layer %q is not supported", l.Type)
+		}
+	}
+	if !slices.Contains([]string{dumpCustom, dumpTar, dumpSQL}, p.Format) {
+		return fmt.Errorf("pipeline format %q is not supported", p.Format)
+	}
+	return nil
+}
+
+// readPipeline fetches the manifest of key into dir and checks the
+// downloaded dump file against it. It returns nil if the dump has no
+// manifest or the manifest no descriptor.
+func readPipeline(ctx context.Context, dest Destination, key, file, dir string) (*Pipeline, error) {
+	mkey := manifestKey(key)
+	var found bool
+	err := storageOp(ctx, dest, "head "+mkey, 0, func(ctx context.Context) error {
+		var err error
+		found, err = dest.store().exists(ctx, mkey)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	path := filepath.Join(dir, filepath.Base(mkey))
+	err = storageOp(ctx, dest, "download "+mkey, 0, func(ctx context.Context) error {
+		return dest.store().get(ctx, mkey, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", mkey, err)
+	}
+	if m.Pipeline == nil {
+		return nil, nil
+	}
+	if err := m.Pipeline.check(); err != nil {
+		return nil, err
+	}
+	if m.SHA256 != "" {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return nil, err
+		}
+		if sum != m.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch: manifest has sha256 %s, downloaded file has %s", m.SHA256, sum)
+		}
+	}
+	return m.Pipeline, nil
+}
+
+// unwrap undoes the layers of p on file and returns the inner dump and its
+// format. Each layer is checked against the file before it is undone.
+func (p *Pipeline) unwrap(file, ageIdentity string) (string, string, error) {
+	for i := len(p.Layers) - 1; i >= 0; i-- {
+		l := p.Layers[i]
+		got, err := sniffLayer(file)
+		if err != nil {
+			return "", "", err
+		}
+		if got != l.Type {
+			return "", "", fmt.Errorf("pipeline says the next layer is %s, but the file is %s", l.Type, got)
+		}
+		if l.Type == layerAge && ageIdentity == "" && l.Recipient != "" {
+			return "", "", fmt.Errorf("%s is age-encrypted to %s; pass --age-identity", file, l.Recipient)
+		}
+		if file, err = unwrapLayer(file, l.Type, ageIdentity); err != nil {
+			return "", "", err
+		}
+	}
+	got, err := sniffLayer(file)
+	if err != nil {
+		return "", "", err
+	}
+	if got != p.Format {
+		return "", "", fmt.Errorf("pipeline says the dump is %s, but the file is %s", p.Format, got)
+	}
+	log.Printf("[restore] %s: unwrapped %d layers as described by its manifest", filepath.Base(file), len(p.Layers))
+	return file, got, nil
+}
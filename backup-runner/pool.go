@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+/*
+   Worker limit. cron starts every job in its own goroutine, so a burst of
+   schedules firing together means as many pg_dumps at once. With workers
+   set, runs take a slot from runPool first; when all are taken a run either
+   waits in a FIFO queue or, with whenBusy: drop, is skipped with a warning.
+   A waiting run holds its job's overlap lock, so a backup is never queued
+   twice. The limit can change on reload; runs in flight keep their slots.
+*/
+
+var (
+	queueDepth  = newGauge("pgbackup_queue_depth", "Backup runs waiting for a free worker.")
+	workersBusy = newGauge("pgbackup_workers_busy", "Backup runs holding a worker slot.")
+	droppedRuns = newCounter("pgbackup_dropped_runs_total", "Runs skipped because all workers were busy (whenBusy: drop).", "backup")
+)
+
+type pool struct {
+	mu      sync.Mutex
+	limit   int // 0 is unlimited
+	drop    bool
+	running int
+	waiters []chan struct{}
+}
+
+var runPool = &pool{}
+
+// configure sets the worker limit, admitting waiting runs if it grew.
+func (p *pool) configure(limit int, drop bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit, p.drop = limit, drop
+	for len(p.waiters) > 0 && p.free() {
+		p.running++
+		p.admit()
+	}
+	p.publish()
+}
+
+func (p *pool) free() bool { return p.limit <= 0 || p.running < p.limit }
+
+// admit hands a slot to the longest waiting run.
+func (p *pool) admit() {
+	close(p.waiters[0])
+	p.waiters = p.waiters[1:]
+}
+
+func (p *pool) publish() {
+	queueDepth.Set(float64(len(p.waiters)))
+	workersBusy.Set(float64(p.running))
+}
+
+// acquire takes a worker slot for a run of name, waiting for one if needed.
+// It reports false if the run was dropped instead. queued is called once
+// the run has a slot or its place in the queue.
+func (p *pool) acquire(name, trigger string, queued func()) bool {
+	p.mu.Lock()
+	if p.free() {
+		p.running++
+		p.publish()
+		p.mu.Unlock()
+		queued()
+		return true
+	}
+	if p.drop {
+		limit := p.limit
+		p.mu.Unlock()
+		log.Printf("[schedule] WARNING: %s: all %d workers busy, dropping %s run", name, limit, trigger)
+		droppedRuns.Inc(name)
+		return false
+	}
+	ch := make(chan struct{})
+	p.waiters = append(p.waiters, ch)
+	log.Printf("[schedule] %s: all %d workers busy, %s run queued (%d waiting)", name, p.limit, trigger, len(p.waiters))
+	p.publish()
+	p.mu.Unlock()
+	queued()
+	<-ch
+	return true
+}
+
+// release returns a slot, handing it straight to the next waiting run unless
+// the limit shrank below what is running.
+func (p *pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.waiters) > 0 && (p.limit <= 0 || p.running <= p.limit) {
+		p.admit()
+	} else {
+		p.running--
+	}
+	p.publish()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+   print-config shows the config exactly as the runner would use it: after
+   decryption, env expansion, credentials from the environment and
+   validation (schedules expanded into one backup each, names and
+   compressors filled in). Unset options are left out. Secrets are masked unless --show-secrets is
+   given: access keys, session tokens, restic passwords, connection
+   passwords and the paths of webhook and heartbeat URLs, which often are
+   the token.
+*/
+
+const redacted = "***"
+
+func printConfigCmd(args []string) int {
+	fs := flag.NewFlagSet("print-config", flag.ContinueOnError)
+	showSecrets := fs.Bool("show-secrets", false, "print secrets in clear text (local debugging only)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner print-config [--show-secrets]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	// An invalid config is still printed, as that is usually when it is
+	// needed; the problems follow on stderr.
+	verr := validateConfig(&cfg)
+	if !*showSecrets {
+		cfg = redactConfig(cfg)
+	}
+	var doc yaml.Node
+	if err := doc.Encode(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	dropZero(&doc)
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if verr != nil {
+		fmt.Fprintln(os.Stderr, verr)
+		return 2
+	}
+	return 0
+}
+
+// dropZero removes unset fields from mappings, so the output shows what is
+// configured or defaulted rather than every option there is.
+func dropZero(n *yaml.Node) {
+	for _, c := range n.Content {
+		dropZero(c)
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	kept := n.Content[:0]
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if !isZeroNode(n.Content[i+1]) {
+			kept = append(kept, n.Content[i], n.Content[i+1])
+		}
+	}
+	n.Content = kept
+}
+
+func isZeroNode(n *yaml.Node) bool {
+	switch n.Kind {
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(n.Content) == 0
+	case yaml.ScalarNode:
+		switch n.Value {
+		case "", "0s":
+			return true
+		case "0", "false", "null":
+			return n.Tag != "!!str"
+		}
+	}
+	return false
+}
+
+// redactConfig returns a copy of cfg with its secrets masked.
+func redactConfig(cfg Config) Config {
+	dests := make(map[string]Destination, len(cfg.Destinations))
+	for k, d := range cfg.Destinations {
+		d.Access = redactValue(d.Access)
+		d.Secret = redactValue(d.Secret)
+		d.SessionToken = redactValue(d.SessionToken)
+		d.Password = redactValue(d.Password)
+		dests[k] = d
+	}
+	cfg.Destinations = dests
+	backups := make([]Backup, len(cfg.Backups))
+	for i, b := range cfg.Backups {
+		b.URL = redactConn(b.URL)
+		b.HeartbeatURL = redactURLPath(b.HeartbeatURL)
+		backups[i] = b
+	}
+	cfg.Backups = backups
+	cfg.Notify.Webhook = redactURLPath(cfg.Notify.Webhook)
+	cfg.Catalog.URL = redactConn(cfg.Catalog.URL)
+	cfg.Events.URL = redactConn(cfg.Events.URL)
+	return cfg
+}
+
+func redactValue(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactURLPath keeps only the scheme and host of a URL, enough to tell
+// which service it points at.
+func redactURLPath(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return redactValue(s)
+	}
+	if u.Path == "" && u.RawQuery == "" && u.User == nil {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/" + redacted
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+   Replication. A backup with replicateTo copies every uploaded dump (and
+   its manifest) from its destination to a second one, usually a bucket in
+   another region, with a server-side copy: `aws s3 cp s3://... s3://...`
+   has S3 copy the object (CopyObject, or UploadPartCopy above 5GB), so the
+   dump isn't uploaded from here a second time as with fanout.
+
+   The copy is made with the replica's credentials, which must therefore be
+   allowed to read the primary bucket. When the two destinations use
+   different credentials and the replica's are denied that read, the dump
+   is uploaded to the replica from the local file instead, as fanout would,
+   with a warning saying so. Replication never fails the run, the dump
+   being safely on the primary; a failed one is logged and reported under
+   the run's destinations. Retention prunes the replica like the primary
+   after each successful replication, so both keep the same history.
+*/
+
+// resolveReplica checks b's replicateTo and looks up its destination.
+func (b *Backup) resolveReplica(dests map[string]Destination) error {
+	b.replica = nil
+	if b.ReplicateTo == "" {
+		return nil
+	}
+	src := dests[b.Destination]
+	d, ok := dests[b.ReplicateTo]
+	switch {
+	case !ok:
+		return fmt.Errorf("replicateTo: unknown destination %q", b.ReplicateTo)
+	case b.ReplicateTo == b.Destination:
+		return errors.New("replicateTo must differ from destination")
+	case len(b.Fanout) > 0:
+		return errors.New("replicateTo and fanout can't be combined; list the destination under fanout instead")
+	case cmp.Or(src.Type, "s3") != "s3" || cmp.Or(d.Type, "s3") != "s3":
+		return errors.New("replicateTo needs s3 destinations on both sides")
+	case src.Endpoint != d.Endpoint:
+		return errors.New("replicateTo needs both destinations on the same endpoint for a server-side copy; use fanout across services")
+	}
+	b.replica = &fanoutTarget{name: b.ReplicateTo, dest: d}
+	return nil
+}
+
+// sameCredentials reports whether two destinations authenticate as the
+// same identity, as far as the config tells.
+func sameCredentials(a, b Destination) bool {
+	return a.Access == b.Access && a.Secret == b.Secret && a.SessionToken == b.SessionToken
+}
+
+// accessDenied reports whether a failed aws command was refused access.
+func accessDenied(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "AccessDenied") || strings.Contains(msg, "Forbidden")
+}
+
+// replicate copies the dump just uploaded to res.Key, and its manifest, to
+// b's replica. out is the local dump, for the upload fallback. The outcome
+// is recorded in res.Destinations; it returns the replica's side of the
+// upload for retention, or false if the replica misses the dump.
+func replicate(ctx context.Context, b Backup, dest Destination, res *RunResult, out string) (Backup, uploaded, bool) {
+	t := *b.replica
+	rb := b
+	rb.Destination = t.name
+	up := uploaded{basePrefix: basePrefix(rb, t.dest)}
+	key := up.basePrefix + strings.TrimPrefix(res.Key, basePrefix(b, dest))
+	err := admit(rb, t.dest)
+	if err == nil {
+		err = copyToReplica(ctx, rb, dest, t, res, key, out)
+		r := RunResult{Backup: b.Name}
+		if err != nil {
+			r.fail(PhaseUpload, err)
+		}
+		observe(rb, t.dest, r)
+	}
+	if err == nil && t.dest.ObjectLockRetention > 0 {
+		until := time.Now().Add(t.dest.ObjectLockRetention)
+		err = storageOp(ctx, t.dest, "retention "+key, 0, func(ctx context.Context) error {
+			return awsPutRetention(ctx, t.dest, key, t.dest.ObjectLockMode, until)
+		})
+	}
+	res.Destinations = append(res.Destinations, DestinationResult{Destination: t.name, Key: key, Err: err})
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: replicating %s to destination %q failed, the replica misses this dump: %v",
+			b.Name, res.Key, t.name, err)
+		return rb, up, false
+	}
+	log.Printf("[backup] replicated %s to %s", dest.store().url(res.Key), t.dest.store().url(key))
+	return rb, up, true
+}
+
+// copyToReplica copies res.Key to key on the replica t, falling back to
+// uploading out when t's own credentials can't read dest.
+func copyToReplica(ctx context.Context, rb Backup, dest Destination, t fanoutTarget, res *RunResult, key, out string) error {
+	copyObject := func(src, dst string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			args := []string{"s3", "cp", dest.store().url(src), t.dest.store().url(dst), "--only-show-errors"}
+			if dest.Region != "" {
+				args = append(args, "--source-region", dest.Region)
+			}
+			cmd := awsCommand(ctx, t.dest, args...)
+			cmd.Stdout = os.Stdout
+			return runCaptured(cmd, nil)
+		}
+	}
+	// Tried once first: a denied copy is no reason to retry when there is
+	// another way.
+	opCtx, cancel := t.dest.opContext(ctx, 0)
+	err := copyObject(res.Key, key)(opCtx)
+	cancel()
+	switch {
+	case err == nil:
+	case !sameCredentials(dest, t.dest) && accessDenied(err):
+		log.Printf("[backup] WARNING: %s: destination %q can't read %s with its credentials, uploading %s from here instead",
+			rb.Name, t.name, dest.store().url(res.Key), t.dest.store().url(key))
+		err = storageOp(ctx, t.dest, "upload "+key, 0, func(ctx context.Context) error {
+			return t.dest.store().put(ctx, key, out)
+		})
+		if err == nil && rb.WriteManifest {
+			if err := uploadManifest(ctx, rb, t.dest, key, out, *res); err != nil {
+				log.Printf("[backup] manifest upload to destination %q failed: %v", t.name, err)
+			}
+		}
+		return err
+	default:
+		err = storageOp(ctx, t.dest, "replicate "+key, 0, copyObject(res.Key, key))
+	}
+	// Like on the primary, a missing manifest doesn't fail the dump.
+	if err == nil && rb.WriteManifest {
+		if err := storageOp(ctx, t.dest, "replicate "+manifestKey(key), 0, copyObject(manifestKey(res.Key), manifestKey(key))); err != nil {
+			log.Printf("[backup] manifest replication to destination %q failed: %v", t.name, err)
+		}
+	}
+	return err
+}
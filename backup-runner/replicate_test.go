@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A copy that fails once is retried, and the manifest follows the dump.
+func TestReplicateRetriesAndCopiesManifest(t *testing.T) {
+	storageBackoff = time.Millisecond
+	t.Cleanup(func() { storageBackoff = 5 * time.Second })
+	dir := t.TempDir()
+	awsLog := filepath.Join(dir, "aws.log")
+	t.Setenv("AWS_LOG", awsLog)
+	t.Setenv("AWS_FAILED", filepath.Join(dir, "failed"))
+	fakeBins(t, map[string]string{"aws": `echo "$@" >> "$AWS_LOG"
+if [ "$1 $2" = "s3 cp" ] && [ ! -e "$AWS_FAILED" ]; then
+	touch "$AWS_FAILED"; echo "connection reset by peer" >&2; exit 1
+fi`})
+
+	dest := Destination{Bucket: "primary"}
+	b := Backup{Name: "app", URL: "postgres://db/app", Destination: "primary", WriteManifest: true,
+		replica: &fanoutTarget{name: "replica", dest: Destination{Bucket: "replica"}}}
+	key := basePrefix(b, dest) + "pgdump-20260102T030405Z.dump"
+	res := RunResult{Backup: b.Name, Key: key}
+	if _, _, ok := replicate(context.Background(), b, dest, &res, filepath.Join(dir, "pgdump.dump")); !ok {
+		t.Fatalf("replication failed: %v", res.Destinations)
+	}
+
+	body, _ := os.ReadFile(awsLog)
+	var copies []string
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if strings.HasPrefix(line, "s3 cp ") {
+			copies = append(copies, line)
+		}
+	}
+	want := []string{"s3://replica/" + key, "s3://replica/" + key, "s3://replica/" + manifestKey(key)}
+	if len(copies) != len(want) {
+		t.Fatalf("copies:\n%s\nwant the dump twice, then its manifest", strings.Join(copies, "\n"))
+	}
+	for i, w := range want {
+		if !strings.Contains(copies[i], " "+w+" ") {
+			t.Errorf("copy %d = %q, want it to %s", i+1, copies[i], w)
+		}
+	}
+}
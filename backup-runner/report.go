@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+   Run reports. With report.path set, finished runs are written to that file
+   as JSON, for CI jobs and scripts to read instead of parsing logs: the
+   daemon writes one report per run, `run` one report covering every backup
+   it ran. By default each report replaces the file (atomically, so a reader
+   never sees half of one); with append: true reports are added one per line
+   (JSON Lines). schemaVersion changes only when fields change meaning or
+   are removed; new fields may appear at any time.
+*/
+
+const reportSchemaVersion = 1
+
+type Report struct {
+	Path   string `yaml:"path"`
+	Append bool   `yaml:"append"`
+}
+
+type runReport struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	GeneratedAt   time.Time     `json:"generatedAt"`
+	Mode          string        `json:"mode"` // daemon or once
+	Results       []reportEntry `json:"results"`
+}
+
+type reportEntry struct {
+	Backup          string    `json:"backup"`
+	Status          string    `json:"status"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Size            int64     `json:"size"`
+	// UncompressedSize and CompressionRatio are set for dumps compressed
+	// with an external compressor.
+	UncompressedSize int64    `json:"uncompressedSize,omitempty"`
+	CompressionRatio float64  `json:"compressionRatio,omitempty"`
+	Key              string   `json:"key,omitempty"`
+	Phase            Phase    `json:"phase,omitempty"`
+	Error            string   `json:"error,omitempty"`
+	Retryable        bool     `json:"retryable,omitempty"`
+	Stderr           []string `json:"stderr,omitempty"`
+	PruneError       string   `json:"pruneError,omitempty"`
+	LocalCopyError   string   `json:"localCopyError,omitempty"`
+	GlobalsError     string   `json:"globalsError,omitempty"`
+	// Destinations are the per-destination outcomes of a fan-out run.
+	Destinations []destinationEntry `json:"destinations,omitempty"`
+}
+
+func newReportEntry(r RunResult) reportEntry {
+	e := reportEntry{
+		Backup:           r.Backup,
+		Status:           r.status(),
+		Started:          r.Started,
+		DurationSeconds:  r.Duration.Seconds(),
+		Size:             r.Size,
+		UncompressedSize: r.RawSize,
+		CompressionRatio: math.Round(r.compressionRatio()*100) / 100,
+		Key:              r.Key,
+		Stderr:           r.Stderr,
+		Destinations:     destinationEntries(r.Destinations),
+	}
+	if r.Err != nil {
+		e.Phase, e.Error, e.Retryable = r.Phase, r.Err.Error(), r.Retryable
+	}
+	if r.PruneErr != nil {
+		e.PruneError = r.PruneErr.Error()
+	}
+	if r.LocalCopyErr != nil {
+		e.LocalCopyError = r.LocalCopyErr.Error()
+	}
+	if r.GlobalsErr != nil {
+		e.GlobalsError = r.GlobalsErr.Error()
+	}
+	return e
+}
+
+var (
+	reportCfg atomic.Pointer[Report]
+	reportMu  sync.Mutex
+)
+
+func setReport(r Report) { reportCfg.Store(&r) }
+
+// writeReport writes results to the configured report file, if any. A
+// failure is logged; it never affects the runs.
+func writeReport(mode string, results []RunResult) {
+	r := reportCfg.Load()
+	if r == nil || r.Path == "" {
+		return
+	}
+	rep := runReport{SchemaVersion: reportSchemaVersion, GeneratedAt: time.Now().UTC(), Mode: mode}
+	for _, res := range results {
+		rep.Results = append(rep.Results, newReportEntry(res))
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	var err error
+	if r.Append {
+		err = appendReport(r.Path, rep)
+	} else {
+		err = replaceReport(r.Path, rep)
+	}
+	if err != nil {
+		log.Printf("[backup] WARNING: writing run report to %s failed: %v", r.Path, err)
+	}
+}
+
+func appendReport(path string, rep runReport) error {
+	line, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func replaceReport(path string, rep runReport) error {
+	body, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".report-*.json")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(body, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
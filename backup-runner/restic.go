@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+   Restic destinations (type: restic) hand the dump to `restic backup --stdin`
+   instead of uploading an object per run, so daily dumps are deduplicated and
+   encrypted by restic. Every run of a backup uses the same stdin filename,
+   <database>/pgdump.dump (resticFilename), which keeps its snapshots in one
+   group; retention is delegated to
+   `restic forget --keep-last maxHistory --prune`.
+*/
+
+// resticEnv returns the environment for restic commands. Access/Secret are
+// forwarded as AWS credentials for S3-backed repositories.
+func resticEnv(d Destination) []string {
+	env := awsEnv(d)
+	env = append(env, "RESTIC_REPOSITORY="+d.Repository)
+	if d.Password != "" {
+		env = append(env, "RESTIC_PASSWORD="+d.Password)
+	}
+	if d.PasswordFile != "" {
+		env = append(env, "RESTIC_PASSWORD_FILE="+d.PasswordFile)
+	}
+	return env
+}
+
+func resticTag(b Backup) string {
+	return "pg-backup=" + b.Name
+}
+
+// resticFilename is the path b's dumps have in its restic snapshots.
+func resticFilename(b Backup, file string) string {
+	return path.Join(b.prefixName(), strings.TrimSuffix(b.dumpPrefix(), "-")+b.fileDumpExt(file))
+}
+
+func resticBackup(ctx context.Context, b Backup, d Destination, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	cmd := exec.CommandContext(ctx, "restic", "backup",
+		"--stdin", "--stdin-filename", resticFilename(b, file),
+		"--tag", resticTag(b))
+	cmd.Env = resticEnv(d)
+	cmd.Stdin = in
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func resticForget(ctx context.Context, b Backup, d Destination) error {
+	cmd := exec.CommandContext(ctx, "restic", "forget",
+		"--tag", resticTag(b),
+		"--group-by", "tags",
+		"--keep-last", strconv.Itoa(b.MaxHistory),
+		"--prune")
+	cmd.Env = resticEnv(d)
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func pruneRestic(ctx context.Context, b Backup, d Destination) error {
+	err := storageOp(ctx, d, "restic forget "+b.Name, 0, func(ctx context.Context) error {
+		return resticForget(ctx, b, d)
+	})
+	if err != nil {
+		log.Printf("[prune] restic forget failed for %s: %v", b.Name, err)
+		pruneFailures.Inc(b.Name)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func restoreObjects(keys ...string) []s3Object {
+	objs := make([]s3Object, len(keys))
+	for i, k := range keys {
+		objs[i] = s3Object{Key: k, Size: 100}
+	}
+	return objs
+}
+
+func candidateDirs(cs []restoreCandidate) []string {
+	var dirs []string
+	for _, c := range cs {
+		dirs = append(dirs, c.dir()+" "+c.key)
+	}
+	return dirs
+}
+
+// Dumps of one database by backups with different prefixes are kept apart.
+func TestRestoreDumpsByPrefix(t *testing.T) {
+	dumps := restoreDumps(restoreObjects(
+		"pg/team-a/app/pgdump-20240101T020000Z.dump",
+		"pg/team-a/app/pgdump-20240102T020000Z.dump",
+		"pg/team-b/app/pgdump-20240103T020000Z.dump",
+		"pg/app/pgdump-20231231T020000Z.dump.gz",
+		"pg/app/pgdump-20231231T020000Z.json",
+		"pg/team-a/archive/app/pgdump-20230101T020000Z.dump",
+	), "pg/")
+	got := candidateDirs(newestDumps(dumps, time.Time{}))
+	want := []string{
+		"app pg/app/pgdump-20231231T020000Z.dump.gz",
+		"team-a/app pg/team-a/app/pgdump-20240102T020000Z.dump",
+		"team-b/app pg/team-b/app/pgdump-20240103T020000Z.dump",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("newest dumps:\n%q\nwant\n%q", got, want)
+	}
+	if err := ambiguousDatabases(newestDumps(dumps, time.Time{})); err == nil {
+		t.Error("app under three prefixes: not reported as ambiguous")
+	}
+	if got := candidateDirs(withPrefix(newestDumps(dumps, time.Time{}), "/team-a/")); len(got) != 1 || got[0] != want[1] {
+		t.Errorf("withPrefix(team-a) = %q", got)
+	}
+	if err := ambiguousDatabases(withPrefix(newestDumps(dumps, time.Time{}), "team-a")); err != nil {
+		t.Error(err)
+	}
+}
+
+// The parts of a backup with parts are stored as <database>/<part>/ and
+// restored together, per snapshot, into the database.
+func TestGroupParts(t *testing.T) {
+	manifests := map[string]Manifest{
+		"team/app/core/pgdump-20240101T020000Z.dump":  {Database: "app", Part: "core", Snapshot: "S1", Parts: []string{"core", "audit"}},
+		"team/app/audit/pgdump-20240101T020501Z.dump": {Database: "app", Part: "audit", Snapshot: "S1", Parts: []string{"core", "audit"}},
+		// The audit part of the second run failed.
+		"team/app/core/pgdump-20240102T020000Z.dump": {Database: "app", Part: "core", Snapshot: "S2", Parts: []string{"core", "audit"}},
+		"team/other/pgdump-20240102T020000Z.dump":    {Database: "other"},
+	}
+	dumps := restoreDumps(restoreObjects(
+		"team/app/core/pgdump-20231231T020000Z.dump", // from before manifests
+		"team/app/core/pgdump-20240101T020000Z.dump",
+		"team/app/audit/pgdump-20240101T020501Z.dump",
+		"team/app/core/pgdump-20240102T020000Z.dump",
+		"team/other/pgdump-20240102T020000Z.dump",
+	), "")
+	grouped := groupParts(dumps, func(key string) (Manifest, bool) {
+		m, ok := manifests[key]
+		return m, ok
+	})
+	newest := newestDumps(grouped, time.Time{})
+	if got, want := candidateDirs(newest), []string{
+		"team/app team/app/core/pgdump-20240101T020000Z.dump",
+		"team/other team/other/pgdump-20240102T020000Z.dump",
+	}; !slices.Equal(got, want) {
+		t.Fatalf("candidates:\n%q\nwant\n%q", got, want)
+	}
+	app := newest[0]
+	if app.db != "app" || app.prefix != "team" || app.snapshot != "S1" {
+		t.Errorf("app restored as %s under %q from snapshot %s", app.db, app.prefix, app.snapshot)
+	}
+	var parts []string
+	for _, p := range app.parts {
+		parts = append(parts, p.part+" "+p.key)
+	}
+	if want := []string{
+		"core team/app/core/pgdump-20240101T020000Z.dump",
+		"audit team/app/audit/pgdump-20240101T020501Z.dump",
+	}; !slices.Equal(parts, want) {
+		t.Errorf("parts:\n%q\nwant\n%q", parts, want)
+	}
+	if !app.ts.Equal(time.Date(2024, 1, 1, 2, 5, 1, 0, time.UTC)) {
+		t.Errorf("snapshot dated %s, want its newest part's", app.ts)
+	}
+	if err := ambiguousDatabases(newest); err != nil {
+		t.Error(err)
+	}
+}
+
+// restoreParts creates the database from the first part and restores each
+// section from every part before the next.
+func TestRestoreParts(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "pg_restore.log")
+	fake := filepath.Join(dir, "pg_restore")
+	script := "#!/bin/sh\necho \"$*\" >> " + log + "\n"
+	if err := os.WriteFile(fake, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	c := restoreCandidate{db: "app", snapshot: "S1"}
+	for _, part := range []string{"core", "audit"} {
+		file := filepath.Join(dir, part+".dump")
+		if err := os.WriteFile(file, []byte("PGDMP"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		c.parts = append(c.parts, restoreCandidate{db: "app", part: part, key: "app/" + part + "/pgdump.dump", file: file})
+	}
+	err := restoreOne(context.Background(), Destination{}, c, "postgres://admin@db/maint", restoreTools{pgRestore: fake, psql: fake})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, audit := filepath.Join(dir, "core.dump"), filepath.Join(dir, "audit.dump")
+	want := []string{
+		"--section=pre-data --clean --if-exists --create -d maint " + core,
+		"--section=pre-data -d app " + audit,
+		"--section=data -d app " + core,
+		"--section=data -d app " + audit,
+		"--section=post-data -d app " + core,
+		"--section=post-data -d app " + audit,
+	}
+	if got := strings.Split(strings.TrimSpace(string(out)), "\n"); !slices.Equal(got, want) {
+		t.Errorf("pg_restore runs:\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
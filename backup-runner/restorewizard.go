@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+   restore --interactive walks whoever is on call through a restore:
+   destination, database, dump and target are picked from numbered lists,
+   each step skipped when its flag is given. Before anything is touched it
+   shows every dump with its size and age and what pg_restore will drop on
+   which server, and the database name (or "all") has to be typed to go
+   ahead. --yes skips every prompt, taking the newest dumps for whatever the
+   flags leave open, so a rehearsed command line can run unattended.
+*/
+
+// wizardDumps is how many dumps of a database are offered to choose from.
+const wizardDumps = 20
+
+var errAborted = errors.New("aborted")
+
+type restoreWizard struct {
+	cfg Config
+	in  *bufio.Reader
+	out io.Writer
+	yes bool
+	// From the command line; empty means ask.
+	destName string
+	database string
+	// prefix, if not nil, restricts the dumps to one backup prefix.
+	prefix *string
+	target string
+	at     time.Time
+}
+
+func (w *restoreWizard) run(ctx context.Context, tools restoreTools, parallel int) int {
+	dest, chosen, err := w.choose(ctx)
+	if err != nil {
+		if errors.Is(err, errAborted) {
+			fmt.Fprintln(w.out, "Nothing restored.")
+		} else {
+			fmt.Fprintf(w.out, "restore: %v\n", err)
+		}
+		return 1
+	}
+	return restoreCandidates(ctx, dest, chosen, w.database, w.target, tools, parallel)
+}
+
+// choose runs the prompts and returns the dumps to restore.
+func (w *restoreWizard) choose(ctx context.Context) (Destination, []restoreCandidate, error) {
+	if err := w.chooseDestination(); err != nil {
+		return Destination{}, nil, err
+	}
+	dest := w.cfg.Destinations[w.destName]
+	dumps, err := listRestoreDumps(ctx, dest)
+	if err != nil {
+		return dest, nil, fmt.Errorf("list failed: %w", err)
+	}
+	if w.prefix != nil {
+		dumps = withPrefix(dumps, *w.prefix)
+	}
+	var eligible []restoreCandidate
+	for _, c := range dumps {
+		if w.at.IsZero() || !c.ts.After(w.at) {
+			eligible = append(eligible, c)
+		}
+	}
+	if len(eligible) == 0 {
+		return dest, nil, fmt.Errorf("no matching dumps found in %s", dest.store().url(dest.Prefix))
+	}
+	chosen, err := w.chooseDumps(ctx, eligible)
+	if err != nil {
+		return dest, nil, err
+	}
+	if err := w.chooseTarget(); err != nil {
+		return dest, nil, err
+	}
+	if err := w.confirm(dest, chosen); err != nil {
+		return dest, nil, err
+	}
+	return dest, chosen, nil
+}
+
+func (w *restoreWizard) chooseDestination() error {
+	if w.destName != "" {
+		if _, ok := w.cfg.Destinations[w.destName]; !ok {
+			return fmt.Errorf("unknown destination %q", w.destName)
+		}
+		return nil
+	}
+	var names []string
+	for name, d := range w.cfg.Destinations {
+		if d.Type != "restic" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return errors.New("no s3 or b2 destinations configured")
+	}
+	if len(names) == 1 {
+		w.destName = names[0]
+		return nil
+	}
+	if w.yes {
+		return errors.New("--destination is required with --yes when several are configured")
+	}
+	items := make([]string, len(names))
+	for i, name := range names {
+		d := w.cfg.Destinations[name]
+		items[i] = fmt.Sprintf("%s  (%s)", name, d.store().url(d.Prefix))
+	}
+	i, err := w.pick("Destination", items, 0)
+	if err != nil {
+		return err
+	}
+	w.destName = names[i]
+	return nil
+}
+
+// chooseDumps picks either the newest dump of every database or one dump
+// of one database. dumps are grouped by database directory, newest first;
+// a database stored by several backups has a directory under each of their
+// prefixes.
+func (w *restoreWizard) chooseDumps(ctx context.Context, dumps []restoreCandidate) ([]restoreCandidate, error) {
+	var dbs []string
+	newest := map[string]restoreCandidate{}
+	for _, c := range dumps {
+		if _, ok := newest[c.dir()]; !ok {
+			dbs = append(dbs, c.dir())
+			newest[c.dir()] = c
+		}
+	}
+	all := make([]restoreCandidate, 0, len(dbs))
+	for _, db := range dbs {
+		all = append(all, newest[db])
+	}
+
+	var db string
+	if w.database != "" {
+		var dirs []string
+		for _, d := range dbs {
+			if newest[d].db == w.database {
+				dirs = append(dirs, d)
+			}
+		}
+		switch {
+		case len(dirs) == 0:
+			// May be inside a bundle; restoreCandidates narrows it down
+			// once the bundles are unpacked.
+			return all, nil
+		case len(dirs) == 1:
+			db = dirs[0]
+		case w.yes:
+			return nil, fmt.Errorf("%s is stored by more than one backup (%s); choose one with --prefix or --backup",
+				w.database, strings.Join(dirs, ", "))
+		default:
+			i, err := w.pick("Backup of "+w.database, dirs, 0)
+			if err != nil {
+				return nil, err
+			}
+			db = dirs[i]
+		}
+	} else if w.yes {
+		return all, nil
+	} else {
+		items := []string{fmt.Sprintf("all %d, newest dump of each", len(dbs))}
+		dest := w.cfg.Destinations[w.destName]
+		for _, d := range dbs {
+			item := fmt.Sprintf("%s  (newest %s)", d, describeDump(newest[d]))
+			if desc := manifestDescription(ctx, dest, newest[d].key); desc != "" {
+				item += "  " + desc
+			}
+			items = append(items, item)
+		}
+		i, err := w.pick("Database", items, 0)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			return all, nil
+		}
+		db = dbs[i-1]
+	}
+
+	var own []restoreCandidate
+	for _, c := range dumps {
+		if c.dir() == db && len(own) < wizardDumps {
+			own = append(own, c)
+		}
+	}
+	if w.yes || len(own) == 1 {
+		return own[:1], nil
+	}
+	items := make([]string, len(own))
+	for i, c := range own {
+		items[i] = fmt.Sprintf("%s  %s", c.key[strings.LastIndex(c.key, "/")+1:], describeDump(c))
+	}
+	i, err := w.pick("Dump of "+db, items, 0)
+	if err != nil {
+		return nil, err
+	}
+	return own[i : i+1], nil
+}
+
+func (w *restoreWizard) chooseTarget() error {
+	if w.target != "" {
+		_, err := parseConn(w.target)
+		return err
+	}
+	if w.yes {
+		return errors.New("--target is required with --yes")
+	}
+	for {
+		t, err := w.ask("Target cluster (connection URL of its maintenance database, e.g. postgres://user@host:5432/postgres): ")
+		if err != nil {
+			return err
+		}
+		if _, err := parseConn(t); err != nil || t == "" {
+			fmt.Fprintf(w.out, "  not a connection URL: %v\n", err)
+			continue
+		}
+		w.target = t
+		return nil
+	}
+}
+
+// confirm shows what is about to happen and, unless --yes, wants the
+// database name (or "all") typed back.
+func (w *restoreWizard) confirm(dest Destination, chosen []restoreCandidate) error {
+	fmt.Fprintf(w.out, "\nAbout to restore into %s:\n", redactConn(w.target))
+	for _, c := range chosen {
+		what := c.db
+		if c.bundle {
+			what = "every database in bundle " + c.db
+		} else if len(c.parts) > 0 {
+			what = fmt.Sprintf("%s (%d parts)", c.db, len(c.parts))
+		}
+		fmt.Fprintf(w.out, "  %-30s %s  %s\n", what, c.from(dest), describeDump(c))
+	}
+	fmt.Fprintln(w.out, "\npg_restore runs with --clean --create: each database above is DROPPED on the target and")
+	fmt.Fprintln(w.out, "recreated from the dump. Whatever it holds now is lost.")
+	if w.yes {
+		return nil
+	}
+	want := "all"
+	if len(chosen) == 1 && !chosen[0].bundle {
+		want = chosen[0].db
+	}
+	answer, err := w.ask(fmt.Sprintf("\nType %q to restore, anything else to abort: ", want))
+	if err != nil {
+		return err
+	}
+	if answer != want {
+		return errAborted
+	}
+	return nil
+}
+
+// pick shows a numbered list and returns the chosen index; an empty answer
+// takes def.
+func (w *restoreWizard) pick(title string, items []string, def int) (int, error) {
+	fmt.Fprintf(w.out, "\n%s:\n", title)
+	for i, item := range items {
+		fmt.Fprintf(w.out, "  %2d) %s\n", i+1, item)
+	}
+	for {
+		answer, err := w.ask(fmt.Sprintf("Choose 1-%d [%d]: ", len(items), def+1))
+		if err != nil {
+			return 0, err
+		}
+		if answer == "" {
+			return def, nil
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(items) {
+			return n - 1, nil
+		}
+		fmt.Fprintf(w.out, "  enter a number between 1 and %d\n", len(items))
+	}
+}
+
+func (w *restoreWizard) ask(prompt string) (string, error) {
+	fmt.Fprint(w.out, prompt)
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		// No terminal to answer, or Ctrl-D.
+		fmt.Fprintln(w.out)
+		return "", errAborted
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// describeDump is a dump's size and age, for picking between them.
+func describeDump(c restoreCandidate) string {
+	age := time.Since(c.ts).Round(time.Minute)
+	ago := strings.TrimSuffix(age.String(), "0s")
+	if age >= 48*time.Hour {
+		ago = fmt.Sprintf("%dd%dh", age/(24*time.Hour), age%(24*time.Hour)/time.Hour)
+	}
+	return fmt.Sprintf("%s, %s, %s ago", c.ts.Format("2006-01-02 15:04 UTC"), ByteSize(c.size), ago)
+}
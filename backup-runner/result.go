@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Phase is the step of a run that a RunResult's error came from.
+type Phase string
+
+const (
+	PhasePrecheck Phase = "precheck"
+	PhaseDump     Phase = "dump"
+	PhaseCompress Phase = "compress"
+	PhaseUpload   Phase = "upload"
+	PhasePrune    Phase = "prune"
+)
+
+// RunResult is the outcome of one run of a backup. Everything that reports on
+// runs (logs, metrics, notifications, heartbeats) reads it, so they agree on
+// what happened. Err is nil on success; a prune failure is recorded in
+// PruneErr and doesn't fail the run.
+type RunResult struct {
+	Backup    string
+	Key       string
+	Phase     Phase
+	Err       error
+	Retryable bool
+	Skipped   bool
+	Size      int64
+	Started   time.Time
+	Duration  time.Duration
+	PruneErr  error
+	// Stderr is the tail of the failed command's stderr, if one failed.
+	Stderr []string
+	// LocalCopyErr is why the dump wasn't kept in /backups; like PruneErr
+	// it doesn't fail the run.
+	LocalCopyErr error
+	// GlobalsErr is why the globals dump failed; it doesn't fail the run
+	// either.
+	GlobalsErr error
+	// SHA256 is the checksum of the stored dump, only computed for the
+	// catalog.
+	SHA256 string
+	// Destinations are the outcomes per destination of a fan-out run.
+	Destinations []DestinationResult
+	// RawSize is the size of the dump before the compressor, 0 when it
+	// isn't known; see compressionRatio.
+	RawSize int64
+	// WalLSN is the server's WAL position before the dump, with
+	// skipUnchanged. Unchanged marks a run skipped because it hadn't moved.
+	WalLSN    string
+	Unchanged bool
+}
+
+// fail records err as the run's failure in phase.
+func (r *RunResult) fail(phase Phase, err error) {
+	r.Phase, r.Err, r.Retryable = phase, err, isRetryable(phase, err)
+	var ce *cmdError
+	if errors.As(err, &ce) {
+		r.Stderr = ce.stderr
+	}
+}
+
+// compressionRatio is the uncompressed dump size over the stored size, 0
+// when the run didn't compress with an external compressor: pg_dump's own
+// compression doesn't tell how much it wrote before compressing.
+func (r RunResult) compressionRatio() float64 {
+	if r.RawSize <= 0 || r.Size <= 0 {
+		return 0
+	}
+	return float64(r.RawSize) / float64(r.Size)
+}
+
+func (r RunResult) status() string {
+	switch {
+	case r.Skipped:
+		return "skipped"
+	case r.Err != nil:
+		return "failed"
+	}
+	return "success"
+}
+
+// isRetryable reports whether a failure is likely transient, i.e. running the
+// same backup again later may well succeed. Storage errors and timeouts are;
+// a missing binary or a local I/O problem is not. pg_dump exiting non-zero is
+// treated as transient, as it is most often a connection problem.
+func isRetryable(phase Phase, err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return false
+	}
+	switch phase {
+	case PhaseUpload, PhasePrune:
+		return true
+	case PhaseDump:
+		var exitErr *exec.ExitError
+		return errors.As(err, &exitErr)
+	}
+	return false
+}
+
+// report publishes a finished run to the log, metrics, notifications, the
+// backup's heartbeat, the catalog and the event topic.
+func report(b Backup, r RunResult) {
+	runsTotal.Inc(b.Name, r.status())
+	recordLastRun(r)
+	switch {
+	case r.Skipped:
+		log.Printf("[backup] %s skipped%s", b.Name, labelSuffix(b.Name))
+		if r.Unchanged {
+			// The newest dump is still current: not stale, and alive.
+			recordSuccess(b.Name, time.Now())
+			heartbeat(b, true)
+		}
+	case r.Err != nil:
+		log.Printf("[backup] %s failed in %s phase after %s (retryable: %t): %v%s",
+			b.Name, r.Phase, r.Duration.Round(time.Second), r.Retryable, r.Err, labelSuffix(b.Name))
+		// The error already ends with the last stderr line; show the lines
+		// leading up to it when there are more.
+		if len(r.Stderr) > 1 {
+			for _, l := range r.Stderr {
+				log.Printf("[backup] %s stderr: %s", b.Name, l)
+			}
+		}
+		// While the destination is degraded its own notification stands in
+		// for the failures of every backup writing to it.
+		if notifier().OnFailure && !degraded(b.Destination) {
+			notify("backup_failed", fmt.Sprintf("backup %s failed in %s phase: %v", b.Name, r.Phase, r.Err), map[string]any{
+				"backup":    b.Name,
+				"phase":     string(r.Phase),
+				"error":     r.Err.Error(),
+				"retryable": r.Retryable,
+				"stderr":    strings.Join(r.Stderr, "\n"),
+			})
+		}
+		if b.HeartbeatOnFailure {
+			heartbeat(b, false)
+		}
+	default:
+		lastSuccess.Set(float64(time.Now().Unix()), b.Name)
+		recordSuccess(b.Name, time.Now())
+		lastDuration.Set(r.Duration.Seconds(), b.Name)
+		lastSize.Set(float64(r.Size), b.Name)
+		if ratio := r.compressionRatio(); ratio > 0 {
+			compressionRatio.Set(ratio, b.Name)
+		}
+		log.Printf("[backup] %s finished in %s (%d bytes)%s", b.Name, r.Duration.Round(time.Second), r.Size, labelSuffix(b.Name))
+		if notifier().OnSuccess {
+			notify("backup_succeeded", fmt.Sprintf("backup %s succeeded: %s (%d bytes)", b.Name, r.Key, r.Size), map[string]any{
+				"backup":   b.Name,
+				"key":      r.Key,
+				"size":     r.Size,
+				"duration": r.Duration.Seconds(),
+			})
+		}
+		heartbeat(b, true)
+	}
+	recordCatalog(b, r)
+	publishFinished(b, r)
+	recordTuning(b, r)
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+   Resumable uploads. With resumableUploads on an s3 destination and a
+   /backups volume, a run works in /backups/.work instead of /tmp and
+   uploads its dump as a multipart upload it drives itself, recording the
+   upload id and every finished part in upload.json next to the dump. If the
+   process dies mid-upload, the next daemon start finds the workspace,
+   uploads only the missing parts and completes the upload instead of
+   starting a multi-hour upload over. The checkpoint also holds the backup
+   as the run saw it and the dump's manifest, built before the upload, so
+   what the run would have done after the upload (verification, checksum,
+   object lock, manifest, archive, local copy, retention, latest pointer)
+   is done then too, without the database. Until that succeeds the
+   workspace is kept and retried at the next start. Replication and
+   postMaintenance are not replayed.
+
+   Workspaces left without a checkpoint (the process died while dumping) or
+   whose dump is gone are removed, and their multipart uploads aborted. So
+   are multipart uploads under the destination's prefix that are older than
+   a day and that no workspace knows about; the parts of an abandoned upload
+   are billed until then.
+*/
+
+const (
+	resumeRoot         = localCopyDir + "/.work"
+	checkpointName     = "upload.json"
+	minPartSize        = 5 << 20
+	defaultPartSize    = 64 << 20
+	maxParts           = 10000
+	abandonedUploadAge = 24 * time.Hour
+)
+
+type uploadCheckpoint struct {
+	Destination string         `json:"destination"`
+	Backup      string         `json:"backup"`
+	Key         string         `json:"key"`
+	UploadID    string         `json:"uploadId"`
+	File        string         `json:"file"`
+	Size        int64          `json:"size"`
+	PartSize    int64          `json:"partSize"`
+	Parts       []uploadedPart `json:"parts"`
+	// Completed is set once the upload is complete, and only what follows
+	// it is left to do.
+	Completed bool `json:"completed,omitempty"`
+	// Run is the interrupted run, Manifest the manifest of its dump if it
+	// writes one. Checkpoints from before they were recorded have neither.
+	Run      *resumeRun `json:"run,omitempty"`
+	Manifest *Manifest  `json:"manifest,omitempty"`
+}
+
+// resumeRun is what the steps after an upload need of the run: the backup
+// as the run saw it, with what was resolved at run time, and the result so
+// far. The connection URL is kept without its password, for the database
+// name it carries.
+type resumeRun struct {
+	Backup         Backup    `json:"backup"`
+	PgDumpCompress string    `json:"pgDumpCompress,omitempty"`
+	Part           string    `json:"part,omitempty"`
+	Snapshot       string    `json:"snapshot,omitempty"`
+	PartNames      []string  `json:"partNames,omitempty"`
+	Started        time.Time `json:"started"`
+	RawSize        int64     `json:"rawSize,omitempty"`
+	WalLSN         string    `json:"walLsn,omitempty"`
+}
+
+func newResumeRun(b Backup, res RunResult) *resumeRun {
+	saved := b
+	saved.URL = redactConn(b.URL)
+	saved.HeartbeatURL = ""
+	return &resumeRun{
+		Backup:         saved,
+		PgDumpCompress: b.pgDumpCompress,
+		Part:           b.part,
+		Snapshot:       b.snapshot,
+		PartNames:      b.partNames,
+		Started:        res.Started,
+		RawSize:        res.RawSize,
+		WalLSN:         res.WalLSN,
+	}
+}
+
+// restore rebuilds the run's backup and its result for the dump uploaded
+// to key.
+func (r *resumeRun) restore(key string, size int64) (Backup, RunResult) {
+	b := r.Backup
+	b.pgDumpCompress, b.part, b.snapshot, b.partNames = r.PgDumpCompress, r.Part, r.Snapshot, r.PartNames
+	res := RunResult{Backup: b.Name, Started: r.Started, Key: key, Size: size, RawSize: r.RawSize, WalLSN: r.WalLSN}
+	return b, res
+}
+
+// uploadedPart is a finished part as complete-multipart-upload wants it.
+type uploadedPart struct {
+	PartNumber     int    `json:"PartNumber"`
+	ETag           string `json:"ETag"`
+	ChecksumSHA256 string `json:"ChecksumSHA256,omitempty"`
+	ChecksumSHA1   string `json:"ChecksumSHA1,omitempty"`
+	ChecksumCRC32  string `json:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C string `json:"ChecksumCRC32C,omitempty"`
+}
+
+// resumable reports whether uploads to d are checkpointed.
+func (d Destination) resumable() bool {
+	if !d.ResumableUploads {
+		return false
+	}
+	_, err := os.Stat(localCopyDir)
+	return err == nil
+}
+
+// partSize is d's part size, raised as needed to stay within maxParts.
+func (d Destination) partSize(size int64) int64 {
+	ps := int64(d.PartSize)
+	if ps == 0 {
+		ps = defaultPartSize
+	}
+	for (size+ps-1)/ps > maxParts {
+		ps *= 2
+	}
+	return ps
+}
+
+func (c *uploadCheckpoint) save(path string) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadCheckpoint(path string) (uploadCheckpoint, error) {
+	var c uploadCheckpoint
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(body, &c)
+}
+
+// resumableUpload uploads file to key as a checkpointed multipart upload
+// and returns the manifest it built for the checkpoint, if b writes one.
+// The upload is aborted if it fails; only a crash leaves it to be resumed.
+func resumableUpload(ctx context.Context, b Backup, dest Destination, res RunResult, key, file string) (*Manifest, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	cp := uploadCheckpoint{
+		Destination: b.Destination,
+		Backup:      b.Name,
+		Key:         key,
+		File:        filepath.Base(file),
+		Size:        st.Size(),
+		PartSize:    dest.partSize(st.Size()),
+		Run:         newResumeRun(b, res),
+	}
+	if b.WriteManifest {
+		m, err := buildManifest(ctx, b, key, file, res)
+		if err != nil {
+			return nil, err
+		}
+		cp.Manifest = &m
+	}
+	err = storageOp(ctx, dest, "create multipart upload "+key, 0, func(ctx context.Context) error {
+		var err error
+		cp.UploadID, err = awsCreateMultipartUpload(ctx, dest, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cpPath := filepath.Join(filepath.Dir(file), checkpointName)
+	if err = cp.save(cpPath); err == nil {
+		err = uploadParts(ctx, dest, &cp, file, cpPath)
+	}
+	if err != nil {
+		abortUpload(ctx, dest, key, cp.UploadID)
+		os.Remove(cpPath)
+	}
+	return cp.Manifest, err
+}
+
+// uploadParts uploads the parts cp doesn't have yet, checkpointing after
+// each, and completes the upload.
+func uploadParts(ctx context.Context, dest Destination, cp *uploadCheckpoint, file, cpPath string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	done := map[int]bool{}
+	for _, p := range cp.Parts {
+		done[p.PartNumber] = true
+	}
+	n := max(int((cp.Size+cp.PartSize-1)/cp.PartSize), 1)
+	for i := 1; i <= n; i++ {
+		if done[i] {
+			continue
+		}
+		chunk := filepath.Join(filepath.Dir(cpPath), fmt.Sprintf("part-%05d", i))
+		if err := writeChunk(chunk, io.NewSectionReader(f, int64(i-1)*cp.PartSize, cp.PartSize)); err != nil {
+			return err
+		}
+		var part uploadedPart
+		err := storageOp(ctx, dest, fmt.Sprintf("upload part %d/%d of %s", i, n, cp.Key), 0, func(ctx context.Context) error {
+			var err error
+			part, err = awsUploadPart(ctx, dest, cp.Key, cp.UploadID, i, chunk)
+			return err
+		})
+		os.Remove(chunk)
+		if err != nil {
+			return err
+		}
+		cp.Parts = append(cp.Parts, part)
+		if err := cp.save(cpPath); err != nil {
+			return err
+		}
+	}
+	sort.Slice(cp.Parts, func(i, j int) bool { return cp.Parts[i].PartNumber < cp.Parts[j].PartNumber })
+	err = storageOp(ctx, dest, "complete multipart upload "+cp.Key, 0, func(ctx context.Context) error {
+		return awsCompleteMultipartUpload(ctx, dest, cp.Key, cp.UploadID, cp.Parts)
+	})
+	if err != nil {
+		return err
+	}
+	cp.Completed = true
+	if err := cp.save(cpPath); err != nil {
+		log.Printf("[backup] WARNING: %s: recording the completed upload of %s failed: %v", cp.Backup, cp.Key, err)
+	}
+	return nil
+}
+
+func writeChunk(path string, r io.Reader) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func abortUpload(ctx context.Context, dest Destination, key, uploadID string) {
+	err := storageOp(ctx, dest, "abort multipart upload "+key, 0, func(ctx context.Context) error {
+		return awsAbortMultipartUpload(ctx, dest, key, uploadID)
+	})
+	if err != nil {
+		log.Printf("[backup] WARNING: aborting multipart upload of %s failed, its parts stay billed until a lifecycle rule or the next start removes them: %v", key, err)
+	}
+}
+
+// interruptedWorkspaces lists the workspaces left in resumeRoot. It must run
+// before anything is scheduled, so no new run's workspace is among them.
+func interruptedWorkspaces() []string {
+	entries, err := os.ReadDir(resumeRoot)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(resumeRoot, e.Name()))
+		}
+	}
+	return dirs
+}
+
+// resumeUploads finishes the uploads of interrupted runs and cleans up
+// after those that can't be finished, then aborts abandoned multipart
+// uploads on every resumable destination.
+func resumeUploads(ctx context.Context, cfg Config, workspaces []string) {
+	known := map[string]bool{}
+	for _, ws := range workspaces {
+		cp, err := loadCheckpoint(filepath.Join(ws, checkpointName))
+		if err != nil {
+			log.Printf("[backup] removing %s, left by a run interrupted before its upload", ws)
+			os.RemoveAll(ws)
+			continue
+		}
+		known[cp.UploadID] = true
+		dest, ok := cfg.Destinations[cp.Destination]
+		file := filepath.Join(ws, cp.File)
+		st, err := os.Stat(file)
+		switch {
+		case !ok:
+			log.Printf("[backup] WARNING: %s: destination %q of interrupted upload %s no longer exists, leaving the upload to a lifecycle rule", cp.Backup, cp.Destination, cp.Key)
+		case err != nil || st.Size() != cp.Size:
+			log.Printf("[backup] WARNING: %s: dump for interrupted upload %s is missing or changed, aborting the upload", cp.Backup, cp.Key)
+			abortUpload(ctx, dest, cp.Key, cp.UploadID)
+		case !cp.Completed:
+			log.Printf("[backup] %s: resuming upload of %s (%d parts already uploaded)", cp.Backup, dest.store().url(cp.Key), len(cp.Parts))
+			if err := uploadParts(ctx, dest, &cp, file, filepath.Join(ws, checkpointName)); err != nil {
+				log.Printf("[backup] WARNING: %s: resuming upload of %s failed, aborting it: %v", cp.Backup, cp.Key, err)
+				abortUpload(ctx, dest, cp.Key, cp.UploadID)
+				break
+			}
+			log.Printf("[backup] %s: resumed upload of %s completed", cp.Backup, dest.store().url(cp.Key))
+			fallthrough
+		default:
+			if !finishResumed(ctx, dest, cp, file) {
+				log.Printf("[backup] WARNING: %s: keeping %s to finish %s at the next start", cp.Backup, ws, cp.Key)
+				continue
+			}
+		}
+		os.RemoveAll(ws)
+	}
+
+	for name, dest := range cfg.Destinations {
+		if dest.ResumableUploads {
+			abortAbandonedUploads(ctx, name, dest, known)
+		}
+	}
+}
+
+// finishResumed does what the interrupted run would have done after its
+// upload, as storeBackup does. It reports whether the dump's own steps
+// (finishUpload) succeeded; retention and the latest pointer only warn.
+func finishResumed(ctx context.Context, dest Destination, cp uploadCheckpoint, file string) bool {
+	if cp.Run == nil {
+		log.Printf("[backup] %s: checkpoint of %s predates resuming what follows the upload; the next run catches up on retention", cp.Backup, cp.Key)
+		return true
+	}
+	b, res := cp.Run.restore(cp.Key, cp.Size)
+	up, err := finishUpload(ctx, b, dest, &res, cp.Key, file, cp.Manifest)
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: finishing resumed upload of %s failed: %v", b.Name, cp.Key, err)
+		return false
+	}
+	keepLocal(ctx, b, &res, file)
+	applyRetention(ctx, b, dest, &res, up)
+	up.finish(ctx, b, dest)
+	return true
+}
+
+func abortAbandonedUploads(ctx context.Context, name string, dest Destination, known map[string]bool) {
+	var uploads []multipartUpload
+	err := storageOp(ctx, dest, "list multipart uploads", pruneTimeout, func(ctx context.Context) error {
+		var err error
+		uploads, err = awsListMultipartUploads(ctx, dest, strings.Trim(dest.Prefix, "/"))
+		return err
+	})
+	if err != nil {
+		log.Printf("[backup] WARNING: destination %q: listing multipart uploads failed: %v", name, err)
+		return
+	}
+	for _, u := range uploads {
+		if known[u.UploadID] || time.Since(u.Initiated) < abandonedUploadAge {
+			continue
+		}
+		log.Printf("[backup] destination %q: aborting multipart upload of %s abandoned since %s", name, u.Key, u.Initiated.Format(time.RFC3339))
+		abortUpload(ctx, dest, u.Key, u.UploadID)
+	}
+}
+
+type multipartUpload struct {
+	Key       string    `json:"Key"`
+	UploadID  string    `json:"UploadId"`
+	Initiated time.Time `json:"Initiated"`
+}
+
+func awsCreateMultipartUpload(ctx context.Context, d Destination, key string) (string, error) {
+	args := []string{"s3api", "create-multipart-upload", "--bucket", d.Bucket, "--key", strings.TrimLeft(key, "/"), "--output", "json"}
+	args = append(args, d.cpArgs()...)
+	out, err := outputCaptured(awsCommand(ctx, d, args...))
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadID string `json:"UploadId"`
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return "", err
+	}
+	if res.UploadID == "" {
+		return "", fmt.Errorf("create-multipart-upload returned no upload id")
+	}
+	return res.UploadID, nil
+}
+
+func awsUploadPart(ctx context.Context, d Destination, key, uploadID string, n int, chunk string) (uploadedPart, error) {
+	args := []string{
+		"s3api", "upload-part",
+		"--bucket", d.Bucket,
+		"--key", strings.TrimLeft(key, "/"),
+		"--upload-id", uploadID,
+		"--part-number", fmt.Sprint(n),
+		"--body", chunk,
+		"--output", "json",
+	}
+	args = append(args, d.cpArgs()...)
+	out, err := outputCaptured(awsCommand(ctx, d, args...))
+	if err != nil {
+		return uploadedPart{}, err
+	}
+	part := uploadedPart{PartNumber: n}
+	if err := json.Unmarshal(out, &part); err != nil {
+		return uploadedPart{}, err
+	}
+	part.PartNumber = n
+	return part, nil
+}
+
+func awsCompleteMultipartUpload(ctx context.Context, d Destination, key, uploadID string, parts []uploadedPart) error {
+	body, err := json.Marshal(map[string]any{"Parts": parts})
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"s3api", "complete-multipart-upload",
+		"--bucket", d.Bucket,
+		"--key", strings.TrimLeft(key, "/"),
+		"--upload-id", uploadID,
+		"--multipart-upload", string(body),
+	}
+	cmd := awsCommand(ctx, d, args...)
+	cmd.Stdout = io.Discard
+	return runCaptured(cmd, nil)
+}
+
+func awsAbortMultipartUpload(ctx context.Context, d Destination, key, uploadID string) error {
+	args := []string{"s3api", "abort-multipart-upload", "--bucket", d.Bucket, "--key", strings.TrimLeft(key, "/"), "--upload-id", uploadID}
+	return runCaptured(awsCommand(ctx, d, args...), nil)
+}
+
+func awsListMultipartUploads(ctx context.Context, d Destination, prefix string) ([]multipartUpload, error) {
+	args := []string{"s3api", "list-multipart-uploads", "--bucket", d.Bucket, "--output", "json"}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix+"/")
+	}
+	out, err := outputCaptured(awsCommand(ctx, d, args...))
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Uploads []multipartUpload `json:"Uploads"`
+	}
+	if len(strings.TrimSpace(string(out))) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, err
+	}
+	return res.Uploads, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An upload completed before a crash is still verified and gets its
+// manifest at the next start, and its workspace is kept until that succeeds.
+func TestResumeFinishesCompletedUpload(t *testing.T) {
+	storageBackoff = time.Millisecond
+	t.Cleanup(func() { storageBackoff = 5 * time.Second })
+	const key = "app/app/pgdump-2026-01-02T03-04-05Z.dump"
+	for _, tc := range []struct {
+		name string
+		aws  string
+		kept bool
+	}{
+		{"succeeds", `echo "$@" >> "$AWS_LOG"; [ "$2" = head-object ] && echo '{"ContentLength": 4}'; exit 0`, false},
+		{"verify fails", `echo "$@" >> "$AWS_LOG"; [ "$2" = head-object ] && echo '{"ContentLength": 3}'; exit 0`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			awsLog := filepath.Join(t.TempDir(), "aws.log")
+			t.Setenv("AWS_LOG", awsLog)
+			fakeBins(t, map[string]string{"aws": tc.aws})
+
+			ws := t.TempDir()
+			file := filepath.Join(ws, "pgdump.dump")
+			if err := os.WriteFile(file, []byte("dump"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			b := Backup{Name: "app", URL: "postgres://user:secret@db/app", Destination: "s3", WriteManifest: true}
+			res := RunResult{Backup: b.Name, Started: time.Now()}
+			cp := uploadCheckpoint{
+				Destination: "s3",
+				Backup:      b.Name,
+				Key:         key,
+				File:        "pgdump.dump",
+				Size:        4,
+				Completed:   true,
+				Run:         newResumeRun(b, res),
+				Manifest:    &Manifest{Backup: b.Name},
+			}
+			if strings.Contains(cp.Run.Backup.URL, "secret") {
+				t.Errorf("checkpoint keeps the password: %s", cp.Run.Backup.URL)
+			}
+			if err := cp.save(filepath.Join(ws, checkpointName)); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := Config{Destinations: map[string]Destination{"s3": {Bucket: "bucket", VerifyUpload: true}}}
+			resumeUploads(context.Background(), cfg, []string{ws})
+
+			calls, _ := os.ReadFile(awsLog)
+			if !tc.kept && !strings.Contains(string(calls), manifestKey(key)) {
+				t.Errorf("manifest %s not uploaded; aws calls:\n%s", manifestKey(key), calls)
+			}
+			if strings.Contains(string(calls), "upload-part") {
+				t.Errorf("completed upload uploaded again:\n%s", calls)
+			}
+			_, err := os.Stat(ws)
+			if kept := err == nil; kept != tc.kept {
+				t.Errorf("workspace kept = %v, want %v", kept, tc.kept)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+   Retention. maxHistory keeps the N newest dumps, however close together
+   they were taken, so a burst of manual runs can push out every dump of the
+   days before. keepPerDay keeps the N newest dumps of each calendar day
+   (UTC) instead, and maxAge drops dumps older than a duration: keepPerDay: 2
+   with maxAge: 720h keeps two a day for 30 days. With either, maxHistory
+   caps how many of the dumps they keep, so keepPerDay: 1 with maxHistory: 14
+   keeps the last dump of each of the 14 newest days. The newest dump is
+   always kept, so maxAge never empties a backup that has stopped producing
+   dumps. Days and ages go by the same time as ordering: upload time, or the
+   key's timestamp with pruneByKeyTimestamp.
+*/
+
+// retention is a backup's retention settings, compared between backups
+// that prune the same dumps.
+type retention struct {
+	maxHistory int
+	keepPerDay int
+	maxAge     time.Duration
+}
+
+func (b Backup) retention() retention {
+	return retention{b.MaxHistory, b.KeepPerDay, b.MaxAge}
+}
+
+func (r retention) set() bool {
+	return r.maxHistory > 0 || r.keepPerDay > 0 || r.maxAge > 0
+}
+
+func (r retention) String() string {
+	return fmt.Sprintf("maxHistory %d, keepPerDay %d, maxAge %s", r.maxHistory, r.keepPerDay, r.maxAge)
+}
+
+// hasRetention reports whether pruning deletes any of b's dumps.
+func (b Backup) hasRetention() bool { return b.retention().set() }
+
+// expiredDumps returns the dumps retention deletes. dumps must be sorted
+// newest first by when; the result keeps that order.
+func (r retention) expiredDumps(dumps []s3Object, when func(s3Object) time.Time, now time.Time) []s3Object {
+	var expired []s3Object
+	perDay := map[string]int{}
+	kept := 0
+	for i, o := range dumps {
+		t := when(o)
+		day := t.UTC().Format("2006-01-02")
+		perDay[day]++
+		if i > 0 && (r.keepPerDay > 0 && perDay[day] > r.keepPerDay ||
+			r.maxAge > 0 && now.Sub(t) > r.maxAge ||
+			r.maxHistory > 0 && kept >= r.maxHistory) {
+			expired = append(expired, o)
+			continue
+		}
+		kept++
+	}
+	return expired
+}
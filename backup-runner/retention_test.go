@@ -0,0 +1,119 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExpiredDumps(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	at := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	for _, tc := range []struct {
+		name    string
+		r       retention
+		times   []string // newest first
+		expired []int    // indexes into times
+	}{
+		{
+			name:  "no retention keeps everything",
+			times: []string{"2024-03-10T02:00:00Z", "2024-03-09T02:00:00Z"},
+		},
+		{
+			name:    "maxHistory keeps the newest",
+			r:       retention{maxHistory: 2},
+			times:   []string{"2024-03-10T02:00:00Z", "2024-03-09T02:00:00Z", "2024-03-08T02:00:00Z", "2024-03-07T02:00:00Z"},
+			expired: []int{2, 3},
+		},
+		{
+			name: "maxHistory counts a burst on one day",
+			r:    retention{maxHistory: 3},
+			times: []string{"2024-03-10T11:00:00Z", "2024-03-10T10:00:00Z", "2024-03-10T09:00:00Z",
+				"2024-03-10T08:00:00Z", "2024-03-09T02:00:00Z"},
+			expired: []int{3, 4},
+		},
+		{
+			name: "keepPerDay keeps the newest of each day",
+			r:    retention{keepPerDay: 1},
+			times: []string{"2024-03-10T11:00:00Z", "2024-03-10T10:00:00Z", "2024-03-10T09:00:00Z",
+				"2024-03-09T02:00:00Z", "2024-03-08T23:00:00Z", "2024-03-08T01:00:00Z"},
+			expired: []int{1, 2, 5},
+		},
+		{
+			name: "keepPerDay splits days at midnight UTC",
+			r:    retention{keepPerDay: 1},
+			times: []string{"2024-03-10T00:00:00Z", "2024-03-09T23:59:59Z", "2024-03-09T00:00:00Z",
+				"2024-03-08T23:59:59Z"},
+			expired: []int{2},
+		},
+		{
+			name: "keepPerDay goes by UTC whatever the zone",
+			r:    retention{keepPerDay: 1},
+			// The 10th, 9th and 8th in UTC; the last two fall on the 9th in
+			// their own zones.
+			times: []string{"2024-03-10T01:30:00+01:00", "2024-03-09T23:30:00Z", "2024-03-09T01:30:00+02:00"},
+		},
+		{
+			name: "keepPerDay 2",
+			r:    retention{keepPerDay: 2},
+			times: []string{"2024-03-10T11:00:00Z", "2024-03-10T10:00:00Z", "2024-03-10T09:00:00Z",
+				"2024-03-09T02:00:00Z"},
+			expired: []int{2},
+		},
+		{
+			name: "maxHistory caps keepPerDay",
+			r:    retention{keepPerDay: 1, maxHistory: 2},
+			times: []string{"2024-03-10T11:00:00Z", "2024-03-10T10:00:00Z", "2024-03-09T02:00:00Z",
+				"2024-03-08T02:00:00Z", "2024-03-07T02:00:00Z"},
+			expired: []int{1, 3, 4},
+		},
+		{
+			name:    "maxAge",
+			r:       retention{maxAge: 48 * time.Hour},
+			times:   []string{"2024-03-10T02:00:00Z", "2024-03-08T12:00:00Z", "2024-03-08T11:59:59Z", "2024-03-01T02:00:00Z"},
+			expired: []int{2, 3},
+		},
+		{
+			name:  "maxAge keeps the newest dump however old",
+			r:     retention{maxAge: 24 * time.Hour},
+			times: []string{"2024-02-01T02:00:00Z", "2024-01-31T02:00:00Z"},
+			// Only the second: a backup that stopped producing dumps keeps its last.
+			expired: []int{1},
+		},
+		{
+			name:    "maxAge with keepPerDay keeps the newest dump",
+			r:       retention{keepPerDay: 1, maxAge: time.Hour},
+			times:   []string{"2024-03-01T02:00:00Z", "2024-03-01T01:00:00Z"},
+			expired: []int{1},
+		},
+		{
+			name:  "a single dump is always kept",
+			r:     retention{maxHistory: 1, keepPerDay: 1, maxAge: time.Minute},
+			times: []string{"2023-01-01T00:00:00Z"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var dumps []s3Object
+			for i, s := range tc.times {
+				dumps = append(dumps, s3Object{Key: string(rune('a' + i)), LastModified: at(s)})
+			}
+			var want []string
+			for _, i := range tc.expired {
+				want = append(want, dumps[i].Key)
+			}
+			var got []string
+			for _, o := range tc.r.expiredDumps(dumps, func(o s3Object) time.Time { return o.LastModified }, now) {
+				got = append(got, o.Key)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("expired %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// retry calls fn up to attempts times, doubling delay between attempts. It
+// returns the last error if every attempt fails, or once ctx is done.
+func retry(ctx context.Context, what string, attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 1; i <= attempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// Past the deadline; another attempt would be killed too.
+			return err
+		}
+		if i < attempts {
+			log.Printf("[retry] %s failed (attempt %d/%d): %v; retrying in %s", what, i, attempts, err, delay)
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}
+	return err
+}
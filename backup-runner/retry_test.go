@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// A run cancelled while retry waits to try again stops waiting.
+func TestRetryStopsBackoffWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := errors.New("failed")
+	calls := 0
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := retry(ctx, "op", 3, time.Hour, func() error {
+		calls++
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Errorf("err = %v, want the attempt's error", err)
+	}
+	if calls != 1 {
+		t.Errorf("%d attempts, want 1", calls)
+	}
+	if took := time.Since(start); took > 10*time.Second {
+		t.Errorf("returned after %s, want soon after the cancel", took)
+	}
+}
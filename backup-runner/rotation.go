@@ -0,0 +1,167 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+   Credential rotation. Keys rotated while the daemon runs would otherwise
+   fail every upload until a restart. When a storage operation fails with
+   an authentication error (an unknown or expired key, a bad signature) the
+   credentials are read again from where they came from, and the operation
+   is repeated at once if that turned up new ones:
+
+   - keys from AWS_ACCESS_KEY_ID_FILE, AWS_SECRET_ACCESS_KEY_FILE and
+     AWS_SESSION_TOKEN_FILE (Docker and Kubernetes secrets) are read from
+     the files again;
+   - keys from the AWS CLI's default chain are resolved again, dropping the
+     cached ones (credentials.go);
+   - keys from plain environment variables can't change while the process
+     runs, and keys written in the config need a config reload (SIGHUP), so
+     for those a warning says what to do.
+
+   Only authentication errors cause a reload. The credential chain is
+   resolved again, and each warning logged, at most once per
+   credReloadInterval, so a key that stays wrong doesn't cost an STS call or
+   a warning on every retry.
+*/
+
+const credReloadInterval = time.Minute
+
+var credFileVars = []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"}
+
+var (
+	rotMu sync.Mutex
+	// envCreds are the credentials destinations with envCreds use, as last
+	// read from the environment.
+	envCreds   cachedCreds
+	lastReload = map[string]time.Time{}
+)
+
+// envSecret returns the environment variable name, or the trimmed contents
+// of the file named by name_FILE.
+func envSecret(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("[backup] WARNING: reading %s_FILE: %v", name, err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readEnvCredentials reads the AWS credentials from the environment and
+// remembers them for destinations with envCreds.
+func readEnvCredentials() cachedCreds {
+	c := cachedCreds{access: envSecret("AWS_ACCESS_KEY_ID"), secret: envSecret("AWS_SECRET_ACCESS_KEY"), token: envSecret("AWS_SESSION_TOKEN")}
+	rotMu.Lock()
+	envCreds = c
+	rotMu.Unlock()
+	return c
+}
+
+// credsFromFiles reports whether any credential comes from a _FILE
+// variable, the only environment source that can change while running.
+func credsFromFiles() bool {
+	for _, name := range credFileVars {
+		if os.Getenv(name) == "" && os.Getenv(name+"_FILE") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns d with the credentials last read from the environment,
+// when that is where d's came from.
+func (d Destination) current() Destination {
+	if d.envCreds {
+		rotMu.Lock()
+		d.Access, d.Secret, d.SessionToken = envCreds.access, envCreds.secret, envCreds.token
+		rotMu.Unlock()
+	}
+	return d
+}
+
+// authFailure reports whether err says the credentials were rejected, as
+// opposed to missing permissions or any other failure.
+func authFailure(err error) bool {
+	msg := err.Error()
+	for _, s := range []string{
+		"InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken", "TokenRefreshRequired",
+		"Access Key Id you provided does not exist", // restic
+		"bad_auth_token", "expired_auth_token", // b2
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadCredentials reads d's credentials again after an authentication
+// failure. It reports whether that changed them, i.e. whether the failed
+// operation is worth repeating right away.
+func reloadCredentials(d Destination) bool {
+	where := d.store().url("")
+	if d.Type == "restic" {
+		where = d.Repository
+	}
+	switch {
+	case d.envCreds && credsFromFiles():
+		// Reading the files is cheap, so they are read on every failure.
+		rotMu.Lock()
+		old := envCreds
+		rotMu.Unlock()
+		if readEnvCredentials() != old {
+			log.Printf("[backup] credentials for %s were rejected, reloaded them from the _FILE variables", where)
+			return true
+		}
+		if throttled("files") {
+			return false
+		}
+		log.Printf("[backup] WARNING: credentials for %s were rejected; re-read them from the _FILE variables but they are unchanged", where)
+	case d.envCreds:
+		if !throttled("env") {
+			log.Printf("[backup] WARNING: credentials for %s were rejected; they come from environment variables, so restart the runner after rotating them", where)
+		}
+	case d.Access == "" && cmp.Or(d.Type, "s3") == "s3":
+		k := d.credKey()
+		if throttled(fmt.Sprint("chain", k)) {
+			return false
+		}
+		credMu.Lock()
+		delete(credCache, k)
+		credMu.Unlock()
+		log.Printf("[backup] credentials for %s were rejected, resolving the AWS credential chain again", where)
+		return true
+	default:
+		if !throttled("config " + where) {
+			log.Printf("[backup] WARNING: credentials for %s were rejected; they are set in the config, so reload it with SIGHUP after rotating them", where)
+		}
+	}
+	return false
+}
+
+// throttled reports whether source was already acted on within
+// credReloadInterval, and otherwise records that it is now.
+func throttled(source string) bool {
+	rotMu.Lock()
+	defer rotMu.Unlock()
+	if time.Since(lastReload[source]) < credReloadInterval {
+		return true
+	}
+	lastReload[source] = time.Now()
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+/*
+   Key sanitization. A database is stored under a prefix named after it,
+   which is awkward for names with dots, spaces or capitals, and makes
+   Orders and orders share a prefix on backends that compare keys without
+   case. With sanitizeKeys that segment is encoded: lowercase letters,
+   digits and _ stay, every other byte becomes - and two lowercase hex
+   digits, so Orders.EU is stored under -4frders-2e-45-55/. The mapping is
+   reversible and distinct names never share a segment. Manifests keep the
+   original name, which restore prefers over decoding the segment.
+*/
+
+// sanitizeSegment encodes name for use as a key segment.
+func sanitizeSegment(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('-')
+		sb.WriteString(hex.EncodeToString([]byte{c}))
+	}
+	return sb.String()
+}
+
+// unsanitizeSegment decodes a segment written by sanitizeSegment. It reports
+// false for a segment that isn't one, such as a plain database name with
+// a hyphen, which is then taken as it is.
+func unsanitizeSegment(seg string) (string, bool) {
+	if !strings.Contains(seg, "-") {
+		return seg, false
+	}
+	var b []byte
+	for i := 0; i < len(seg); i++ {
+		if seg[i] != '-' {
+			b = append(b, seg[i])
+			continue
+		}
+		if i+3 > len(seg) {
+			return seg, false
+		}
+		c, err := hex.DecodeString(seg[i+1 : i+3])
+		if err != nil {
+			return seg, false
+		}
+		b = append(b, c[0])
+		i += 2
+	}
+	name := string(b)
+	if !utf8.ValidString(name) || sanitizeSegment(name) != seg {
+		return seg, false
+	}
+	return name, true
+}
+
+// keyName is the key segment of b's dumps: prefixName, encoded with
+// sanitizeKeys.
+func (b Backup) keyName() string {
+	name := b.prefixName()
+	if b.SanitizeKeys {
+		name = sanitizeSegment(name)
+	}
+	if b.part != "" {
+		// Part names are safe as they are.
+		name += "/" + b.part
+	}
+	return name
+}
+
+// manifestDatabase returns the database named in the manifest of the dump
+// at key, or "" if there is none.
+func manifestDatabase(ctx context.Context, dest Destination, key string) string {
+	m, err := fetchManifest(ctx, dest, key)
+	if err != nil {
+		return ""
+	}
+	return m.Database
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+   Snapshot parts. A backup with parts dumps subsets of its database (some
+   tables, some schemas) into separate objects, all at the same point in
+   time: a psql session opens a repeatable read transaction, exports its
+   snapshot with pg_export_snapshot() and stays open while each part's
+   pg_dump imports it with --snapshot. Every part then sees exactly the
+   rows the others see, so foreign keys between them hold on restore.
+
+   Each part is stored under <prefix>/<database>/<part>/ as the backup
+   <name>/<part>, with its own retention, like the databases of a discovery
+   backup. Its manifest names the database, the part, the snapshot and all
+   the parts of the run, which is how restore finds the dumps that belong
+   together and restores them into one database (restore.go). The exporting transaction stays open until the last dump is
+   done, holding back vacuum on the whole server for that long; a snapshot
+   can't be shared across databases, so parts are always of the backup's
+   own database.
+*/
+
+// snapshotExportTimeout bounds connecting and exporting the snapshot.
+const snapshotExportTimeout = time.Minute
+
+var partNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DumpPart is a subset of a database dumped from a shared snapshot.
+type DumpPart struct {
+	Name string `yaml:"name"`
+	// Tables, Schemas, ExcludeTables and ExcludeSchemas are pg_dump
+	// patterns for --table, --schema, --exclude-table and --exclude-schema.
+	Tables         []string `yaml:"tables"`
+	Schemas        []string `yaml:"schemas"`
+	ExcludeTables  []string `yaml:"excludeTables"`
+	ExcludeSchemas []string `yaml:"excludeSchemas"`
+}
+
+func (p DumpPart) args() []string {
+	var args []string
+	for _, t := range p.Tables {
+		args = append(args, "--table="+t)
+	}
+	for _, s := range p.Schemas {
+		args = append(args, "--schema="+s)
+	}
+	for _, t := range p.ExcludeTables {
+		args = append(args, "--exclude-table="+t)
+	}
+	for _, s := range p.ExcludeSchemas {
+		args = append(args, "--exclude-schema="+s)
+	}
+	return args
+}
+
+// validateParts checks b's parts.
+func validateParts(b Backup) error {
+	if len(b.Parts) == 0 {
+		return nil
+	}
+	switch {
+	case b.Discover:
+		return errors.New("parts can't be combined with discover: a snapshot can't be shared across databases")
+	case b.CatchUpOnStart:
+		return errors.New("catchUpOnStart is not supported with parts, which are each stored under their own prefix")
+	case !b.WriteManifest:
+		return errors.New("parts need writeManifest: restore tells the dumps of one snapshot apart by their manifests")
+	}
+	seen := map[string]bool{}
+	for i, p := range b.Parts {
+		switch {
+		case !partNamePattern.MatchString(p.Name):
+			return fmt.Errorf("parts[%d]: name %q must be letters, digits, _ or -", i, p.Name)
+		case seen[p.Name]:
+			return fmt.Errorf("parts[%d]: duplicate name %q", i, p.Name)
+		}
+		seen[p.Name] = true
+		for _, pat := range slices.Concat(p.Tables, p.Schemas, p.ExcludeTables, p.ExcludeSchemas) {
+			if strings.TrimSpace(pat) == "" {
+				return fmt.Errorf("parts[%d]: empty pattern", i)
+			}
+		}
+	}
+	return nil
+}
+
+// forPart returns the backup of one part of b, dumped from b's snapshot.
+func (b Backup) forPart(name string) Backup {
+	c := b
+	c.Name = b.Name + "/" + name
+	c.Parts = nil
+	c.part = name
+	for _, p := range b.Parts {
+		if p.Name == name {
+			c.partArgs = p.args()
+		}
+		c.partNames = append(c.partNames, p.Name)
+	}
+	return c
+}
+
+// members returns the backups b stores its dumps as: its parts, or b.
+func (b Backup) members() []Backup {
+	if len(b.Parts) == 0 {
+		return []Backup{b}
+	}
+	var out []Backup
+	for _, p := range b.Parts {
+		out = append(out, b.forPart(p.Name))
+	}
+	return out
+}
+
+// heldSnapshot is an exported snapshot and the psql session keeping it
+// valid.
+type heldSnapshot struct {
+	id      string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+}
+
+// exportSnapshot opens a transaction on b's database and exports its
+// snapshot, which stays importable until release.
+func exportSnapshot(ctx context.Context, b Backup) (*heldSnapshot, error) {
+	env, err := pgEnv(b)
+	if err != nil {
+		return nil, err
+	}
+	cmd := runCommand(ctx, binPath(b.PsqlPath, "psql"), "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1")
+	cmd.Env = env
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	tail := &tailWriter{}
+	captureStderr(cmd, tail)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// psql waits for more input after the query; a connection that hangs
+	// is killed instead of holding up the run.
+	timer := time.AfterFunc(snapshotExportTimeout, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+	fmt.Fprint(stdin, "BEGIN ISOLATION LEVEL REPEATABLE READ, READ ONLY;\nSELECT pg_export_snapshot();\n")
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	id := strings.TrimSpace(line)
+	if err != nil || id == "" {
+		stdin.Close()
+		if err == nil {
+			err = errors.New("no snapshot returned")
+		}
+		if werr := cmd.Wait(); werr != nil {
+			err = werr
+		}
+		return nil, fmt.Errorf("psql: %w", &cmdError{err: err, stderr: tail.Lines()})
+	}
+	// Whatever else psql prints is of no interest, but must not block it.
+	go io.Copy(io.Discard, stdout)
+	return &heldSnapshot{id: id, cmd: cmd, stdin: stdin, started: time.Now()}, nil
+}
+
+// release ends the exporting transaction.
+func (s *heldSnapshot) release(name string) {
+	fmt.Fprint(s.stdin, "COMMIT;\n")
+	s.stdin.Close()
+	if err := s.cmd.Wait(); err != nil {
+		log.Printf("[backup] %s: closing the snapshot session: %v", name, err)
+	}
+	log.Printf("[backup] %s: released snapshot %s after %s", name, s.id, time.Since(s.started).Round(time.Second))
+}
+
+// runParts dumps every part of b from one exported snapshot and sums them
+// up into one result. One part failing doesn't stop the others; without a
+// snapshot none is dumped.
+func runParts(ctx context.Context, b Backup, dest Destination) RunResult {
+	res := RunResult{Backup: b.Name, Started: time.Now()}
+	snap, err := exportSnapshot(ctx, b)
+	if err != nil {
+		res.fail(PhasePrecheck, fmt.Errorf("exporting snapshot: %w", err))
+		res.Duration = time.Since(res.Started)
+		return res
+	}
+	var names []string
+	for _, p := range b.Parts {
+		names = append(names, p.Name)
+	}
+	log.Printf("[backup] %s: exported snapshot %s, dumping %s from it", b.Name, snap.id, strings.Join(names, ", "))
+	b.snapshot = snap.id
+	return runMembers(ctx, b, dest, res, names, b.forPart, func() { snap.release(b.Name) })
+}
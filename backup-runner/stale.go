@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+/*
+   Staleness. pgbackup_backup_stale is 1 when a backup hasn't succeeded for
+   longer than its schedule allows, so alerting is `pgbackup_backup_stale ==
+   1` rather than arithmetic over timestamps and schedules in PromQL. The
+   schedule gives the run due after the last success (or after startup,
+   before the first one) and the interval following it; the backup is stale
+   once staleGrace-1 intervals have passed since that run was due. With the
+   default of 2 that is when the next run is due as well, without a success
+   in between. Irregular cron schedules (weekdays only) are handled, as only
+   the expected runs count.
+*/
+
+const defaultStaleGrace = 2.0
+
+var backupStale = newGauge("pgbackup_backup_stale", "1 if the backup has gone staleGrace schedule intervals without a success.", "backup")
+
+type staleWatch struct {
+	sched cron.Schedule
+	grace float64
+}
+
+var (
+	staleMu      sync.Mutex
+	staleWatches = map[string]staleWatch{}
+	lastOK       = map[string]time.Time{}
+	staleSince   = time.Now()
+)
+
+func (b Backup) staleGrace() float64 {
+	if b.StaleGrace == 0 {
+		return defaultStaleGrace
+	}
+	return b.StaleGrace
+}
+
+// setStaleWatches installs the schedules staleness is computed from. Last
+// successes are kept across reloads.
+func setStaleWatches(backups []Backup) {
+	watches := map[string]staleWatch{}
+	for _, b := range backups {
+		if sched, err := b.schedule(); err == nil {
+			watches[b.Name] = staleWatch{sched: sched, grace: b.staleGrace()}
+		}
+	}
+	staleMu.Lock()
+	staleWatches = watches
+	staleMu.Unlock()
+}
+
+func recordSuccess(name string, t time.Time) {
+	staleMu.Lock()
+	lastOK[name] = t
+	staleMu.Unlock()
+}
+
+// isStale reports whether a backup last successful at ref is overdue at now.
+func isStale(w staleWatch, ref, now time.Time) bool {
+	expected := w.sched.Next(ref)
+	period := w.sched.Next(expected).Sub(expected)
+	return now.After(expected.Add(time.Duration((w.grace - 1) * float64(period))))
+}
+
+// updateStale recomputes pgbackup_backup_stale; it runs on every scrape.
+func updateStale() {
+	now := time.Now()
+	staleMu.Lock()
+	defer staleMu.Unlock()
+	backupStale.Reset()
+	for name, w := range staleWatches {
+		ref, ok := lastOK[name]
+		if !ok {
+			ref = staleSince
+		}
+		v := 0.0
+		if isStale(w, ref, now) {
+			v = 1
+		}
+		backupStale.Set(v, name)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is LOG_LEVEL (debug, info, warn or error), lower-cased. It only
+// affects chatty, periodic output such as dump progress; errors and the
+// per-run summary are always logged.
+var logLevel = strings.ToLower(os.Getenv("LOG_LEVEL"))
+
+// progressInterval is how often a running dump logs its size: every 10s at
+// debug, every minute at info (the default), never at warn or error.
+func progressInterval() time.Duration {
+	switch logLevel {
+	case "debug":
+		return 10 * time.Second
+	case "warn", "warning", "error":
+		return 0
+	}
+	return time.Minute
+}
+
+// progressPoll is how often the dump file is stat'ed to keep /status current,
+// independent of how often progress is logged.
+const progressPoll = 2 * time.Second
+
+// runStatus is a run in progress, as shown on /status.
+type runStatus struct {
+	Backup  string    `json:"backup"`
+	Phase   Phase     `json:"phase"`
+	Started time.Time `json:"started"`
+	Bytes   int64     `json:"bytes"`
+	// Stderr is the tail of pg_dump's stderr so far.
+	Stderr []string `json:"stderr,omitempty"`
+	// Tables is how many tables pg_dump has dumped with verboseProgress,
+	// out of roughly TablesTotal; Table is the one it is on.
+	Tables      int    `json:"tables,omitempty"`
+	TablesTotal int    `json:"tablesTotal,omitempty"`
+	Percent     int    `json:"percent,omitempty"`
+	Table       string `json:"table,omitempty"`
+
+	stderr *tailWriter
+}
+
+// lastRun is the outcome of a backup's most recent finished run.
+type lastRun struct {
+	Backup   string    `json:"backup"`
+	Status   string    `json:"status"`
+	Finished time.Time `json:"finished"`
+	Phase    Phase     `json:"phase,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Stderr   []string  `json:"stderr,omitempty"`
+	// LocalCopyError is set when the dump uploaded fine but couldn't be
+	// kept in /backups.
+	LocalCopyError string `json:"localCopyError,omitempty"`
+	// GlobalsError is set when the dump uploaded fine but the globals
+	// didn't.
+	GlobalsError string `json:"globalsError,omitempty"`
+	// Destinations are the per-destination outcomes of a fan-out run.
+	Destinations []destinationEntry `json:"destinations,omitempty"`
+}
+
+var (
+	activeMu sync.Mutex
+	active   = map[string]*runStatus{}
+	last     = map[string]lastRun{}
+)
+
+// startRun registers a run on /status and returns a func that removes it.
+func startRun(name string) (done func()) {
+	activeMu.Lock()
+	active[name] = &runStatus{Backup: name, Phase: PhasePrecheck, Started: time.Now()}
+	activeMu.Unlock()
+	return func() {
+		activeMu.Lock()
+		delete(active, name)
+		activeMu.Unlock()
+	}
+}
+
+func setRunPhase(name string, p Phase) {
+	activeMu.Lock()
+	if st, ok := active[name]; ok {
+		st.Phase = p
+	}
+	activeMu.Unlock()
+}
+
+func setRunStderr(name string, t *tailWriter) {
+	activeMu.Lock()
+	if st, ok := active[name]; ok {
+		st.stderr = t
+	}
+	activeMu.Unlock()
+}
+
+func recordLastRun(r RunResult) {
+	l := lastRun{Backup: r.Backup, Status: r.status(), Finished: r.Started.Add(r.Duration), Stderr: r.Stderr,
+		Destinations: destinationEntries(r.Destinations)}
+	if r.Err != nil {
+		l.Phase, l.Error = r.Phase, r.Err.Error()
+	}
+	if r.LocalCopyErr != nil {
+		l.LocalCopyError = r.LocalCopyErr.Error()
+	}
+	if r.GlobalsErr != nil {
+		l.GlobalsError = r.GlobalsErr.Error()
+	}
+	activeMu.Lock()
+	last[r.Backup] = l
+	activeMu.Unlock()
+}
+
+func setRunBytes(name string, n int64) {
+	activeMu.Lock()
+	if st, ok := active[name]; ok {
+		st.Bytes = n
+	}
+	activeMu.Unlock()
+}
+
+func setRunTables(name string, done, total int, table string) {
+	activeMu.Lock()
+	if st, ok := active[name]; ok {
+		st.Tables, st.TablesTotal, st.Table = done, total, table
+		st.Percent = tablePercent(done, total)
+	}
+	activeMu.Unlock()
+}
+
+// tableProgress describes a run's table progress for the progress log, if
+// it has any.
+func tableProgress(name string) string {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	st, ok := active[name]
+	switch {
+	case !ok || (st.Tables == 0 && st.TablesTotal == 0):
+		return ""
+	case st.TablesTotal > 0:
+		return fmt.Sprintf(", %d of ~%d tables (%d%%)", st.Tables, st.TablesTotal, st.Percent)
+	}
+	return fmt.Sprintf(", %d tables", st.Tables)
+}
+
+func activeRuns() []runStatus {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	out := make([]runStatus, 0, len(active))
+	for _, st := range active {
+		s := *st
+		if st.stderr != nil {
+			s.Stderr = st.stderr.Lines()
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Backup < out[j].Backup })
+	return out
+}
+
+// watchProgress polls the size of a file being written by pg_dump, keeping
+// the run's byte count on /status current and logging it periodically, until
+// the returned stop func is called.
+func watchProgress(name, path string) (stop func()) {
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		every := progressInterval()
+		started, lastLog := time.Now(), time.Now()
+		t := time.NewTicker(progressPoll)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+			}
+			st, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			setRunBytes(name, st.Size())
+			if every > 0 && time.Since(lastLog) >= every {
+				lastLog = time.Now()
+				log.Printf("[backup] %s: %s written so far%s (%s elapsed)", name, ByteSize(st.Size()), tableProgress(name), time.Since(started).Round(time.Second))
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	activeMu.Lock()
+	finished := make([]lastRun, 0, len(last))
+	for _, l := range last {
+		finished = append(finished, l)
+	}
+	activeMu.Unlock()
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Backup < finished[j].Backup })
+	json.NewEncoder(w).Encode(map[string]any{"active": activeRuns(), "last": finished})
+}
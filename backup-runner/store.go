@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+)
+
+// objectStore is the key-based storage behind s3 and b2 destinations. Restic
+// destinations don't address dumps by key and bypass it.
+type objectStore interface {
+	put(ctx context.Context, key, file string) error
+	get(ctx context.Context, key, file string) error
+	list(ctx context.Context, prefix string) ([]s3Object, error)
+	// remove deletes keys, returning the ones retained by Object Lock.
+	remove(ctx context.Context, keys []string) (locked []string, err error)
+	exists(ctx context.Context, key string) (bool, error)
+	// size returns the stored size of key.
+	size(ctx context.Context, key string) (int64, error)
+	// copy duplicates src to dst within the bucket without downloading it.
+	copy(ctx context.Context, src, dst string) error
+	url(key string) string
+}
+
+func (d Destination) store() objectStore {
+	if d.Type == "b2" {
+		return b2Store{d}
+	}
+	return s3Store{d}
+}
+
+type s3Store struct{ d Destination }
+
+func (s s3Store) put(ctx context.Context, key, file string) error {
+	return awsCp(ctx, s.d, key, file, s.d.cpArgs()...)
+}
+
+func (s s3Store) get(ctx context.Context, key, file string) error {
+	return awsGet(ctx, s.d, key, file)
+}
+
+func (s s3Store) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	return awsListObjects(ctx, s.d, prefix)
+}
+
+func (s s3Store) remove(ctx context.Context, keys []string) ([]string, error) {
+	return awsDeleteObjects(ctx, s.d, keys)
+}
+
+func (s s3Store) exists(ctx context.Context, key string) (bool, error) {
+	return awsObjectExists(ctx, s.d, key)
+}
+
+func (s s3Store) size(ctx context.Context, key string) (int64, error) {
+	head, err := awsHeadObject(ctx, s.d, key)
+	return head.ContentLength, err
+}
+
+func (s s3Store) copy(ctx context.Context, src, dst string) error {
+	cmd := awsCommand(ctx, s.d, "s3", "cp", s.url(src), s.url(dst), "--only-show-errors")
+	cmd.Stdout = os.Stdout
+	return runCaptured(cmd, nil)
+}
+
+func (s s3Store) url(key string) string {
+	return "s3://" + s.d.Bucket + "/" + strings.TrimLeft(key, "/")
+}
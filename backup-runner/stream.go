@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+/*
+   Streaming. By default a run writes the whole dump, then compresses it into
+   a second file, then uploads that: three slow phases back to back, with the
+   uncompressed dump on disk next to the compressed one. With stream:
+   compress, pg_dump's output is piped straight through the compressor into
+   the dump file, so dumping and compressing overlap and the uncompressed dump
+   never touches disk. stream: upload also feeds the same bytes to
+   `aws s3 cp -` as they are written, so the upload finishes with the dump.
+
+   The compressed file is written either way: the manifest, checksum check,
+   latest pointer and local copy read it, and when the streamed upload fails
+   the run uploads the file the usual way, with retries, instead of dumping
+   again. A failing pg_dump or compressor kills the streamed upload before it
+   completes, so a truncated dump is never stored. Failures are attributed to
+   the stage that failed: dump, compress, or upload if the upload from the
+   file fails as well.
+*/
+
+// phaseError attributes an error of the dump stage to another phase.
+type phaseError struct {
+	phase Phase
+	err   error
+}
+
+func (e *phaseError) Error() string { return e.err.Error() }
+func (e *phaseError) Unwrap() error { return e.err }
+
+// streamDump runs pg_dump piped through the compressor into a file in dir.
+// With stream: upload the output is also uploaded to a new key while it is
+// written; key is empty if that upload failed and out still needs uploading.
+// raw is how much pg_dump wrote to the compressor, 0 without one.
+func streamDump(ctx context.Context, b Backup, dest Destination, dir string) (out, key string, raw int64, err error) {
+	ts := time.Now().UTC().Format(tsLayout)
+	f, err := os.CreateTemp(dir, b.dumpPrefix()+ts+"-*"+b.dumpExt())
+	if err != nil {
+		return "", "", 0, err
+	}
+	defer f.Close()
+	out = f.Name()
+	fail := func(err error) (string, string, int64, error) {
+		os.Remove(out)
+		return "", "", 0, err
+	}
+
+	dump, err := pgDumpCommand(ctx, b, dir, pgDumpArgs(b))
+	if err != nil {
+		return fail(err)
+	}
+	tail, rules := dumpStderr(ctx, b)
+	captureStderr(dump, tail)
+
+	var sink io.Writer = f
+	var up *streamUpload
+	if b.Stream == "upload" {
+		if key, err = dumpKey(ctx, b, dest, b.dumpExt()); err == nil {
+			up, err = startStreamUpload(ctx, dest, key)
+		}
+		if err != nil {
+			log.Printf("[backup] WARNING: %s: streamed upload not started, uploading after the dump: %v", b.Name, err)
+			key = ""
+		} else {
+			sink = io.MultiWriter(f, up)
+		}
+	}
+
+	var comp *exec.Cmd
+	compTail := &tailWriter{}
+	var pr, pw *os.File
+	if b.Compression != "" {
+		if pr, pw, err = os.Pipe(); err != nil {
+			up.cancel()
+			return fail(err)
+		}
+		comp = runCommand(ctx, b.Compression, compressArgs(b)...)
+		comp.Stdin, comp.Stdout = pr, sink
+		captureStderr(comp, compTail)
+		// Counted on the way through for the compression ratio. When the
+		// compressor is gone the write fails and os/exec closes pg_dump's
+		// end, so pg_dump fails as it would writing to the pipe itself.
+		dump.Stdout = &countingWriter{w: pw, n: &raw}
+	} else {
+		dump.Stdout = sink
+	}
+
+	if err := dump.Start(); err != nil {
+		up.cancel()
+		if pr != nil {
+			pr.Close()
+			pw.Close()
+		}
+		return fail(err)
+	}
+	var compErr error
+	if comp != nil {
+		compErr = comp.Start()
+		// Only the compressor reads the pipe now, so its exiting fails
+		// the writes; the write end is closed once pg_dump's output has
+		// all been copied into it.
+		pr.Close()
+	}
+	stop := watchProgress(b.Name, out)
+	dumpErr := dump.Wait()
+	if pw != nil {
+		pw.Close()
+	}
+	if dumpErr != nil {
+		dumpErr = &cmdError{err: dumpErr, stderr: tail.Lines()}
+	}
+	dumpErr = rules.judge(b, dumpErr)
+	if comp != nil && compErr == nil {
+		if compErr = comp.Wait(); compErr != nil {
+			compErr = &cmdError{err: compErr, stderr: compTail.Lines()}
+		}
+	}
+	stop()
+
+	if compErr == nil && dumpErr == nil {
+		err = f.Close()
+	}
+	switch {
+	case compErr != nil:
+		// pg_dump failing on the closed pipe is a consequence, not the cause.
+		up.cancel()
+		return fail(&phaseError{PhaseCompress, fmt.Errorf("%s: %w", b.Compression, compErr)})
+	case dumpErr != nil:
+		up.cancel()
+		return fail(dumpErr)
+	case err != nil:
+		up.cancel()
+		return fail(err)
+	}
+
+	if up != nil {
+		if err := up.finish(); err != nil {
+			log.Printf("[backup] WARNING: %s: streamed upload of %s failed, uploading the dump file instead: %v", b.Name, key, err)
+			key = ""
+		}
+	}
+	return out, key, raw, nil
+}
+
+// countingWriter counts the bytes written through it into n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+// streamUpload is an `aws s3 cp -` fed while the dump is written. Once the
+// upload has failed, writes to it are dropped, so the dump carries on into
+// the local file.
+type streamUpload struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	stop  context.CancelFunc
+	tail  *tailWriter
+	err   error // the first failed write
+}
+
+func startStreamUpload(ctx context.Context, dest Destination, key string) (*streamUpload, error) {
+	ctx, cancel := dest.opContext(ctx, 0)
+	args := append([]string{"s3", "cp", "-", dest.store().url(key), "--only-show-errors"}, dest.cpArgs()...)
+	cmd := awsCommand(ctx, dest, args...)
+	cmd.Stdout = os.Stdout
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	tail := &tailWriter{}
+	captureStderr(cmd, tail)
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &streamUpload{cmd: cmd, stdin: stdin, stop: cancel, tail: tail}, nil
+}
+
+func (u *streamUpload) Write(p []byte) (int, error) {
+	if u.err == nil {
+		if _, err := u.stdin.Write(p); err != nil {
+			u.err = err
+		}
+	}
+	return len(p), nil
+}
+
+// finish ends the input and waits for the upload to complete.
+func (u *streamUpload) finish() error {
+	defer u.stop()
+	u.stdin.Close()
+	if err := u.cmd.Wait(); err != nil {
+		return &cmdError{err: err, stderr: u.tail.Lines()}
+	}
+	return u.err
+}
+
+// cancel kills the upload before it completes; the CLI aborts the multipart
+// upload, or nothing was stored yet. Safe on a nil upload.
+func (u *streamUpload) cancel() {
+	if u == nil {
+		return
+	}
+	u.stop()
+	u.stdin.Close()
+	u.cmd.Wait()
+}
+
+// removeStreamed deletes a streamed upload whose dump turned out unusable.
+func removeStreamed(ctx context.Context, b Backup, dest Destination, key string) {
+	err := storageOp(ctx, dest, "delete "+key, pruneTimeout, func(ctx context.Context) error {
+		_, err := dest.store().remove(ctx, []string{key})
+		return err
+	})
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: removing streamed upload %s failed, it stays in the bucket: %v", b.Name, key, err)
+	}
+}
+
+// streamDumpFor adapts streamDump to dumpRetryingLocks, recording the
+// streamed key and the uncompressed size in res.
+func streamDumpFor(dest Destination, res *RunResult) func(context.Context, Backup, string) (string, error) {
+	return func(ctx context.Context, b Backup, dir string) (string, error) {
+		out, k, raw, err := streamDump(ctx, b, dest, dir)
+		res.Key, res.RawSize = k, raw
+		return out, err
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+/*
+   Alert suppression. During planned maintenance a backup is expected to
+   fail, and paging someone for it helps nobody. suppressAlertsDuring lists
+   windows in which a backup's failure notifications are only logged: either
+   recurring, a cron schedule opening a window of duration at each firing,
+   or one-off, an explicit from/to range. Success and prune notifications
+   still go out, as do failures outside every window. Runs, retries,
+   metrics and heartbeats are not affected.
+*/
+
+// SuppressWindow is one entry of suppressAlertsDuring.
+type SuppressWindow struct {
+	// Schedule opens a window of Duration at each firing, e.g.
+	// "0 2 * * 6" with 3h for Saturday nights.
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	// From and To bound a one-off window, as RFC 3339 timestamps.
+	From time.Time `yaml:"from,omitempty"`
+	To   time.Time `yaml:"to,omitempty"`
+
+	sched cron.Schedule
+}
+
+// unsuppressed are the events that are not failures and are sent inside
+// suppression windows too.
+var unsuppressed = map[string]bool{"backup_succeeded": true, "prune": true}
+
+var (
+	suppressMu      sync.RWMutex
+	suppressWindows = map[string][]SuppressWindow{}
+)
+
+// validate checks w and parses its schedule.
+func (w *SuppressWindow) validate() error {
+	switch {
+	case w.Schedule != "" && (!w.From.IsZero() || !w.To.IsZero()):
+		return errors.New("set either schedule and duration, or from and to")
+	case w.Schedule != "":
+		sched, err := cronParser.Parse(w.Schedule)
+		if err != nil {
+			return fmt.Errorf("schedule %q: %w", w.Schedule, err)
+		}
+		if w.Duration <= 0 {
+			return errors.New("schedule needs a positive duration")
+		}
+		w.sched = sched
+	case w.From.IsZero() || w.To.IsZero():
+		return errors.New("needs schedule and duration, or from and to")
+	case !w.To.After(w.From):
+		return errors.New("to must be after from")
+	case w.Duration != 0:
+		return errors.New("duration only applies to schedule")
+	}
+	return nil
+}
+
+// covers reports whether t falls in the window.
+func (w SuppressWindow) covers(t time.Time) bool {
+	if w.sched != nil {
+		// The last firing before t, if the window it opened is still open.
+		return !w.sched.Next(t.Add(-w.Duration)).After(t)
+	}
+	return !t.Before(w.From) && t.Before(w.To)
+}
+
+func (w SuppressWindow) String() string {
+	if w.sched != nil {
+		return fmt.Sprintf("%q for %s", w.Schedule, w.Duration)
+	}
+	return w.From.Format(time.RFC3339) + " to " + w.To.Format(time.RFC3339)
+}
+
+// setSuppressWindows installs the windows of a validated config.
+func setSuppressWindows(backups []Backup) {
+	windows := map[string][]SuppressWindow{}
+	for _, b := range backups {
+		if len(b.SuppressAlertsDuring) > 0 {
+			windows[b.Name] = b.SuppressAlertsDuring
+		}
+	}
+	suppressMu.Lock()
+	suppressWindows = windows
+	suppressMu.Unlock()
+}
+
+// suppressedBy returns the window of the named backup t falls in, if any.
+// Databases of a discovery backup (name/db) use the backup's windows.
+func suppressedBy(name string, t time.Time) (SuppressWindow, bool) {
+	suppressMu.RLock()
+	defer suppressMu.RUnlock()
+	windows, ok := suppressWindows[name]
+	if !ok {
+		base, _, _ := strings.Cut(name, "/")
+		windows = suppressWindows[base]
+	}
+	for _, w := range windows {
+		if w.covers(t) {
+			return w, true
+		}
+	}
+	return SuppressWindow{}, false
+}
+
+// suppressed reports whether the notification event about backup is held
+// back by a window, logging it if so.
+func suppressed(event string, fields map[string]any) bool {
+	name, ok := fields["backup"].(string)
+	if !ok || unsuppressed[event] {
+		return false
+	}
+	w, ok := suppressedBy(name, time.Now())
+	if ok {
+		log.Printf("[notify] %s: %s not sent, alerts are suppressed (%s)", name, event, w)
+	}
+	return ok
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+/*
+   test checks both ends of a backup without dumping: the database answers
+   SELECT 1, and every destination it writes to (its own, any fanout
+   targets and its replica) accepts, lists and deletes a small probe object under the
+   backup's prefix. Restic repositories are checked by reading their config
+   instead. Every step is attempted once, without the retries of a real
+   run, and reported on its own line; the exit status is 1 if any failed.
+
+   The daemon doesn't check its backups before starting, so test is what
+   gates a deployment when run before it (an init container, a deploy
+   step). Backups with skipTest, say of a dev box that is often down,
+   are left out of a test of all backups so they can't hold up the others;
+   naming one with --backup still tests it.
+*/
+
+// testTimeout bounds each step of test unless the destination sets
+// operationTimeout.
+const testTimeout = 30 * time.Second
+
+func testCmd(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	name := fs.String("backup", "", "test only this backup")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: backup-runner test [--backup name]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err == nil {
+		err = validateConfig(&cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	failed, found := false, false
+	var skipped []string
+	for _, b := range cfg.Backups {
+		if *name != "" && b.Name != *name {
+			continue
+		}
+		found = true
+		fmt.Println(b.Name)
+		if b.SkipTest && *name == "" {
+			fmt.Println("  skip  skipTest is set")
+			skipped = append(skipped, b.Name)
+			continue
+		}
+		step := func(what string, err error) {
+			status := "ok"
+			if err != nil {
+				status, failed = "FAIL", true
+				what += ": " + err.Error()
+			}
+			fmt.Printf("  %-4s  %s\n", status, what)
+		}
+		start := time.Now()
+		_, err := psqlQuery(ctx, b, "SELECT 1")
+		step(fmt.Sprintf("connect to %s (%s)", redactConn(b.URL), time.Since(start).Round(time.Millisecond)), err)
+		targets := []fanoutTarget{{b.Destination, cfg.Destinations[b.Destination]}}
+		targets = append(targets, b.fanoutTo...)
+		if b.replica != nil {
+			targets = append(targets, *b.replica)
+		}
+		for _, t := range targets {
+			testDestination(ctx, b, t, step)
+		}
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "unknown backup %q\n", *name)
+		return 2
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("skipped (skipTest): %s\n", strings.Join(skipped, ", "))
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// testDestination writes, lists and deletes a probe object for b on t,
+// reporting each through step. The probe is removed even if listing fails.
+func testDestination(ctx context.Context, b Backup, t fanoutTarget, step func(string, error)) {
+	dest := t.dest
+	if dest.Type == "restic" {
+		ctx, cancel := dest.opContext(ctx, testTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "restic", "cat", "config")
+		cmd.Env = resticEnv(dest)
+		step(fmt.Sprintf("open restic repository of %s", t.name), runCaptured(cmd, nil))
+		return
+	}
+	f, err := os.CreateTemp("", "pgbackup-probe-")
+	if err == nil {
+		_, err = fmt.Fprintf(f, "backup-runner test probe, safe to delete\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		defer os.Remove(f.Name())
+	}
+	store := dest.store()
+	key := basePrefix(b, dest) + ".pgbackup-probe-" + time.Now().UTC().Format(tsLayout)
+	op := func(what string, fn func(ctx context.Context) error) error {
+		ctx, cancel := dest.opContext(ctx, testTimeout)
+		defer cancel()
+		err := fn(ctx)
+		step(fmt.Sprintf("%s %s (%s)", what, store.url(key), t.name), err)
+		return err
+	}
+	if err != nil {
+		step("write probe file", err)
+		return
+	}
+	if op("write", func(ctx context.Context) error { return store.put(ctx, key, f.Name()) }) != nil {
+		return
+	}
+	op("list", func(ctx context.Context) error {
+		objs, err := store.list(ctx, key)
+		if err == nil && len(objs) == 0 {
+			err = errors.New("probe not listed after writing it")
+		}
+		return err
+	})
+	op("delete", func(ctx context.Context) error {
+		locked, err := store.remove(ctx, []string{key})
+		if err == nil && len(locked) > 0 {
+			err = errors.New("retained by object lock; remove it once the retention expires")
+		}
+		return err
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+)
+
+/*
+   Manual trigger. Where the HTTP endpoint isn't exposed, an operator can
+   still start backups by hand: TRIGGER_SIGNAL (SIGUSR1 by default, none to
+   disable) runs every backup at once. To run only some, write their names
+   to TRIGGER_FILE, one per line, before sending the signal; the file is
+   removed once read. Triggered runs go through the same overlap lock and
+   worker limit as scheduled ones, so a backup already running is skipped.
+*/
+
+const defaultTriggerFile = "/tmp/pgbackup-trigger"
+
+var triggerSignals = map[string]syscall.Signal{
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// triggerSignal returns the signal configured by TRIGGER_SIGNAL, or 0 if
+// triggering is disabled.
+func triggerSignal() (syscall.Signal, error) {
+	name := strings.ToUpper(os.Getenv("TRIGGER_SIGNAL"))
+	switch name {
+	case "":
+		return syscall.SIGUSR1, nil
+	case "NONE", "OFF", "FALSE":
+		return 0, nil
+	}
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := triggerSignals[name]
+	if !ok {
+		return 0, fmt.Errorf("TRIGGER_SIGNAL must be SIGUSR1, SIGUSR2 or none, got %q", os.Getenv("TRIGGER_SIGNAL"))
+	}
+	return sig, nil
+}
+
+func triggerFile() string {
+	if f := os.Getenv("TRIGGER_FILE"); f != "" {
+		return f
+	}
+	return defaultTriggerFile
+}
+
+// triggered reads and removes the trigger file. It returns nil, meaning
+// every backup, if there is none.
+func triggered() ([]string, error) {
+	path := triggerFile()
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+	names := strings.Fields(string(body))
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return names, nil
+}
+
+func signalName(sig os.Signal) string {
+	for name, s := range triggerSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// trigger runs the backups named in the trigger file, or all of them.
+func (d *daemon) trigger(s os.Signal) {
+	sig := signalName(s)
+	names, err := triggered()
+	if err != nil {
+		log.Printf("[schedule] %s received, but %s is unreadable, nothing triggered: %v", sig, triggerFile(), err)
+		return
+	}
+	d.mu.Lock()
+	jobs := d.jobs
+	d.mu.Unlock()
+
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	var run []string
+	for _, j := range jobs {
+		if names != nil && !want[j.b.Name] {
+			continue
+		}
+		delete(want, j.b.Name)
+		run = append(run, j.b.Name)
+		go j.run("signal", nil)
+	}
+	for n := range want {
+		log.Printf("[schedule] WARNING: %s received for unknown backup %q", sig, n)
+	}
+	log.Printf("[schedule] %s received, triggered %d backups: %s", sig, len(run), strings.Join(run, ", "))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+/*
+   Table progress. With verboseProgress, pg_dump runs with --verbose and its
+   per-object messages are parsed as they arrive: each "dumping contents of
+   table" is one more table done, shown on /status and in the progress log
+   next to the byte count. Schema-heavy databases spend most of a dump on
+   many small tables, where bytes say little. The tables to dump are counted
+   up front, so /status can show a rough percentage. The messages are only
+   counted, not kept: they stay out of the stderr tail and the stderr rules,
+   and each line costs a prefix check.
+*/
+
+// countTablesQuery counts the tables whose data pg_dump will dump, roughly:
+// extension config tables, exclusions and the like aren't accounted for.
+const countTablesQuery = `SELECT count(*) FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind = 'r' AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'`
+
+// pgDumpLevels are the message levels pg_dump prefixes diagnostics with;
+// verbose messages have none.
+var pgDumpLevels = []string{"error:", "fatal:", "warning:", "detail:", "hint:", "["}
+
+type dumpProgress struct {
+	name        string
+	done, total int
+}
+
+// newDumpProgress returns the table progress of a dump of b, or nil if b
+// doesn't ask for it. A failed count just means no percentage.
+func newDumpProgress(ctx context.Context, b Backup) *dumpProgress {
+	if !b.VerboseProgress {
+		return nil
+	}
+	p := &dumpProgress{name: b.Name}
+	if !b.SchemaOnly {
+		if out, err := psqlQuery(ctx, b, countTablesQuery); err == nil {
+			p.total, _ = strconv.Atoi(out)
+		}
+	}
+	setRunTables(p.name, 0, p.total, "")
+	return p
+}
+
+// observe reports whether line is one of pg_dump's verbose messages,
+// counting the tables among them.
+func (p *dumpProgress) observe(line string) bool {
+	msg, ok := strings.CutPrefix(line, "pg_dump: ")
+	if !ok {
+		return false
+	}
+	for _, level := range pgDumpLevels {
+		if strings.HasPrefix(msg, level) {
+			return false
+		}
+	}
+	if table, ok := strings.CutPrefix(msg, "dumping contents of table "); ok {
+		p.done++
+		setRunTables(p.name, p.done, p.total, strings.Trim(table, `"`))
+	}
+	return true
+}
+
+// tablePercent is a rough share of tables done, short of 100 until the dump
+// has finished.
+func tablePercent(done, total int) int {
+	if total <= 0 {
+		return 0
+	}
+	return min(done*100/total, 99)
+}
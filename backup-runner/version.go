@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at build time:
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Without ldflags the commit and date fall back to what the Go toolchain
+// recorded from version control, if anything.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if commit == "" {
+				commit = s.Value
+			}
+		case "vcs.time":
+			if buildDate == "" {
+				buildDate = s.Value
+			}
+		}
+	}
+}
+
+func versionString() string {
+	c := commit
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	d := buildDate
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("pg-backup %s (commit %s, built %s, %s)", version, c, d, runtime.Version())
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+		"go":        runtime.Version(),
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+/*
+   Skipping unchanged databases. With skipUnchanged a run first reads the
+   server's WAL position, the LSN every change advances, and records it in
+   the manifest of the dump it stores. The next run compares the current
+   position to the one in the manifest of the newest dump: if it hasn't
+   moved, nothing on the server changed and the run is skipped, the
+   existing dump being as current as a new one would be. On a standby the
+   replayed position is used.
+
+   The position is server-wide, so a write to any database on the server,
+   and the WAL PostgreSQL writes on its own (checkpoints after activity,
+   archive_timeout segment switches), counts as a change; skipping only
+   ever happens when it is certainly safe. A position lower than the
+   recorded one means a different or restored server and is treated as a
+   change. Whenever the comparison can't be made (no manifest, no recorded
+   position, a failed query) the backup runs as usual.
+*/
+
+// walPositionQuery is the position changes have reached, on a primary or
+// a standby.
+const walPositionQuery = "SELECT CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END"
+
+// lsn is a WAL position, a 64-bit byte offset into the WAL.
+type lsn uint64
+
+// parseLSN parses PostgreSQL's text form of an LSN, two hexadecimal 32-bit
+// halves separated by a slash, e.g. 16/B374D848.
+func parseLSN(s string) (lsn, error) {
+	hi, lo, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok || hi == "" || lo == "" {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+	return lsn(h<<32 | l), nil
+}
+
+func (l lsn) String() string { return fmt.Sprintf("%X/%X", uint64(l)>>32, uint32(l)) }
+
+// walPosition returns the WAL position of b's server.
+func walPosition(ctx context.Context, b Backup) (lsn, error) {
+	out, err := psqlQuery(ctx, b, walPositionQuery)
+	if err != nil {
+		return 0, err
+	}
+	if out == "" {
+		return 0, errors.New("server returned no WAL position")
+	}
+	return parseLSN(out)
+}
+
+// checkUnchanged reads b's WAL position for the manifest and reports
+// whether it equals the one recorded with the newest dump on dest, i.e.
+// whether the run can be skipped. pos is empty if it couldn't be read.
+func checkUnchanged(ctx context.Context, b Backup, dest Destination) (pos string, unchanged bool) {
+	cur, err := walPosition(ctx, b)
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: reading the WAL position failed, dumping: %v", b.Name, err)
+		return "", false
+	}
+	key, _, err := newestDump(ctx, b, dest)
+	if err != nil || key == "" {
+		if err != nil {
+			log.Printf("[backup] WARNING: %s: finding the newest dump failed, dumping: %v", b.Name, err)
+		}
+		return cur.String(), false
+	}
+	m, err := fetchManifest(ctx, dest, key)
+	if err != nil {
+		log.Printf("[backup] WARNING: %s: reading the manifest of %s failed, dumping: %v", b.Name, path.Base(key), err)
+		return cur.String(), false
+	}
+	if m.WalLSN == "" {
+		log.Printf("[backup] %s: no WAL position recorded with %s, dumping", b.Name, path.Base(key))
+		return cur.String(), false
+	}
+	prev, err := parseLSN(m.WalLSN)
+	switch {
+	case err != nil:
+		log.Printf("[backup] WARNING: %s: manifest of %s: %v, dumping", b.Name, path.Base(key), err)
+	case cur == prev:
+		log.Printf("[backup] %s: WAL position %s unchanged since %s, skipping", b.Name, cur, path.Base(key))
+		return cur.String(), true
+	case cur < prev:
+		log.Printf("[backup] WARNING: %s: WAL position %s is behind %s recorded with %s, a different or restored server; dumping",
+			b.Name, cur, prev, path.Base(key))
+	}
+	return cur.String(), false
+}